@@ -0,0 +1,147 @@
+package frame
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ApprovalPolicy decides whether a new member is active right away or waits
+for an admin to approve them. It is checked when a member signs up, and
+again when they verify their email address. Members it approves record
+"policy:" and the policy's name as who approved them.
+
+Choose one with SiteAuthConfig.ApprovalPolicy. The default is
+ManualApprovalPolicy.
+*/
+type ApprovalPolicy interface {
+	Name() string
+	Approve(member Member) (bool, error)
+}
+
+type approvalPolicyFunc struct {
+	name    string
+	approve func(member Member) (bool, error)
+}
+
+func (p approvalPolicyFunc) Name() string {
+	return p.name
+}
+
+func (p approvalPolicyFunc) Approve(member Member) (bool, error) {
+	return p.approve(member)
+}
+
+/*
+ApprovalPolicyFunc turns a function into an ApprovalPolicy. Use it for
+rules of your own, such as checking a member against another system.
+
+	ApprovalPolicy: frame.ApprovalPolicyFunc("crm-customer", func(member frame.Member) (bool, error) {
+		return crm.IsCustomer(member.Email)
+	}),
+*/
+func ApprovalPolicyFunc(name string, approve func(member Member) (bool, error)) ApprovalPolicy {
+	return approvalPolicyFunc{name: name, approve: approve}
+}
+
+/*
+ManualApprovalPolicy leaves every new member pending until an admin
+activates them.
+*/
+func ManualApprovalPolicy() ApprovalPolicy {
+	return ApprovalPolicyFunc("manual", func(member Member) (bool, error) {
+		return false, nil
+	})
+}
+
+/*
+AutoApprovePolicy approves every new member.
+*/
+func AutoApprovePolicy() ApprovalPolicy {
+	return ApprovalPolicyFunc("auto-approve", func(member Member) (bool, error) {
+		return true, nil
+	})
+}
+
+/*
+AutoApproveDomainsPolicy approves members whose email address is at one of
+domains. Everyone else waits for an admin. Subdomains don't match.
+*/
+func AutoApproveDomainsPolicy(domains ...string) ApprovalPolicy {
+	allowed := map[string]struct{}{}
+
+	for _, domain := range domains {
+		allowed[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))] = struct{}{}
+	}
+
+	return ApprovalPolicyFunc("auto-approve-domains", func(member Member) (bool, error) {
+		at := strings.LastIndex(member.Email, "@")
+
+		if at < 0 {
+			return false, nil
+		}
+
+		_, ok := allowed[strings.ToLower(member.Email[at+1:])]
+		return ok, nil
+	})
+}
+
+/*
+VerifiedEmailApprovalPolicy approves members once they have verified
+their email address. Turn on SiteAuthConfig.VerifyEmailAddresses so they
+are sent a verification link.
+*/
+func VerifiedEmailApprovalPolicy() ApprovalPolicy {
+	return ApprovalPolicyFunc("verified-email", func(member Member) (bool, error) {
+		return member.EmailVerifiedAt != nil, nil
+	})
+}
+
+/*
+applyApprovalPolicy activates a pending member if the approval policy
+approves them. member is updated to match.
+*/
+func (sa *SiteAuth) applyApprovalPolicy(r *http.Request, memberService *MemberService, member *Member) error {
+	var (
+		err      error
+		approved bool
+	)
+
+	if member.Status.ID != MemberPendingApprovalID {
+		return nil
+	}
+
+	if approved, err = sa.approvalPolicy.Approve(*member); err != nil {
+		return fmt.Errorf("approval policy '%s' failed: %w", sa.approvalPolicy.Name(), err)
+	}
+
+	if !approved {
+		return nil
+	}
+
+	approvedBy := "policy:" + sa.approvalPolicy.Name()
+
+	if err = memberService.ApproveMember(member.ID, approvedBy); err != nil {
+		return err
+	}
+
+	member.Status = MembersStatus{
+		ID:     MemberActiveID,
+		Status: MemberActive,
+	}
+
+	member.ApprovedBy = approvedBy
+
+	sa.logger.WithFields(logrus.Fields{
+		"memberID":   member.ID,
+		"approvedBy": approvedBy,
+	}).Info("member approved")
+
+	_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMemberApproved, AuditTargetMember, member.ID).WithActor(approvedBy, ""))
+
+	sa.notifyMemberApproved(*member)
+	return nil
+}
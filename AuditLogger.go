@@ -0,0 +1,615 @@
+package frame
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Actions recorded by Frame. Applications may record their own actions. A
+"noun.verb" name, such as "invoice.paid", keeps them easy to filter.
+*/
+const (
+	AuditActionAccountLocked         string = "member.locked"
+	AuditActionAccountUnlocked       string = "member.unlocked"
+	AuditActionAdminLogin            string = "admin.login"
+	AuditActionAdminLoginFailed      string = "admin.login_failed"
+	AuditActionApiTokenCreated       string = "member.api_token_created"
+	AuditActionApiTokenRevoked       string = "member.api_token_revoked"
+	AuditActionDataExportRequested   string = "member.data_export_requested"
+	AuditActionImpersonationEnded    string = "member.impersonation_ended"
+	AuditActionImpersonationStarted  string = "member.impersonation_started"
+	AuditActionInvitationAccepted    string = "member.invitation_accepted"
+	AuditActionInvitationRevoked     string = "invitation.revoked"
+	AuditActionMagicLinkSent         string = "member.magic_link_sent"
+	AuditActionMemberActivated       string = "member.activated"
+	AuditActionMemberAnonymized      string = "member.anonymized"
+	AuditActionMemberApproved        string = "member.approved"
+	AuditActionMemberDeleted         string = "member.deleted"
+	AuditActionMemberInvited         string = "invitation.created"
+	AuditActionMemberLogin           string = "member.login"
+	AuditActionMemberLoginFailed     string = "member.login_failed"
+	AuditActionMemberSessionRevoked  string = "member.session_revoked"
+	AuditActionMemberSessionsRevoked string = "member.sessions_revoked"
+	AuditActionMemberUpdated         string = "member.updated"
+	AuditActionPasswordReset         string = "member.password_reset"
+	AuditActionRoleCreated           string = "role.created"
+	AuditActionRoleUpdated           string = "role.updated"
+	AuditActionTwoFactorDisabled     string = "member.two_factor_disabled"
+	AuditActionTwoFactorEnabled      string = "member.two_factor_enabled"
+	AuditActionTwoFactorReset        string = "member.two_factor_reset"
+	AuditTargetInvitation            string = "invitation"
+	AuditTargetMember                string = "member"
+	AuditTargetRole                  string = "role"
+)
+
+/*
+AuditEvent records who did what to which thing. Changes holds the fields
+that differ between the before and after values given to WithChanges.
+*/
+type AuditEvent struct {
+	ID            string                 `json:"id"`
+	CreatedAt     time.Time              `json:"createdAt"`
+	Action        string                 `json:"action"`
+	Actor         string                 `json:"actor"`
+	ActorMemberID string                 `json:"actorMemberID"`
+	Changes       map[string]AuditChange `json:"changes"`
+	IPAddress     string                 `json:"ipAddress"`
+	TargetID      string                 `json:"targetID"`
+	TargetType    string                 `json:"targetType"`
+}
+
+/*
+AuditChange is a single field's value before and after an event.
+*/
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+/*
+BeforeString formats the before value for display.
+*/
+func (c AuditChange) BeforeString() string {
+	return formatAuditValue(c.Before)
+}
+
+/*
+AfterString formats the after value for display.
+*/
+func (c AuditChange) AfterString() string {
+	return formatAuditValue(c.After)
+}
+
+func formatAuditValue(value interface{}) string {
+	if value == nil {
+		return "(none)"
+	}
+
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	b, err := json.Marshal(value)
+
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(b)
+}
+
+/*
+AuditEventFilter narrows the events returned by GetAuditEvents. Empty
+fields match everything.
+*/
+type AuditEventFilter struct {
+	Action     string
+	Actor      string
+	From       *time.Time
+	TargetID   string
+	TargetType string
+	To         *time.Time
+}
+
+/*
+NewAuditEvent starts an event for a request. The actor is the logged in
+admin, or the logged in member if there is no admin.
+*/
+func NewAuditEvent(r *http.Request, action, targetType, targetID string) AuditEvent {
+	result := AuditEvent{
+		Action:     action,
+		IPAddress:  RealIP(r),
+		TargetID:   targetID,
+		TargetType: targetType,
+	}
+
+	if admin, ok := AdminPrincipalFromContext(r.Context()); ok {
+		result.Actor = admin.Email
+		result.ActorMemberID = admin.MemberID
+		return result
+	}
+
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		result.Actor = principal.Email
+		result.ActorMemberID = principal.MemberID
+
+		if principal.ImpersonatorUserName != "" {
+			result.Actor = fmt.Sprintf("%s (impersonating %s)", principal.ImpersonatorUserName, principal.Email)
+		}
+	}
+
+	return result
+}
+
+/*
+WithActor sets who performed the action. Use it for events, such as failed
+logins, that happen before anybody is logged in.
+*/
+func (e AuditEvent) WithActor(actor, actorMemberID string) AuditEvent {
+	e.Actor = actor
+	e.ActorMemberID = actorMemberID
+	return e
+}
+
+/*
+WithChanges records the fields that differ between before and after. Both
+are compared using their JSON representation, so fields tagged json:"-",
+such as passwords, are never recorded. Either may be nil.
+*/
+func (e AuditEvent) WithChanges(before, after interface{}) AuditEvent {
+	e.Changes = diffAuditValues(before, after)
+	return e
+}
+
+type AuditLoggerConfig struct {
+	DB       *sql.DB
+	Logger   *logrus.Entry
+	PageSize int
+}
+
+/*
+AuditLogger writes admin and security events to the audit_events table.
+They can be browsed at /admin/audit. Record your application's own events
+with Record:
+
+	app.AuditLogger.Record(frame.NewAuditEvent(r, "invoice.paid", "invoice", invoice.ID).WithChanges(before, after))
+*/
+type AuditLogger struct {
+	db       *sql.DB
+	logger   *logrus.Entry
+	pageSize int
+}
+
+func NewAuditLogger(config AuditLoggerConfig) AuditLogger {
+	return AuditLogger{
+		db:       config.DB,
+		logger:   config.Logger,
+		pageSize: config.PageSize,
+	}
+}
+
+/*
+Record writes an event. Failures are logged as well as returned, so
+callers that can't do anything about them may ignore the error.
+*/
+func (a AuditLogger) Record(event AuditEvent) error {
+	var (
+		err     error
+		changes []byte
+	)
+
+	if a.db == nil {
+		return nil
+	}
+
+	if event.Changes == nil {
+		event.Changes = map[string]AuditChange{}
+	}
+
+	if changes, err = json.Marshal(event.Changes); err != nil {
+		a.logger.WithError(err).WithField("action", event.Action).Error("error encoding audit event changes")
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (
+			created_at,
+			action,
+			actor,
+			actor_member_id,
+			changes,
+			ip_address,
+			target_id,
+			target_type
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8
+		)
+	`
+
+	_, err = a.db.Exec(query, time.Now().UTC(), event.Action, event.Actor, event.ActorMemberID, changes, event.IPAddress, event.TargetID, event.TargetType)
+
+	if err != nil {
+		a.logger.WithError(err).WithFields(logrus.Fields{
+			"action":   event.Action,
+			"actor":    event.Actor,
+			"targetID": event.TargetID,
+		}).Error("error recording audit event")
+	}
+
+	return err
+}
+
+/*
+GetAuditEvents returns a page of events matching the filter, newest first,
+and the total number of matching events.
+*/
+func (a AuditLogger) GetAuditEvents(filter AuditEventFilter, page int) ([]AuditEvent, int, error) {
+	var (
+		err   error
+		rows  *sql.Rows
+		total int
+	)
+
+	result := []AuditEvent{}
+	where := ""
+	args := []interface{}{}
+
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		where += fmt.Sprintf(" AND "+condition, len(args))
+	}
+
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+
+	if filter.Actor != "" {
+		addCondition("actor ILIKE $%d", "%"+filter.Actor+"%")
+	}
+
+	if filter.TargetType != "" {
+		addCondition("target_type = $%d", filter.TargetType)
+	}
+
+	if filter.TargetID != "" {
+		addCondition("target_id = $%d", filter.TargetID)
+	}
+
+	if filter.From != nil {
+		addCondition("created_at >= $%d", *filter.From)
+	}
+
+	if filter.To != nil {
+		addCondition("created_at < $%d", *filter.To)
+	}
+
+	if err = a.db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE 1=1`+where, args...).Scan(&total); err != nil {
+		return result, 0, err
+	}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			action,
+			actor,
+			actor_member_id,
+			changes,
+			ip_address,
+			target_id,
+			target_type
+		FROM audit_events
+		WHERE 1=1
+	` + where + `
+		ORDER BY created_at DESC
+	` + GetDBPaging(page, a.pageSize)
+
+	if rows, err = a.db.Query(query, args...); err != nil {
+		return result, total, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+
+		if event, err = scanAuditEvent(rows); err != nil {
+			return result, total, err
+		}
+
+		result = append(result, event)
+	}
+
+	return result, total, rows.Err()
+}
+
+/*
+GetMemberAuditEvents returns every event a member performed, or that was
+performed on them, oldest first.
+*/
+func (a AuditLogger) GetMemberAuditEvents(memberID string) ([]AuditEvent, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	result := []AuditEvent{}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			action,
+			actor,
+			actor_member_id,
+			changes,
+			ip_address,
+			target_id,
+			target_type
+		FROM audit_events
+		WHERE 1=1
+			AND (actor_member_id = $1 OR (target_type = $2 AND target_id = $1))
+		ORDER BY created_at
+	`
+
+	if rows, err = a.db.Query(query, memberID, AuditTargetMember); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+
+		if event, err = scanAuditEvent(rows); err != nil {
+			return result, err
+		}
+
+		result = append(result, event)
+	}
+
+	return result, rows.Err()
+}
+
+func scanAuditEvent(row rowScanner) (AuditEvent, error) {
+	var changes []byte
+
+	event := AuditEvent{}
+
+	if err := row.Scan(&event.ID, &event.CreatedAt, &event.Action, &event.Actor, &event.ActorMemberID, &changes, &event.IPAddress, &event.TargetID, &event.TargetType); err != nil {
+		return event, err
+	}
+
+	err := json.Unmarshal(changes, &event.Changes)
+	return event, err
+}
+
+/*
+GetAuditActions returns every action that has been recorded, for filtering.
+*/
+func (a AuditLogger) GetAuditActions() ([]string, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	result := []string{}
+
+	if rows, err = a.db.Query(`SELECT DISTINCT action FROM audit_events ORDER BY action`); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var action string
+
+		if err = rows.Scan(&action); err != nil {
+			return result, err
+		}
+
+		result = append(result, action)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+diffAuditValues returns the top level JSON fields that differ between
+before and after.
+*/
+func diffAuditValues(before, after interface{}) map[string]AuditChange {
+	result := map[string]AuditChange{}
+	beforeFields := auditFields(before)
+	afterFields := auditFields(after)
+
+	keys := []string{}
+
+	for key := range beforeFields {
+		keys = append(keys, key)
+	}
+
+	for key := range afterFields {
+		if _, ok := beforeFields[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+			result[key] = AuditChange{Before: beforeFields[key], After: afterFields[key]}
+		}
+	}
+
+	return result
+}
+
+/*
+auditFields flattens value's JSON representation into a map of fields.
+Nested objects use dotted names, such as "role.id".
+*/
+func auditFields(value interface{}) map[string]interface{} {
+	var (
+		b       []byte
+		err     error
+		decoded interface{}
+	)
+
+	result := map[string]interface{}{}
+
+	if value == nil {
+		return result
+	}
+
+	if b, err = json.Marshal(value); err != nil {
+		return result
+	}
+
+	if err = json.Unmarshal(b, &decoded); err != nil {
+		return result
+	}
+
+	/*
+	 * Values that aren't objects are recorded as a single field
+	 */
+	object, ok := decoded.(map[string]interface{})
+
+	if !ok {
+		result["value"] = decoded
+		return result
+	}
+
+	flattenAuditFields(result, "", object)
+	return result
+}
+
+func flattenAuditFields(result map[string]interface{}, prefix string, object map[string]interface{}) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenAuditFields(result, prefix+key+".", nested)
+			continue
+		}
+
+		result[prefix+key] = value
+	}
+}
+
+type AuditData struct {
+	BaseViewModel
+	Actions     []string
+	Events      []AuditEvent
+	Filter      AuditEventFilter
+	From        string
+	NextPage    int
+	Page        int
+	PrevPage    int
+	To          string
+	TotalEvents int
+}
+
+/*
+PageURL links to another page of events with the same filter.
+*/
+func (d AuditData) PageURL(page int) string {
+	query := url.Values{}
+
+	for key, value := range map[string]string{
+		"action":     d.Filter.Action,
+		"actor":      d.Filter.Actor,
+		"from":       d.From,
+		"targetID":   d.Filter.TargetID,
+		"targetType": d.Filter.TargetType,
+		"to":         d.To,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	query.Set("page", strconv.Itoa(page))
+	return "/admin/audit?" + query.Encode()
+}
+
+/*
+GET /admin/audit
+*/
+func (wa *WebApp) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	query := r.URL.Query()
+	page := GetPageFromRequest(r)
+
+	data := AuditData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            wa.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets:        []string{},
+		},
+		Filter: AuditEventFilter{
+			Action:     query.Get("action"),
+			Actor:      strings.TrimSpace(query.Get("actor")),
+			TargetID:   strings.TrimSpace(query.Get("targetID")),
+			TargetType: query.Get("targetType"),
+		},
+		From: query.Get("from"),
+		Page: page,
+		To:   query.Get("to"),
+	}
+
+	if from, err := time.Parse("2006-01-02", data.From); err == nil {
+		data.Filter.From = &from
+	}
+
+	/*
+	 * "To" includes the whole day
+	 */
+	if to, err := time.Parse("2006-01-02", data.To); err == nil {
+		to = to.AddDate(0, 0, 1)
+		data.Filter.To = &to
+	}
+
+	if data.Events, data.TotalEvents, err = wa.auditLogger.GetAuditEvents(data.Filter, page); err != nil {
+		wa.logger.WithError(err).Error("error retrieving audit events")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	if data.Actions, err = wa.auditLogger.GetAuditActions(); err != nil {
+		wa.logger.WithError(err).Error("error retrieving audit actions")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+
+	if page*wa.auditLogger.pageSize < data.TotalEvents {
+		data.NextPage = page + 1
+	}
+
+	wa.RenderTemplate(w, "admin-audit.tmpl", data)
+}
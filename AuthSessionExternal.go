@@ -1,109 +1,329 @@
 package frame
 
-// func (fa *FrameApplication) WithGoogleAuth(scopes ...string) *FrameApplication {
-// 	fa.externalAuths = append(fa.externalAuths, google.New(fa.Config.GoogleClientID, fa.Config.GoogleClientSecret, fa.Config.GoogleRedirectURI, scopes...))
-// 	return fa
-// }
-
-// func (fa *FrameApplication) SetupExternalAuth(pathsExcludedFromAuth, htmlPaths []string) *FrameApplication {
-// 	if fa.sessionStore == nil {
-// 		fa.Logger.Fatal("Please setup a session storage before calling SetupExternalAuth()")
-// 	}
-
-// 	gothic.Store = fa.sessionStore
-
-// 	goth.UseProviders(
-// 		fa.externalAuths...,
-// 	)
-
-// 	fa.router.HandleFunc("/auth/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
-// 		var (
-// 			err     error
-// 			user    goth.User
-// 			session *sessions.Session
-// 			member  Member
-// 		)
-
-// 		user, err = gothic.CompleteUserAuth(w, r)
-
-// 		if err != nil {
-// 			http.Redirect(w, r, UnexpectedErrorPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		/*
-// 		 * If this member doesn't exist yet, create them as an unapproved member
-// 		 */
-// 		member, err = fa.MemberService.GetMemberByEmail(user.Email, true)
-
-// 		if err != nil && errors.Is(err, gorm.ErrRecordNotFound) {
-// 			member = Member{
-// 				AvatarURL:  user.AvatarURL,
-// 				Email:      user.Email,
-// 				ExternalID: user.UserID,
-// 				FirstName:  user.FirstName,
-// 				LastName:   user.LastName,
-// 				Status: MembersStatus{
-// 					ID:     MemberPendingApprovalID,
-// 					Status: MemberPendingApproval,
-// 				},
-// 			}
-
-// 			if err = fa.MemberService.CreateMember(&member); err != nil {
-// 				fa.Logger.WithError(err).Error("error creating new member")
-// 				http.Redirect(w, r, UnexpectedErrorPath, http.StatusTemporaryRedirect)
-// 				return
-// 			}
-
-// 			http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		if err != nil {
-// 			fa.Logger.WithError(err).Error("error getting member information in external auth")
-// 			http.Redirect(w, r, UnexpectedErrorPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		/*
-// 		 * If we have an existing member, but they aren't approved yet,
-// 		 * redirect them.
-// 		 */
-// 		if member.Status.Status != MemberActive {
-// 			http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		/*
-// 		 * Otherwise, we are good to go!
-// 		 */
-// 		if session, err = fa.sessionStore.Get(r, fa.sessionName); err != nil {
-// 			fa.Logger.WithError(err).Error("error geting session")
-// 			http.Redirect(w, r, UnexpectedErrorPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		session.Values["email"] = user.Email
-// 		session.Values["firstName"] = user.FirstName
-// 		session.Values["lastName"] = user.LastName
-// 		session.Values["avatarURL"] = user.AvatarURL
-// 		// session.Values["status"] =
-
-// 		if err = fa.sessionStore.Save(r, w, session); err != nil {
-// 			fa.Logger.WithError(err).Error("error saving session")
-// 			http.Redirect(w, r, UnexpectedErrorPath, http.StatusTemporaryRedirect)
-// 			return
-// 		}
-
-// 		if fa.OnAuthSuccess != nil {
-// 			fa.OnAuthSuccess(w, r, member)
-// 		}
-// 	})
-
-// 	fa.router.HandleFunc("/auth/{provider}", func(w http.ResponseWriter, r *http.Request) {
-// 		gothic.BeginAuthHandler(w, r)
-// 	})
-
-// 	fa.setupMiddleware(pathsExcludedFromAuth, htmlPaths)
-// 	return fa
-// }
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/app-nerds/kit/v6/passwords"
+	"github.com/gorilla/mux"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/google"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ErrExternalAccountMismatch is returned when an external login matches a
+member by email address, but that member is already linked to a different
+external account.
+*/
+var ErrExternalAccountMismatch = errors.New("member is linked to a different external account")
+
+/*
+ErrExternalEmailNotVerified is returned when an external login matches a
+member by email address, but the provider hasn't verified that address.
+Such a login could belong to anyone who typed in the member's address, so
+it is never linked.
+*/
+var ErrExternalEmailNotVerified = errors.New("external provider has not verified the email address")
+
+/*
+ErrInviteOnly is returned when an external login would create a new member
+on an invite only site.
+*/
+var ErrInviteOnly = errors.New("new members must be invited")
+
+/*
+AddExternalAuth lets members log in using accounts at external OAuth
+providers. Any goth.Provider can be used. For local testing goth's "faux"
+provider, or an OAuth2 provider pointed at a local fake server, works
+just as well as a real one. This registers the following endpoints:
+
+- /auth/{provider}
+- /auth/{provider}/callback
+
+Site auth must be configured first by calling AddSiteAuth().
+*/
+func (fa *FrameApplication) AddExternalAuth(providers ...goth.Provider) *FrameApplication {
+	if fa.siteAuth == nil {
+		fa.Logger.Fatalf("please configure site auth before external auth by calling AddSiteAuth()")
+	}
+
+	fa.externalAuths = append(fa.externalAuths, providers...)
+
+	gothic.Store = fa.webApp.GetSessionStore()
+	goth.UseProviders(providers...)
+
+	fa.siteAuth.addExternalAuthProviders(providers)
+	return fa
+}
+
+/*
+GoogleAuthProvider creates a Google OAuth2 provider using the GOOGLE_CLIENT_ID,
+GOOGLE_CLIENT_SECRET, and GOOGLE_REDIRECT_URI configuration values. Pass the
+result to AddExternalAuth().
+*/
+func (fa *FrameApplication) GoogleAuthProvider(scopes ...string) goth.Provider {
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	return google.New(fa.Config.GoogleClientID, fa.Config.GoogleClientSecret, fa.Config.GoogleRedirectURI, scopes...)
+}
+
+func (sa *SiteAuth) addExternalAuthProviders(providers []goth.Provider) {
+	for _, provider := range providers {
+		sa.externalAuthProviders = append(sa.externalAuthProviders, provider.Name())
+	}
+}
+
+func (sa *SiteAuth) RegisterExternalAuthRoutes(router *mux.Router, memberService *MemberService, onAuthSuccess func(w http.ResponseWriter, r *http.Request, member Member)) {
+	sa.routes.public(router.HandleFunc(ExternalAuthCallbackPath, sa.handleExternalAuthCallback(memberService, onAuthSuccess)).Methods(http.MethodGet, http.MethodPost))
+	sa.routes.public(router.HandleFunc(ExternalAuthPath, gothic.BeginAuthHandler).Methods(http.MethodGet))
+}
+
+/*
+GET, POST /auth/{provider}/callback
+*/
+func (sa *SiteAuth) handleExternalAuthCallback(memberService *MemberService, onAuthSuccess func(w http.ResponseWriter, r *http.Request, member Member)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err    error
+			user   goth.User
+			member Member
+		)
+
+		if user, err = gothic.CompleteUserAuth(w, r); err != nil {
+			sa.logger.WithError(err).WithField("ip", RealIP(r)).Error("error completing external authentication")
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		logger := sa.logger.WithFields(logrus.Fields{
+			"provider": user.Provider,
+			"ip":       RealIP(r),
+		})
+
+		if member, err = sa.findOrCreateExternalMember(r, memberService, user); errors.Is(err, ErrInviteOnly) {
+			logger.Warn("external login for an email address that has not been invited")
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		if errors.Is(err, ErrExternalEmailNotVerified) {
+			logger.Warn("external login with an unverified email address matches an existing member")
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		if err != nil {
+			logger.WithError(err).Error("error finding or creating member from external authentication")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * If this member isn't approved yet, or has been deleted, redirect them.
+		 */
+		if member.Status.ID != MemberActiveID || member.DeletedAt != nil {
+			http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * Members whose provider didn't verify their email address have to
+		 * verify it with us first.
+		 */
+		if sa.requireVerifiedEmail && member.EmailVerifiedAt == nil {
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * Members with two-factor authentication turned on still need to provide
+		 * a code from their authenticator app.
+		 */
+		if member.TotpEnabledAt != nil {
+			if err = sa.beginTwoFactorLogin(w, r, member, "/"); err != nil {
+				logger.WithError(err).Error("error starting two-factor login")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			http.Redirect(w, r, SiteAuthTwoFactorPath, http.StatusFound)
+			return
+		}
+
+		if err = sa.writeMemberSession(w, r, member); err != nil {
+			logger.WithError(err).Error("error saving session")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if onAuthSuccess != nil {
+			onAuthSuccess(w, r, member)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+/*
+findOrCreateExternalMember finds the member for an externally authenticated
+user. Members are matched first by external ID, then by email address. An
+existing member matched by email is only linked to the external account
+when the provider says it verified the address. If no member is found a
+new one is created pending approval. A new member's email address is
+marked verified only when the provider verified it. Otherwise they are
+sent a verification email.
+*/
+func (sa *SiteAuth) findOrCreateExternalMember(r *http.Request, memberService *MemberService, user goth.User) (Member, error) {
+	var (
+		err      error
+		member   Member
+		role     MemberRole
+		password string
+	)
+
+	externalID := user.Provider + ":" + user.UserID
+
+	member, err = memberService.GetMemberByExternalID(externalID, true)
+
+	if err == nil {
+		return member, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Member{}, err
+	}
+
+	if user.Email == "" {
+		return Member{}, fmt.Errorf("provider '%s' did not return an email address", user.Provider)
+	}
+
+	/*
+	 * Link to an existing member with the same email address
+	 */
+	member, err = memberService.GetMemberByEmail(user.Email, true)
+
+	if err == nil {
+		if member.ExternalID != "" && member.ExternalID != externalID {
+			return Member{}, ErrExternalAccountMismatch
+		}
+
+		if !externalEmailVerified(user) {
+			return Member{}, ErrExternalEmailNotVerified
+		}
+
+		if err = memberService.LinkMemberExternalID(member.ID, externalID); err != nil {
+			return Member{}, fmt.Errorf("error linking member to external account: %w", err)
+		}
+
+		member.ExternalID = externalID
+		return member, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Member{}, err
+	}
+
+	if sa.inviteOnly {
+		return Member{}, ErrInviteOnly
+	}
+
+	/*
+	 * This is a brand new member. They get a random password they don't know,
+	 * so they can only log in through the provider until they reset it.
+	 */
+	if role, err = memberService.GetMemberRole(BaseMemberRole); err != nil {
+		return Member{}, fmt.Errorf("error retrieving member role: %w", err)
+	}
+
+	if password, err = generateSecureToken(); err != nil {
+		return Member{}, err
+	}
+
+	firstName, lastName := user.FirstName, user.LastName
+
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(user.Name, " ")
+	}
+
+	member = Member{
+		AvatarURL:  user.AvatarURL,
+		Email:      user.Email,
+		ExternalID: externalID,
+		FirstName:  firstName,
+		LastName:   lastName,
+		Password:   passwords.HashedPasswordString(password),
+		Status: MembersStatus{
+			ID:     MemberPendingApprovalID,
+			Status: MemberPendingApproval,
+		},
+		Role: role,
+	}
+
+	if err = memberService.CreateMember(&member); err != nil {
+		return Member{}, fmt.Errorf("error creating new member: %w", err)
+	}
+
+	if externalEmailVerified(user) {
+		if err = memberService.MarkMemberEmailVerified(member.ID); err != nil {
+			return Member{}, fmt.Errorf("error marking new member email verified: %w", err)
+		}
+
+		now := time.Now().UTC()
+		member.EmailVerifiedAt = &now
+	}
+
+	if err = sa.applyApprovalPolicy(r, memberService, &member); err != nil {
+		return Member{}, err
+	}
+
+	if member.EmailVerifiedAt == nil && sa.verifyEmailAddresses {
+		if err = sa.sendVerificationEmail(member); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error sending verification email to new member")
+		}
+	}
+
+	if member.Status.ID == MemberPendingApprovalID {
+		sa.notifyPendingApproval(memberService, member)
+	}
+
+	sa.logger.WithFields(logrus.Fields{
+		"memberID": member.ID,
+		"provider": user.Provider,
+	}).Info("new member created from external authentication")
+
+	return member, nil
+}
+
+/*
+externalEmailVerified returns true when the provider says it verified the
+user's email address. OpenID Connect providers send an email_verified
+claim, and Google's profile endpoint sends verified_email. Providers that
+say neither are treated as unverified.
+*/
+func externalEmailVerified(user goth.User) bool {
+	for _, key := range []string{"email_verified", "verified_email"} {
+		switch value := user.RawData[key].(type) {
+		case bool:
+			if value {
+				return true
+			}
+
+		case string:
+			if verified, err := strconv.ParseBool(value); err == nil && verified {
+				return true
+			}
+		}
+	}
+
+	return false
+}
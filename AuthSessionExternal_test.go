@@ -0,0 +1,70 @@
+package frame
+
+import (
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/faux"
+)
+
+func TestExternalEmailVerified(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawData map[string]interface{}
+		want    bool
+	}{
+		{name: "no claims", rawData: nil, want: false},
+		{name: "openid connect verified", rawData: map[string]interface{}{"email_verified": true}, want: true},
+		{name: "openid connect unverified", rawData: map[string]interface{}{"email_verified": false}, want: false},
+		{name: "openid connect verified as string", rawData: map[string]interface{}{"email_verified": "true"}, want: true},
+		{name: "google verified", rawData: map[string]interface{}{"verified_email": true}, want: true},
+		{name: "google unverified", rawData: map[string]interface{}{"verified_email": false}, want: false},
+		{name: "unrelated claim", rawData: map[string]interface{}{"verified": true}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := goth.User{Email: "member@example.com", RawData: test.rawData}
+
+			if got := externalEmailVerified(user); got != test.want {
+				t.Errorf("externalEmailVerified() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+/*
+The faux provider makes no claim about the email address it returns, so
+a login through it must never be linked to an existing member.
+*/
+func TestExternalEmailVerifiedFauxProvider(t *testing.T) {
+	provider := &faux.Provider{}
+
+	session, err := provider.BeginAuth("state")
+
+	if err != nil {
+		t.Fatalf("BeginAuth() error = %v", err)
+	}
+
+	fauxSession := session.(*faux.Session)
+	fauxSession.Email = "member@example.com"
+	fauxSession.Name = "Some Member"
+
+	if _, err = session.Authorize(provider, nil); err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+
+	user, err := provider.FetchUser(session)
+
+	if err != nil {
+		t.Fatalf("FetchUser() error = %v", err)
+	}
+
+	if user.Email != "member@example.com" {
+		t.Fatalf("FetchUser() email = %q, want %q", user.Email, "member@example.com")
+	}
+
+	if externalEmailVerified(user) {
+		t.Errorf("externalEmailVerified() = true for a provider that didn't verify the email address")
+	}
+}
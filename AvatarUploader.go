@@ -0,0 +1,27 @@
+package frame
+
+import "io"
+
+/*
+AvatarUploader stores an avatar a member uploaded and returns the URL it
+can be viewed at. Set one with WithAvatarUploader().
+*/
+type AvatarUploader func(member Member, fileName string, file io.Reader) (string, error)
+
+/*
+WithAvatarUploader sets where member avatars are stored. Without one,
+members can't upload an avatar. Site auth must be configured first by
+calling AddSiteAuth().
+
+	app.WithAvatarUploader(func(member frame.Member, fileName string, file io.Reader) (string, error) {
+		return imageStore.Save("avatars", fileName, file)
+	})
+*/
+func (fa *FrameApplication) WithAvatarUploader(uploader AvatarUploader) *FrameApplication {
+	if fa.siteAuth == nil {
+		fa.Logger.Fatalf("please configure site auth before adding an avatar uploader by calling AddSiteAuth()")
+	}
+
+	fa.memberManagement.avatarUploader = uploader
+	return fa
+}
@@ -3,5 +3,7 @@ package frame
 type BaseViewModel struct {
 	JavascriptIncludes
 	AppName     string
+	CSRFToken   string
+	Permissions PermissionSet
 	Stylesheets []string
 }
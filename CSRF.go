@@ -0,0 +1,277 @@
+package frame
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	/*
+	 * CSRFFieldName is the name of the hidden form field that carries the
+	 * CSRF token. Javascript requests send it in the X-CSRF-Token header
+	 * instead.
+	 */
+	CSRFFieldName string = "csrf_token"
+)
+
+/*
+csrfStaticPaths serve files, and never render forms or accept posts.
+*/
+var csrfStaticPaths = []string{"/static", "/frame-static", "/admin-static"}
+
+/*
+csrfProtection checks CSRF tokens, and keeps the routes that don't check
+them. Each visitor's token is kept in their member session, or their admin
+session on admin routes, so it ends when that session does.
+*/
+type csrfProtection struct {
+	lock         *sync.RWMutex
+	logger       *logrus.Entry
+	skippedPaths map[string]struct{}
+}
+
+func newCSRFProtection(logger *logrus.Entry) *csrfProtection {
+	return &csrfProtection{
+		lock:         &sync.RWMutex{},
+		logger:       logger,
+		skippedPaths: map[string]struct{}{},
+	}
+}
+
+/*
+skip turns off CSRF checks for routes registered with these path templates.
+Webhook receivers and token based APIs don't use cookies, so they can't be
+forged by another site.
+*/
+func (c *csrfProtection) skip(paths ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, path := range paths {
+		c.skippedPaths[path] = struct{}{}
+	}
+}
+
+func (c *csrfProtection) isSkipped(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+
+	if route == nil {
+		return false
+	}
+
+	path, err := route.GetPathTemplate()
+
+	if err != nil {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, ok := c.skippedPaths[path]
+	return ok
+}
+
+/*
+middleware puts the visitor's CSRF token in the request context. POST,
+PUT, PATCH, and DELETE requests must send the token back, either in the
+csrf_token form field or the X-CSRF-Token header. Requests that site auth
+has authenticated with an API token or JWT are not checked, so this must
+run after the site auth middleware.
+*/
+func (c *csrfProtection) middleware(webApp *WebApp, routes *routeRegistry, forbidden func(w http.ResponseWriter, r *http.Request)) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				session *sessions.Session
+			)
+
+			if authenticatedWithBearerToken(r) || pathHasAnyPrefix(r.URL.Path, csrfStaticPaths) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sessionName, sessionStore := webApp.GetSessionName(), webApp.GetSessionStore()
+
+			if csrfUsesAdminSession(r, routes) {
+				sessionName, sessionStore = webApp.GetAdminSessionName(), webApp.GetAdminSessionStore()
+			}
+
+			/*
+			 * A session that can't be decoded, such as one signed with an old
+			 * key, is replaced with a new one. Visitors without a token are
+			 * only given one when a page asks for it, so requests that never
+			 * render a form don't create sessions.
+			 */
+			session, _ = sessionStore.Get(r, sessionName)
+			token, _ := session.Values["csrfToken"].(string)
+
+			requestToken := &csrfRequestToken{
+				token: token,
+				mint: func() string {
+					newToken, err := renewCSRFToken(session)
+
+					if err != nil {
+						c.logger.WithError(err).Error("error generating csrf token")
+						return ""
+					}
+
+					if err = sessionStore.Save(r, w, session); err != nil {
+						c.logger.WithError(err).Error("error saving csrf token to session")
+						return ""
+					}
+
+					return newToken
+				},
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), csrfTokenContextKey, requestToken))
+
+			if !csrfMethodRequiresToken(r.Method) || c.isSkipped(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sentToken := r.Header.Get(AllowHeaderCSRF)
+
+			if sentToken == "" {
+				sentToken = r.PostFormValue(CSRFFieldName)
+			}
+
+			if token == "" || subtle.ConstantTimeCompare([]byte(sentToken), []byte(token)) != 1 {
+				c.logger.WithFields(logrus.Fields{
+					"event":  "csrf_failed",
+					"ip":     RealIP(r),
+					"method": r.Method,
+					"path":   r.URL.Path,
+				}).Warn("request has a missing or invalid csrf token")
+
+				forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+csrfRequestToken is the CSRF token for one request. A visitor who doesn't
+have one yet gets one the first time a handler asks for it.
+*/
+type csrfRequestToken struct {
+	mint  func() string
+	token string
+}
+
+func (t *csrfRequestToken) get() string {
+	if t.token == "" {
+		t.token = t.mint()
+	}
+
+	return t.token
+}
+
+/*
+csrfUsesAdminSession returns true when the token for this request belongs
+in the admin session. Routes declared for admins use it wherever they are
+mounted, and member routes never do. Anything else, such as the admin
+login page, uses it when it is below /admin.
+*/
+func csrfUsesAdminSession(r *http.Request, routes *routeRegistry) bool {
+	if auth, declared := routes.lookup(r); declared && auth.level != AuthPublic {
+		return auth.level == AuthAdmin
+	}
+
+	return pathHasPrefix(r.URL.Path, "/admin")
+}
+
+/*
+authenticatedWithBearerToken returns true when site auth has checked an API
+token or JWT for this request. Those don't use cookies, so they can't be
+forged by another site. A bearer header alone proves nothing.
+*/
+func authenticatedWithBearerToken(r *http.Request) bool {
+	principal, ok := PrincipalFromContext(r.Context())
+	return ok && (principal.AuthMethod == AuthMethodApiToken || principal.AuthMethod == AuthMethodJwt)
+}
+
+/*
+renewCSRFToken puts a new CSRF token in session and returns it. Sessions
+get a new token when someone logs in, so a token picked up before login
+can't be used after it.
+*/
+func renewCSRFToken(session *sessions.Session) (string, error) {
+	token, err := generateSecureToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	session.Values["csrfToken"] = token
+	return token, nil
+}
+
+func csrfMethodRequiresToken(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete
+}
+
+/*
+CSRFToken returns the CSRF token for the current visitor. Put it in your
+view model's CSRFToken field and add the hidden form field with the
+csrfField template function:
+
+	<form method="POST">
+		{{csrfField .CSRFToken}}
+	</form>
+*/
+func CSRFToken(r *http.Request) string {
+	token, ok := r.Context().Value(csrfTokenContextKey).(*csrfRequestToken)
+
+	if !ok {
+		return ""
+	}
+
+	return token.get()
+}
+
+/*
+templateFuncCSRFField writes the hidden form field that carries a CSRF
+token.
+*/
+func templateFuncCSRFField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + CSRFFieldName + `" value="` + template.HTMLEscapeString(token) + `" />`)
+}
+
+/*
+sendCSRFFailedResponse shows the forbidden page when a form post fails
+the CSRF check. Javascript and API requests get a JSON response.
+*/
+func (fa *FrameApplication) sendCSRFFailedResponse(w http.ResponseWriter, r *http.Request) {
+	if fa.webApp == nil || r.Header.Get(AllowHeaderCSRF) != "" || strings.HasPrefix(r.Header.Get(AllowHeaderContentType), "application/json") {
+		sendJSONStatusResponse(w, http.StatusForbidden, "Invalid CSRF token")
+		return
+	}
+
+	data := struct {
+		Message     string
+		Stylesheets []string
+	}{
+		Message: "Your session has expired, or this form was submitted from another site. Please go back, reload the page, and try again.",
+		Stylesheets: []string{
+			"/frame-static/css/frame-page-styles.css",
+		},
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	fa.webApp.RenderTemplate(w, "forbidden.tmpl", data)
+}
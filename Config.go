@@ -12,33 +12,49 @@ type Config struct {
 	AdminSessionKey    string `flag:"adminsessionkey" env:"ADMIN_SESSION_KEY" default:"my-secret-key" description:"Key used to encrypt admin sessions"`
 	AdminSessionMaxAge int    `flag:"adminsessionmaxage" env:"ADMIN_SESSION_MAX_AGE" default:"86400" description:"Number of seconds a session is valid for"`
 	AdminSessionName   string `flag:"adminsessionname" env:"ADMIN_SESSION_NAME" default:"" description:"Name of cookie sessions"`
+	Argon2Iterations   int    `flag:"argon2iterations" env:"ARGON2_ITERATIONS" default:"3" description:"Number of passes Argon2id makes when hashing passwords"`
+	Argon2Memory       int    `flag:"argon2memory" env:"ARGON2_MEMORY" default:"65536" description:"KiB of memory Argon2id uses when hashing passwords"`
+	Argon2Parallelism  int    `flag:"argon2parallelism" env:"ARGON2_PARALLELISM" default:"2" description:"Number of threads Argon2id uses when hashing passwords"`
 	AutoSSLEmail       string `flag:"autosslemail" env:"AUTO_SSL_EMAIL" default:"" description:"Email address to use for Lets Encrypt"`
 	AutoSSLWhitelist   string `flag:"autosslwhitelist" env:"AUTO_SSL_WHITELIST" default:"" description:"Comma-seperated list of domains for SSL"`
+	BcryptCost         int    `flag:"bcryptcost" env:"BCRYPT_COST" default:"10" description:"Cost used when hashing passwords with bcrypt"`
 	DatabaseTimeout    int    `flag:"databasetimeout" env:"DATABASE_TIMEOUT" default:"30" description:"Timeout for database connections"`
 	Debug              bool   `flag:"debug" env:"DEBUG" default:"true" description:"True to turn on debug mode."`
 	DSN                string `flag:"dsn" env:"DSN" default:"host=localhost user=postgres password=password dbname=frame port=5432" description:"DSN string to connect to a database"`
 	FireplaceURL       string `flag:"fireplaceurl" env:"FIREPLACE_URL" default:"" description:"URL to a Fireplace logging server"`
 	FireplacePassword  string `flag:"fireplacepassword" env:"FIREPLACE_PASSWORD" default:"" description:"Password to the Fireplace logging server"`
-	GobucketURL        string `flag:"gobucketurl" env:"GOBUCKET_URL" default:"" description:"URL to a Gobucket Server"`
-	GobucketClientCode string `flag:"gobucketclientcode" env:"GOBUCKET_CLIENT_CODE" default:"" description:"Client Code to a Gobucket Server"`
-	GobucketAppKey     string `flag:"gobucketappkey" env:"GOBUCKET_APP_KEY" default:"" description:"App Key token to connect to a Gobucket Server"`
 	GoogleClientID     string `flag:"googleclientid" env:"GOOGLE_CLIENT_ID" default:"" description:"Google OAuth2 client ID"`
 	GoogleClientSecret string `flag:"googleclientsecret" env:"GOOGLE_CLIENT_SECRET" default:"" description:"Google OAuth2 client secret"`
 	GoogleRedirectURI  string `flag:"googleredirecturi" env:"GOOGLE_REDIRECT_URI" default:"http://localhost:8080/auth/google/callback" description:"Google OAuth2 redirect URI"`
+	JwtSigningKey      string `flag:"jwtsigningkey" env:"JWT_SIGNING_KEY" default:"" description:"Key used to sign member JWT access tokens. At least 32 characters"`
+	LoginAttemptWindow int    `flag:"loginattemptwindow" env:"LOGIN_ATTEMPT_WINDOW" default:"900" description:"Number of seconds failed login attempts are counted for"`
+	LoginBackoff       int    `flag:"loginbackoff" env:"LOGIN_BACKOFF" default:"1" description:"Seconds to wait after a failed login. Doubles with each failure. 0 turns off backoff"`
+	LoginLockoutTime   int    `flag:"loginlockouttime" env:"LOGIN_LOCKOUT_TIME" default:"1800" description:"Seconds a locked account stays locked. 0 keeps it locked until unlocked"`
+	LoginMaxAttempts   int    `flag:"loginmaxattempts" env:"LOGIN_MAX_ATTEMPTS" default:"5" description:"Failed logins for an account before it is locked. 0 turns off lockout"`
+	LoginMaxIPAttempts int    `flag:"loginmaxipattempts" env:"LOGIN_MAX_IP_ATTEMPTS" default:"20" description:"Failed logins from an IP address before it is blocked. 0 turns off IP blocking"`
 	LogLevel           string `flag:"loglevel" env:"LOG_LEVEL" default:"debug" description:"Minimum log level to report"`
+	MagicLinkIPLimit   int    `flag:"magiclinkiplimit" env:"MAGIC_LINK_IP_LIMIT" default:"10" description:"Magic links an IP address can request within the login attempt window. 0 turns off the limit"`
+	MagicLinkLimit     int    `flag:"magiclinklimit" env:"MAGIC_LINK_LIMIT" default:"3" description:"Magic links an email address can be sent within the login attempt window. 0 turns off the limit"`
 	MailApiKey         string `flag:"mailapikey" env:"MAIL_API_KEY" default:"" description:"API Key to a mail service account (sendgrid)"`
+	MailFromEmail      string `flag:"mailfromemail" env:"MAIL_FROM_EMAIL" default:"" description:"Email address Frame sends member emails from"`
+	MailFromName       string `flag:"mailfromname" env:"MAIL_FROM_NAME" default:"" description:"Name Frame sends member emails from"`
 	Nsqd               string `flag:"nsqd" env:"NSQD" default:"nsqd:4150" description:"Address to NSQD server"`
 	NsqLookupd         string `flag:"nsqlookupd" env:"NSQ_LOOKUPD" default:"nsqlookupd:4161" description:"Address to NSQ lookup service"`
 	PageSize           int    `flag:"pagesize" env:"PAGE_SIZE" default:"25" description:"Size of pages for results"`
+	PasswordHasher     string `flag:"passwordhasher" env:"PASSWORD_HASHER" default:"argon2id" description:"Algorithm used to hash new passwords. Either argon2id or bcrypt"`
+	PasswordListFile   string `flag:"passwordlistfile" env:"PASSWORD_LIST_FILE" default:"" description:"File of breached passwords, one per line, that new passwords can't be. Required while the password policy rejects common passwords"`
+	RootUserEnabled    bool   `flag:"rootuserenabled" env:"ROOT_USER_ENABLED" default:"true" description:"True to allow the break-glass root user to log into admin"`
 	RootUserName       string `flag:"rootusername" env:"ROOT_USER_NAME" default:"root" description:"root user name for admin"`
 	RootUserPassword   string `flag:"rootUserPassword" env:"ROOT_USER_PASSWORD" default:"password" description:"Password to the root admin user"`
 	ServerHost         string `flag:"serverhost" env:"SERVER_HOST" default:"localhost:8080" description:"Host and port to bind to"`
 	SessionKey         string `flag:"sessionkey" env:"SESSION_KEY" default:"my-secret-key" description:"Key used to encrypt sessions"`
 	SessionMaxAge      int    `flag:"sessionmaxage" env:"SESSION_MAX_AGE" default:"86400" description:"Number of seconds a session is valid for"`
 	SessionName        string `flag:"sessionname" env:"SESSION_NAME" default:"" description:"Name of cookie sessions"`
+	SiteURL            string `flag:"siteurl" env:"SITE_URL" default:"http://localhost:8080" description:"Public base URL of the site. Used to build links in emails"`
 	ServerIdleTimeout  int    `flag:"serveridletimeout" env:"SERVER_IDLE_TIMEOUT" default:"30" description:"Timeout for HTTP idle"`
 	ServerReadTimeout  int    `flag:"serverreadtimeout" env:"SERVER_READ_TIMEOUT" default:"60" description:"Timeout for HTTP reads"`
 	ServerWriteTimeout int    `flag:"serverwritetimeout" env:"SERVER_WRITE_TIMEOUT" default:"30" description:"Timeout for HTTP writes"`
+	TokenSigningKey    string `flag:"tokensigningkey" env:"TOKEN_SIGNING_KEY" default:"" description:"Key used to sign email verification and account unlock links. At least 32 characters"`
 }
 
 func NewConfig(appName, version string) *Config {
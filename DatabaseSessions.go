@@ -0,0 +1,220 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+/*
+DatabaseSessionStore is a sessions.Store that keeps session values in the
+database. The cookie only carries a signed, random token. Because the
+values live on the server, a session can be revoked by deleting its row.
+*/
+type DatabaseSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	sessionService *SessionService
+}
+
+func DatabaseSessions(config *Config, sessionService *SessionService) (string, sessions.Store) {
+	sessionStorage := NewDatabaseSessionStore(sessionService, []byte(config.SessionKey))
+	sessionStorage.MaxAge(config.SessionMaxAge)
+	sessionStorage.Options.Path = "/"
+	sessionStorage.Options.HttpOnly = true
+	sessionStorage.Options.Secure = config.Debug
+
+	return config.SessionName, sessionStorage
+}
+
+func AdminDatabaseSessions(config *Config, sessionService *SessionService) (string, sessions.Store) {
+	sessionStorage := NewDatabaseSessionStore(sessionService, []byte(config.AdminSessionKey))
+	sessionStorage.MaxAge(config.AdminSessionMaxAge)
+	sessionStorage.Options.Path = "/"
+	sessionStorage.Options.HttpOnly = true
+	sessionStorage.Options.Secure = config.Debug
+
+	return config.AdminSessionName, sessionStorage
+}
+
+/*
+NewDatabaseSessionStore creates a new database session store. keyPairs are
+used to sign the session token cookie, the same way they are used by
+sessions.NewCookieStore. The session service is a pointer because it is
+not available until the database is configured.
+*/
+func NewDatabaseSessionStore(sessionService *SessionService, keyPairs ...[]byte) *DatabaseSessionStore {
+	result := &DatabaseSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		sessionService: sessionService,
+	}
+
+	result.MaxAge(result.Options.MaxAge)
+	return result
+}
+
+/*
+MaxAge sets the maximum age, in seconds, for the store and its sessions.
+*/
+func (s *DatabaseSessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+/*
+Get returns a session for the given name after adding it to the registry.
+*/
+func (s *DatabaseSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+/*
+New returns the session for the given name. If the cookie is missing or
+invalid, or the session has expired or been revoked, a new empty session
+is returned.
+*/
+func (s *DatabaseSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	var (
+		err       error
+		cookie    *http.Cookie
+		token     string
+		dbSession DatabaseSession
+	)
+
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	if cookie, err = r.Cookie(name); err != nil {
+		return session, nil
+	}
+
+	if err = securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	dbSession, err = s.sessionService.GetSessionByToken(token)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, nil
+	}
+
+	if err != nil {
+		return session, err
+	}
+
+	if err = (securecookie.GobEncoder{}).Deserialize(dbSession.Data, &session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	return session, nil
+}
+
+/*
+Save writes the session values to the database and sets the token cookie.
+A session with a negative MaxAge is deleted.
+*/
+func (s *DatabaseSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	var (
+		err     error
+		data    []byte
+		encoded string
+	)
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err = s.sessionService.DeleteSessionByToken(session.ID); err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		if session.ID, err = generateSecureToken(); err != nil {
+			return err
+		}
+	}
+
+	if data, err = (securecookie.GobEncoder{}).Serialize(session.Values); err != nil {
+		return err
+	}
+
+	maxAge := session.Options.MaxAge
+
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+
+	dbSession := DatabaseSession{
+		ExpiresAt:   time.Now().Add(time.Duration(maxAge) * time.Second),
+		SessionName: session.Name(),
+		MemberID:    sessionMemberID(session),
+		IPAddress:   RealIP(r),
+		UserAgent:   r.UserAgent(),
+		Data:        data,
+	}
+
+	if err = s.sessionService.SaveSession(session.ID, dbSession); err != nil {
+		return err
+	}
+
+	if encoded, err = securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+/*
+renewSessionID gives a session a new token the next time it is saved and
+removes the old one. This is done when someone logs in so a token issued
+before login can't be used afterward.
+*/
+func (s *DatabaseSessionStore) renewSessionID(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.sessionService.DeleteSessionByToken(session.ID); err != nil {
+			return err
+		}
+	}
+
+	session.ID = ""
+	return nil
+}
+
+/*
+sessionMemberID finds the member a session belongs to, so sessions can be
+listed and revoked per member.
+*/
+func sessionMemberID(session *sessions.Session) string {
+	if memberID, ok := session.Values["memberID"].(string); ok && memberID != "" {
+		return memberID
+	}
+
+	if memberID, ok := session.Values["adminMemberID"].(string); ok {
+		return memberID
+	}
+
+	return ""
+}
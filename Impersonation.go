@@ -0,0 +1,353 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+var bodyTagRegex = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+/*
+PUT /admin/api/member/impersonate/{id}
+*/
+func (mm *MemberManagement) handleMemberImpersonate(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		member Member
+	)
+
+	vars := mux.Vars(r)
+	admin, ok := AdminPrincipalFromContext(r.Context())
+
+	if !ok {
+		WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("User unauthorized", "", ""))
+		return
+	}
+
+	if member, err = mm.memberService.GetMemberByID(vars["id"], false); err != nil {
+		mm.logger.WithError(err).WithField("memberID", vars["id"]).Error("error getting member information in handleMemberImpersonate()")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error retrieving member information", err.Error(), ""))
+		return
+	}
+
+	if member.Status.ID != MemberActiveID {
+		WriteJSON(w, http.StatusBadRequest, CreateGenericErrorResponse("Only active members can be impersonated", "", ""))
+		return
+	}
+
+	if err = mm.siteAuth.startImpersonation(w, r, member, admin); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error starting impersonation")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error starting impersonation", err.Error(), ""))
+		return
+	}
+
+	mm.logger.WithFields(logrus.Fields{
+		"event":         "impersonation_started",
+		"adminUserName": admin.Email,
+		"adminMemberID": admin.MemberID,
+		"memberID":      member.ID,
+		"memberEmail":   member.Email,
+		"ip":            RealIP(r),
+	}).Warn("admin started impersonating a member")
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionImpersonationStarted, AuditTargetMember, member.ID))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Impersonation started"))
+}
+
+/*
+POST /member/impersonation/end
+*/
+func (sa *SiteAuth) handleEndImpersonation(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+		sa.logger.WithError(err).Error("error getting session information")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	memberID, _ := session.Values["memberID"].(string)
+
+	if !sa.endImpersonation(r, session) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	session.Options.MaxAge = -1
+
+	if err = sa.sessionStore.Save(r, w, session); err != nil {
+		sa.logger.WithError(err).Error("error deleting impersonation session")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	/*
+	 * The admin session was never touched, so the admin is right back
+	 * where they started.
+	 */
+	http.Redirect(w, r, "/admin/members/edit/"+memberID, http.StatusFound)
+}
+
+/*
+startImpersonation gives the admin's browser a member session for member.
+The session remembers who the admin is. Their admin session is left alone.
+*/
+func (sa *SiteAuth) startImpersonation(w http.ResponseWriter, r *http.Request, member Member, admin *Principal) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+		return fmt.Errorf("error getting session: %w", err)
+	}
+
+	if store, ok := sa.sessionStore.(*DatabaseSessionStore); ok {
+		if err = store.renewSessionID(session); err != nil {
+			return fmt.Errorf("error renewing session: %w", err)
+		}
+	}
+
+	setMemberSessionValues(session, member)
+	session.Values["impersonatorUserName"] = admin.Email
+	session.Values["impersonatorMemberID"] = admin.MemberID
+	session.Values["impersonationStartedAt"] = time.Now().UTC().Unix()
+
+	if _, err = renewCSRFToken(session); err != nil {
+		return fmt.Errorf("error renewing csrf token: %w", err)
+	}
+
+	return sa.sessionStore.Save(r, w, session)
+}
+
+/*
+endImpersonation logs the end of an impersonation session. It returns false
+if the session isn't an impersonation.
+*/
+func (sa *SiteAuth) endImpersonation(r *http.Request, session *sessions.Session) bool {
+	impersonatorUserName, _ := session.Values["impersonatorUserName"].(string)
+
+	if impersonatorUserName == "" {
+		return false
+	}
+
+	impersonatorMemberID, _ := session.Values["impersonatorMemberID"].(string)
+	memberID, _ := session.Values["memberID"].(string)
+	startedAt, _ := session.Values["impersonationStartedAt"].(int64)
+
+	sa.logger.WithFields(logrus.Fields{
+		"event":         "impersonation_ended",
+		"adminUserName": impersonatorUserName,
+		"adminMemberID": impersonatorMemberID,
+		"memberID":      memberID,
+		"duration":      time.Since(time.Unix(startedAt, 0)).Round(time.Second).String(),
+		"ip":            RealIP(r),
+	}).Warn("admin stopped impersonating a member")
+
+	_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionImpersonationEnded, AuditTargetMember, memberID).WithActor(impersonatorUserName, impersonatorMemberID))
+
+	return true
+}
+
+/*
+impersonationExpired returns true when session is an impersonation that
+has lasted longer than the impersonation TTL.
+*/
+func (sa *SiteAuth) impersonationExpired(session *sessions.Session) bool {
+	impersonatorUserName, _ := session.Values["impersonatorUserName"].(string)
+
+	if impersonatorUserName == "" {
+		return false
+	}
+
+	startedAt, _ := session.Values["impersonationStartedAt"].(int64)
+	return time.Since(time.Unix(startedAt, 0)) > sa.impersonationTTL
+}
+
+/*
+isImpersonating returns true when an admin is impersonating the member
+making this request.
+*/
+func isImpersonating(r *http.Request) bool {
+	principal, ok := PrincipalFromContext(r.Context())
+	return ok && principal.ImpersonatorUserName != ""
+}
+
+/*
+sendImpersonationForbidden shows the forbidden page on member pages an
+admin can't use while impersonating. Changes made there, such as a new
+two-factor secret, would outlive the impersonation.
+*/
+func (mm *MemberManagement) sendImpersonationForbidden(w http.ResponseWriter, message string) {
+	data := struct {
+		Message     string
+		Stylesheets []string
+	}{
+		Message: message,
+		Stylesheets: []string{
+			"/frame-static/css/frame-page-styles.css",
+		},
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	mm.webApp.RenderTemplate(w, "forbidden.tmpl", data)
+}
+
+/*
+impersonationBannerMiddleware adds a banner to the top of every HTML page
+while an admin is impersonating a member. It has a button that ends the
+impersonation and returns the admin to the admin section.
+*/
+func (sa *SiteAuth) impersonationBannerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pathHasAnyPrefix(r.URL.Path, []string{"/admin", "/static", "/frame-static", "/admin-static", "/api"}) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		member, impersonatorUserName := sa.getImpersonation(r)
+
+		if impersonatorUserName == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := &impersonationBannerWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+
+		banner := `<div id="frame-impersonation-banner" style="position: sticky; top: 0; z-index: 2147483647; display: flex; gap: 1em; align-items: center; justify-content: center; padding: 0.5em 1em; background: #b91c1c; color: #ffffff; font-family: sans-serif; font-size: 0.9rem;">` +
+			`<span>Signed in as ` + html.EscapeString(strings.TrimSpace(member.FirstName+" "+member.LastName)) + ` (` + html.EscapeString(member.Email) + `). You are impersonating this member as ` + html.EscapeString(impersonatorUserName) + `.</span>` +
+			`<form method="POST" action="` + SiteAuthEndImpersonationPath + `" style="margin: 0;">` + string(templateFuncCSRFField(CSRFToken(r))) + `<button type="submit">Return to admin</button></form>` +
+			`</div>`
+
+		bw.finish(banner)
+	})
+}
+
+/*
+getImpersonation returns the member being impersonated, and the admin
+doing it. Paths that are excluded from auth have no principal, so the
+session is read instead.
+*/
+func (sa *SiteAuth) getImpersonation(r *http.Request) (Member, string) {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		return principal.Member(), principal.ImpersonatorUserName
+	}
+
+	session, err := sa.sessionStore.Get(r, sa.sessionName)
+
+	if err != nil {
+		return Member{}, ""
+	}
+
+	impersonatorUserName, _ := session.Values["impersonatorUserName"].(string)
+	email, _ := session.Values["email"].(string)
+	firstName, _ := session.Values["firstName"].(string)
+	lastName, _ := session.Values["lastName"].(string)
+
+	return Member{Email: email, FirstName: firstName, LastName: lastName}, impersonatorUserName
+}
+
+/*
+impersonationBannerWriter holds an HTML response until the handler is done
+so the banner can be added after the opening body tag. Responses that set a
+Content-Type other than HTML, like downloads and streams, are passed through
+as soon as the handler starts writing them.
+*/
+type impersonationBannerWriter struct {
+	http.ResponseWriter
+	buffer      bytes.Buffer
+	decided     bool
+	passThrough bool
+	status      int
+}
+
+/*
+decide looks at the Content-Type the first time the handler writes. A
+response without one is held, as its type is only known from its body.
+*/
+func (bw *impersonationBannerWriter) decide() {
+	if bw.decided {
+		return
+	}
+
+	bw.decided = true
+	contentType := bw.Header().Get("Content-Type")
+	bw.passThrough = contentType != "" && !strings.HasPrefix(contentType, "text/html")
+}
+
+func (bw *impersonationBannerWriter) WriteHeader(status int) {
+	bw.decide()
+
+	if bw.passThrough {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	bw.status = status
+}
+
+func (bw *impersonationBannerWriter) Write(b []byte) (int, error) {
+	bw.decide()
+
+	if bw.passThrough {
+		return bw.ResponseWriter.Write(b)
+	}
+
+	return bw.buffer.Write(b)
+}
+
+func (bw *impersonationBannerWriter) Flush() {
+	if !bw.passThrough {
+		return
+	}
+
+	if flusher, ok := bw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (bw *impersonationBannerWriter) finish(banner string) {
+	if bw.passThrough {
+		return
+	}
+
+	body := bw.buffer.Bytes()
+	contentType := bw.Header().Get("Content-Type")
+
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	if strings.HasPrefix(contentType, "text/html") {
+		if location := bodyTagRegex.FindIndex(body); location != nil {
+			result := make([]byte, 0, len(body)+len(banner))
+			result = append(result, body[:location[1]]...)
+			result = append(result, banner...)
+			result = append(result, body[location[1]:]...)
+
+			body = result
+			bw.Header().Del("Content-Length")
+		}
+	}
+
+	if bw.status != 0 {
+		bw.ResponseWriter.WriteHeader(bw.status)
+	}
+
+	_, _ = bw.ResponseWriter.Write(body)
+}
@@ -0,0 +1,405 @@
+package frame
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LoginTypeAdmin     string = "admin"
+	LoginTypeApi       string = "api"
+	LoginTypeMagicLink string = "magic-link"
+	LoginTypeMember    string = "member"
+
+	/*
+	 * Login attempts older than this are removed by a daily cron job
+	 */
+	loginAttemptRetention = time.Hour * 24 * 30
+)
+
+/*
+LoginAttemptServiceConfig configures the service used to throttle login
+attempts. Thresholds come from the LOGIN_* configuration values.
+*/
+type LoginAttemptServiceConfig struct {
+	Config *Config
+	DB     *sql.DB
+	Logger *logrus.Entry
+}
+
+/*
+LoginAttemptService records login attempts and decides when an account or
+IP address has failed too many times. Accounts that fail LOGIN_MAX_ATTEMPTS
+times in a row are locked. Each failure also makes the next attempt wait
+longer, starting at LOGIN_BACKOFF seconds and doubling. An IP address that
+fails LOGIN_MAX_IP_ATTEMPTS times within the attempt window is blocked
+until the window passes. Magic link requests are limited within the same
+window by MAGIC_LINK_LIMIT and MAGIC_LINK_IP_LIMIT.
+*/
+type LoginAttemptService struct {
+	backoff          time.Duration
+	db               *sql.DB
+	lockoutTime      time.Duration
+	logger           *logrus.Entry
+	magicLinkIPLimit int
+	magicLinkLimit   int
+	maxAttempts      int
+	maxIPAttempts    int
+	window           time.Duration
+}
+
+func NewLoginAttemptService(config LoginAttemptServiceConfig) LoginAttemptService {
+	return LoginAttemptService{
+		backoff:          time.Duration(config.Config.LoginBackoff) * time.Second,
+		db:               config.DB,
+		lockoutTime:      time.Duration(config.Config.LoginLockoutTime) * time.Second,
+		logger:           config.Logger,
+		magicLinkIPLimit: config.Config.MagicLinkIPLimit,
+		magicLinkLimit:   config.Config.MagicLinkLimit,
+		maxAttempts:      config.Config.LoginMaxAttempts,
+		maxIPAttempts:    config.Config.LoginMaxIPAttempts,
+		window:           time.Duration(config.Config.LoginAttemptWindow) * time.Second,
+	}
+}
+
+/*
+CheckLogin returns how long the caller must wait before another login
+attempt for this email address and IP address is allowed. Zero means the
+attempt may go ahead.
+*/
+func (s LoginAttemptService) CheckLogin(email, ip string) (time.Duration, error) {
+	var (
+		err          error
+		ipFailures   int
+		firstFailure sql.NullTime
+		failures     int
+		lastFailure  sql.NullTime
+	)
+
+	if s.db == nil {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	since := now.Add(-s.window)
+
+	if s.maxIPAttempts > 0 {
+		query := `
+			SELECT
+				COUNT(*),
+				MIN(created_at)
+			FROM login_attempts
+			WHERE 1=1
+				AND ip_address = $1
+				AND succeeded = false
+				AND created_at > $2
+		`
+
+		if err = s.db.QueryRow(query, ip, since).Scan(&ipFailures, &firstFailure); err != nil {
+			return 0, err
+		}
+
+		if ipFailures >= s.maxIPAttempts && firstFailure.Valid {
+			return firstFailure.Time.Add(s.window).Sub(now), nil
+		}
+	}
+
+	if s.backoff > 0 && email != "" {
+		if failures, lastFailure, err = s.getConsecutiveFailures(email, since); err != nil {
+			return 0, err
+		}
+
+		if failures > 0 && lastFailure.Valid {
+			delay := s.backoff << (failures - 1)
+
+			if failures > 20 || delay > s.window {
+				delay = s.window
+			}
+
+			if wait := lastFailure.Time.Add(delay).Sub(now); wait > 0 {
+				return wait, nil
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+/*
+CheckMagicLink returns how long the caller must wait before another magic
+link can be sent to this email address, or requested from this IP address.
+Zero means the link may be sent. Unknown email addresses are counted too,
+so the limit doesn't reveal which addresses have accounts.
+*/
+func (s LoginAttemptService) CheckMagicLink(email, ip string) (time.Duration, error) {
+	var (
+		err  error
+		wait time.Duration
+	)
+
+	if s.db == nil {
+		return 0, nil
+	}
+
+	if wait, err = s.checkMagicLinkRequests("ip_address", ip, s.magicLinkIPLimit); err != nil || wait > 0 {
+		return wait, err
+	}
+
+	return s.checkMagicLinkRequests("email", normalizeLoginEmail(email), s.magicLinkLimit)
+}
+
+/*
+RecordMagicLink records a request for a magic link.
+*/
+func (s LoginAttemptService) RecordMagicLink(email, ip string) error {
+	if s.db == nil {
+		return nil
+	}
+
+	query := `
+		INSERT INTO magic_link_requests (
+			created_at,
+			email,
+			ip_address
+		) VALUES (
+			$1,
+			$2,
+			$3
+		)
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), normalizeLoginEmail(email), ip)
+	return err
+}
+
+/*
+RecordFailure records a failed login and logs it. It returns the number of
+times in a row this email address has failed within the attempt window.
+*/
+func (s LoginAttemptService) RecordFailure(email, ip, loginType string) (int, error) {
+	var (
+		err      error
+		failures int
+	)
+
+	if s.db == nil {
+		return 0, nil
+	}
+
+	if err = s.recordAttempt(email, ip, loginType, false); err != nil {
+		return 0, err
+	}
+
+	if failures, _, err = s.getConsecutiveFailures(email, time.Now().UTC().Add(-s.window)); err != nil {
+		return 0, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"event":     "login_failed",
+		"email":     email,
+		"ip":        ip,
+		"loginType": loginType,
+		"failures":  failures,
+	}).Warn("failed login attempt")
+
+	return failures, nil
+}
+
+/*
+RecordSuccess records a successful login. This resets the failure count
+for the email address.
+*/
+func (s LoginAttemptService) RecordSuccess(email, ip, loginType string) error {
+	if s.db == nil {
+		return nil
+	}
+
+	return s.recordAttempt(email, ip, loginType, true)
+}
+
+/*
+ResetFailures forgets an email address's failed logins. This is done when
+an account is unlocked so the member starts over with a clean slate.
+*/
+func (s LoginAttemptService) ResetFailures(email string) error {
+	if s.db == nil {
+		return nil
+	}
+
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE email = $1 AND succeeded = false`, normalizeLoginEmail(email))
+	return err
+}
+
+/*
+ShouldLock returns true if an account with this many failures in a row
+should be locked.
+*/
+func (s LoginAttemptService) ShouldLock(failures int) bool {
+	return s.maxAttempts > 0 && failures >= s.maxAttempts
+}
+
+/*
+IsLocked returns true if a member's account is locked. Locks expire after
+LOGIN_LOCKOUT_TIME seconds, unless it is 0.
+*/
+func (s LoginAttemptService) IsLocked(member Member) bool {
+	if member.LockedAt == nil {
+		return false
+	}
+
+	if s.lockoutTime <= 0 {
+		return true
+	}
+
+	return time.Now().UTC().Before(member.LockedAt.Add(s.lockoutTime))
+}
+
+/*
+DeleteOldLoginAttempts removes attempts, and magic link requests, older
+than the retention period. It returns the number of attempts removed.
+*/
+func (s LoginAttemptService) DeleteOldLoginAttempts() (int64, error) {
+	before := time.Now().UTC().Add(-loginAttemptRetention)
+	result, err := s.db.Exec(`DELETE FROM login_attempts WHERE created_at < $1`, before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = s.db.Exec(`DELETE FROM magic_link_requests WHERE created_at < $1`, before); err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s LoginAttemptService) recordAttempt(email, ip, loginType string, succeeded bool) error {
+	query := `
+		INSERT INTO login_attempts (
+			created_at,
+			email,
+			ip_address,
+			login_type,
+			succeeded
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5
+		)
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), normalizeLoginEmail(email), ip, loginType, succeeded)
+	return err
+}
+
+/*
+getConsecutiveFailures counts failures for an email address since its last
+successful login, within the attempt window.
+*/
+func (s LoginAttemptService) getConsecutiveFailures(email string, since time.Time) (int, sql.NullTime, error) {
+	var (
+		err         error
+		failures    int
+		lastFailure sql.NullTime
+	)
+
+	query := `
+		SELECT
+			COUNT(*),
+			MAX(created_at)
+		FROM login_attempts
+		WHERE 1=1
+			AND email = $1
+			AND succeeded = false
+			AND created_at > GREATEST($2, COALESCE((
+				SELECT MAX(created_at) FROM login_attempts WHERE email = $1 AND succeeded = true
+			), $2))
+	`
+
+	err = s.db.QueryRow(query, normalizeLoginEmail(email), since).Scan(&failures, &lastFailure)
+	return failures, lastFailure, err
+}
+
+/*
+checkMagicLinkRequests returns how long until the oldest request counted
+against limit leaves the window, once column has reached it.
+*/
+func (s LoginAttemptService) checkMagicLinkRequests(column, value string, limit int) (time.Duration, error) {
+	var (
+		err      error
+		requests int
+		first    sql.NullTime
+	)
+
+	if limit <= 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+
+	query := `
+		SELECT
+			COUNT(*),
+			MIN(created_at)
+		FROM magic_link_requests
+		WHERE 1=1
+			AND ` + column + ` = $1
+			AND created_at > $2
+	`
+
+	if err = s.db.QueryRow(query, value, now.Add(-s.window)).Scan(&requests, &first); err != nil {
+		return 0, err
+	}
+
+	if requests >= limit && first.Valid {
+		return first.Time.Add(s.window).Sub(now), nil
+	}
+
+	return 0, nil
+}
+
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+/*
+formatRetryAfter describes a wait in words for a login page, rounding up
+to the next second or minute.
+*/
+func formatRetryAfter(wait time.Duration) string {
+	if wait <= time.Minute {
+		seconds := int((wait + time.Second - 1) / time.Second)
+
+		if seconds == 1 {
+			return "1 second"
+		}
+
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+
+	minutes := int((wait + time.Minute - 1) / time.Minute)
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+/*
+LockMember locks a member's account so they can't log in.
+*/
+func (s MemberService) LockMember(id string) (time.Time, error) {
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`UPDATE members SET locked_at = $1 WHERE id = $2`, now, id)
+	return now, err
+}
+
+/*
+UnlockMember unlocks a member's account.
+*/
+func (s MemberService) UnlockMember(id string) error {
+	_, err := s.db.Exec(`UPDATE members SET locked_at = NULL, updated_at = $1 WHERE id = $2`, time.Now().UTC(), id)
+	return err
+}
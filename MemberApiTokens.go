@@ -0,0 +1,463 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	/*
+	 * Every personal access token starts with this prefix, which makes
+	 * them easy to spot in logs and secret scanners.
+	 */
+	MemberApiTokenPrefix string = "frm_"
+
+	/*
+	 * ApiTokenScopeRead lets a token make GET, HEAD, and OPTIONS requests.
+	 * ApiTokenScopeWrite lets a token make requests with any method. A token
+	 * may also be scoped to any of the member's permissions. Permissions
+	 * that aren't in a token's scopes aren't available to requests using it.
+	 */
+	ApiTokenScopeRead  string = "read"
+	ApiTokenScopeWrite string = "write"
+)
+
+/*
+ErrInvalidMemberApiToken is returned when an API token does not exist, has
+been revoked, or has expired.
+*/
+var ErrInvalidMemberApiToken = errors.New("invalid, revoked, or expired api token")
+
+/*
+MemberApiToken is a personal access token a member uses to call APIs from
+scripts and other tools. The token itself is only available when it is
+created.
+*/
+type MemberApiToken struct {
+	ID          string     `json:"id"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+	RevokedAt   *time.Time `json:"revokedAt"`
+	MemberID    string     `json:"memberID"`
+	Name        string     `json:"name"`
+	Scopes      []string   `json:"scopes"`
+	TokenPrefix string     `json:"tokenPrefix"`
+}
+
+/*
+HasScope returns true if the token was granted the provided scope.
+*/
+func (t MemberApiToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type MemberApiTokensData struct {
+	BaseViewModel
+	Member      Member
+	Message     string
+	NewToken    string
+	Permissions []string
+	Success     bool
+	Tokens      []MemberApiToken
+}
+
+/*
+GET, POST /member/profile/tokens
+*/
+func (mm *MemberManagement) handleMemberApiTokens(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	ctx := r.Context()
+	principal, ok := PrincipalFromContext(ctx)
+
+	if !ok {
+		sendJSONStatusResponse(w, http.StatusUnauthorized, "User unauthorized")
+		return
+	}
+
+	memberEmail := principal.Email
+
+	/*
+	 * Tokens can't be used to create more tokens
+	 */
+	if principal.AuthMethod == AuthMethodApiToken {
+		sendJSONStatusResponse(w, http.StatusForbidden, "API tokens cannot be managed using an API token")
+		return
+	}
+
+	/*
+	 * Tokens would outlive an admin's impersonation of the member
+	 */
+	if principal.ImpersonatorUserName != "" {
+		sendJSONStatusResponse(w, http.StatusForbidden, "API tokens cannot be managed while impersonating a member")
+		return
+	}
+
+	data := MemberApiTokensData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		},
+		Member:  Member{},
+		Message: "",
+		Success: true,
+	}
+
+	if data.Member, err = mm.memberService.GetMemberByEmail(memberEmail, false); err != nil {
+		mm.logger.WithError(err).Error("error getting member information in handleMemberApiTokens()")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	/*
+	 * Members can only scope tokens to permissions they have
+	 */
+	for name := range PermissionsFromContext(ctx) {
+		data.Permissions = append(data.Permissions, name)
+	}
+
+	sort.Strings(data.Permissions)
+
+	/*
+	 * POST
+	 */
+	if r.Method == http.MethodPost {
+		_ = r.ParseForm()
+
+		switch r.FormValue("action") {
+		case "create":
+			var (
+				expiresIn int
+				token     MemberApiToken
+			)
+
+			name := strings.TrimSpace(r.FormValue("name"))
+			scopes := []string{}
+
+			for _, scope := range r.Form["scopes"] {
+				if scope == ApiTokenScopeRead || scope == ApiTokenScopeWrite || PermissionsFromContext(ctx).Has(scope) {
+					scopes = append(scopes, scope)
+				}
+			}
+
+			if name == "" {
+				data.Success = false
+				data.Message = "Please provide a name for your token."
+				break
+			}
+
+			if len(scopes) == 0 {
+				data.Success = false
+				data.Message = "Please select at least one scope."
+				break
+			}
+
+			if expiresIn, err = strconv.Atoi(r.FormValue("expiresInDays")); err != nil || expiresIn < 0 {
+				data.Success = false
+				data.Message = "Please select when this token expires."
+				break
+			}
+
+			if token, data.NewToken, err = mm.memberService.CreateMemberApiToken(data.Member.ID, name, scopes, time.Duration(expiresIn)*24*time.Hour); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error creating api token")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			mm.logger.WithFields(logrus.Fields{
+				"memberID": data.Member.ID,
+				"tokenID":  token.ID,
+				"scopes":   token.Scopes,
+			}).Info("member api token created")
+
+			_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionApiTokenCreated, AuditTargetMember, data.Member.ID).WithChanges(nil, map[string]interface{}{
+				"tokenID": token.ID,
+				"name":    token.Name,
+				"scopes":  token.Scopes,
+			}))
+
+			data.Message = "Your token has been created."
+
+		case "revoke":
+			if err = mm.memberService.RevokeMemberApiToken(data.Member.ID, r.FormValue("tokenID")); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error revoking api token")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionApiTokenRevoked, AuditTargetMember, data.Member.ID).WithChanges(map[string]string{"tokenID": r.FormValue("tokenID")}, nil))
+
+			data.Message = "Your token has been revoked."
+		}
+	}
+
+	if data.Tokens, err = mm.memberService.GetMemberApiTokens(data.Member.ID); err != nil {
+		mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error retrieving api tokens")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	mm.webApp.RenderTemplate(w, "member-api-tokens.tmpl", data)
+}
+
+/*
+authenticateApiToken authenticates a request carrying an
+"Authorization: Bearer" header. On success the returned context holds the
+same values the cookie session puts there. Permissions are limited to those
+in the token's scopes.
+*/
+func (sa *SiteAuth) authenticateApiToken(r *http.Request, memberService *MemberService, bearerToken string) (context.Context, error) {
+	var (
+		err         error
+		member      Member
+		token       MemberApiToken
+		permissions PermissionSet
+	)
+
+	if member, token, err = memberService.GetMemberByApiToken(bearerToken); err != nil {
+		return nil, err
+	}
+
+	if member.Status.ID != MemberActiveID {
+		return nil, fmt.Errorf("member %s is not active", member.ID)
+	}
+
+	if !token.HasScope(ApiTokenScopeWrite) {
+		if !token.HasScope(ApiTokenScopeRead) || (r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions) {
+			return nil, fmt.Errorf("token %s is not scoped for %s requests", token.ID, r.Method)
+		}
+	}
+
+	if permissions, err = memberService.GetRolePermissions(member.Role.ID); err != nil {
+		return nil, err
+	}
+
+	tokenPermissions := PermissionSet{}
+
+	for name := range permissions {
+		if token.HasScope(name) {
+			tokenPermissions[name] = struct{}{}
+		}
+	}
+
+	principal := newPrincipal(AuthMethodApiToken, memberService)
+	principal.ApiTokenID = token.ID
+	principal.AvatarURL = member.AvatarURL
+	principal.Email = member.Email
+	principal.FirstName = member.FirstName
+	principal.LastName = member.LastName
+	principal.MemberID = member.ID
+	principal.Permissions = tokenPermissions
+	principal.Role = member.Role.Role
+	principal.RoleID = member.Role.ID
+	principal.Status = member.Status.Status
+
+	return withPrincipal(r.Context(), principal), nil
+}
+
+/*
+CreateMemberApiToken creates a new personal access token for a member. A
+ttl of zero creates a token that doesn't expire. The plaintext token is
+returned to the caller. Only a hash of it is stored.
+*/
+func (s MemberService) CreateMemberApiToken(memberID, name string, scopes []string, ttl time.Duration) (MemberApiToken, string, error) {
+	var (
+		err       error
+		token     string
+		expiresAt *time.Time
+	)
+
+	if token, err = generateSecureToken(); err != nil {
+		return MemberApiToken{}, "", err
+	}
+
+	token = MemberApiTokenPrefix + token
+	now := time.Now().UTC()
+
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		expiresAt = &expires
+	}
+
+	result := MemberApiToken{
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+		MemberID:    memberID,
+		Name:        name,
+		Scopes:      scopes,
+		TokenPrefix: token[:len(MemberApiTokenPrefix)+6],
+	}
+
+	query := `
+		INSERT INTO member_api_tokens (
+			created_at,
+			expires_at,
+			member_id,
+			name,
+			scopes,
+			token_prefix,
+			token_hash
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7
+		)
+		RETURNING id
+	`
+
+	err = s.db.QueryRow(query, now, expiresAt, memberID, name, strings.Join(scopes, " "), result.TokenPrefix, hashToken(token)).Scan(&result.ID)
+
+	if err != nil {
+		return MemberApiToken{}, "", err
+	}
+
+	return result, token, nil
+}
+
+/*
+GetMemberApiTokens returns a member's tokens that haven't been revoked,
+newest first.
+*/
+func (s MemberService) GetMemberApiTokens(memberID string) ([]MemberApiToken, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	result := []MemberApiToken{}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			expires_at,
+			last_used_at,
+			revoked_at,
+			name,
+			scopes,
+			token_prefix
+		FROM member_api_tokens
+		WHERE 1=1
+			AND member_id = $1
+			AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`
+
+	if rows, err = s.db.Query(query, memberID); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var scopes string
+
+		token := MemberApiToken{MemberID: memberID}
+
+		if err = rows.Scan(&token.ID, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.RevokedAt, &token.Name, &scopes, &token.TokenPrefix); err != nil {
+			return result, err
+		}
+
+		token.Scopes = strings.Fields(scopes)
+		result = append(result, token)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+GetMemberByApiToken finds the member a token belongs to and records that
+the token was used. If the token is unknown, revoked, or expired
+ErrInvalidMemberApiToken is returned.
+*/
+func (s MemberService) GetMemberByApiToken(token string) (Member, MemberApiToken, error) {
+	var (
+		err    error
+		scopes string
+		member Member
+	)
+
+	result := MemberApiToken{}
+	now := time.Now().UTC()
+
+	query := `
+		UPDATE member_api_tokens SET
+			last_used_at = $1
+		WHERE 1=1
+			AND token_hash = $2
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $1)
+		RETURNING id, created_at, expires_at, member_id, name, scopes, token_prefix
+	`
+
+	err = s.db.QueryRow(query, now, hashToken(token)).Scan(
+		&result.ID,
+		&result.CreatedAt,
+		&result.ExpiresAt,
+		&result.MemberID,
+		&result.Name,
+		&scopes,
+		&result.TokenPrefix,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Member{}, result, ErrInvalidMemberApiToken
+	}
+
+	if err != nil {
+		return Member{}, result, err
+	}
+
+	result.LastUsedAt = &now
+	result.Scopes = strings.Fields(scopes)
+
+	if member, err = s.GetMemberByID(result.MemberID, false); err != nil {
+		return Member{}, result, err
+	}
+
+	return member, result, nil
+}
+
+/*
+RevokeMemberApiToken revokes one of a member's tokens. It can no longer be
+used to authenticate.
+*/
+func (s MemberService) RevokeMemberApiToken(memberID, tokenID string) error {
+	query := `
+		UPDATE member_api_tokens SET
+			revoked_at = $1
+		WHERE 1=1
+			AND id = $2
+			AND member_id = $3
+			AND revoked_at IS NULL
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), tokenID, memberID)
+	return err
+}
@@ -0,0 +1,678 @@
+package frame
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	/*
+	 * Members can ask for one export in this long
+	 */
+	dataExportRequestInterval = time.Hour
+
+	maxExportAvatarSize = 10 * 1024 * 1024
+)
+
+/*
+ErrInvalidDataExport is returned when a data export download token is
+unknown, expired, or the export isn't ready yet.
+*/
+var ErrInvalidDataExport = errors.New("invalid or expired data export")
+
+/*
+MemberDataExporter adds an application's own data to a member's data
+export. Whatever it returns is written as JSON. Register one with
+AddMemberDataExporter().
+*/
+type MemberDataExporter func(member Member) (interface{}, error)
+
+type namedMemberDataExporter struct {
+	name     string
+	exporter MemberDataExporter
+}
+
+/*
+MemberDataExport is a member's request for a copy of their data. The
+archive is built in the background, so CompletedAt is nil until it's ready.
+*/
+type MemberDataExport struct {
+	ID          string     `json:"id"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	MemberID    string     `json:"memberID"`
+}
+
+/*
+MemberDataExportData is used by the data export page.
+*/
+type MemberDataExportData struct {
+	BaseViewModel
+	Export  *MemberDataExport
+	Message string
+	Success bool
+}
+
+/*
+runningDataExports tracks the exports being built in the background, so
+shutdown can wait for them, and remove any that don't finish in time.
+*/
+type runningDataExports struct {
+	ids  map[string]struct{}
+	lock *sync.Mutex
+	wait *sync.WaitGroup
+}
+
+func newRunningDataExports() *runningDataExports {
+	return &runningDataExports{
+		ids:  map[string]struct{}{},
+		lock: &sync.Mutex{},
+		wait: &sync.WaitGroup{},
+	}
+}
+
+func (rde *runningDataExports) add(id string) {
+	rde.lock.Lock()
+	defer rde.lock.Unlock()
+
+	rde.ids[id] = struct{}{}
+	rde.wait.Add(1)
+}
+
+func (rde *runningDataExports) done(id string) {
+	rde.lock.Lock()
+	defer rde.lock.Unlock()
+
+	delete(rde.ids, id)
+	rde.wait.Done()
+}
+
+func (rde *runningDataExports) running() []string {
+	rde.lock.Lock()
+	defer rde.lock.Unlock()
+
+	result := make([]string, 0, len(rde.ids))
+
+	for id := range rde.ids {
+		result = append(result, id)
+	}
+
+	return result
+}
+
+/*
+memberStatusChange is one entry in the status history of a data export
+*/
+type memberStatusChange struct {
+	At    time.Time `json:"at"`
+	Event string    `json:"event"`
+	By    string    `json:"by"`
+}
+
+/*
+Audit actions that change a member's status, in their status history
+*/
+var memberStatusAuditActions = map[string]struct{}{
+	AuditActionAccountLocked:   {},
+	AuditActionAccountUnlocked: {},
+	AuditActionMemberActivated: {},
+	AuditActionMemberApproved:  {},
+	AuditActionMemberDeleted:   {},
+}
+
+/*
+AddMemberDataExporter registers an exporter that adds a section to every
+member data export. The section is named name. Site auth must be
+configured first by calling AddSiteAuth().
+
+	app.AddMemberDataExporter("orders", func(member frame.Member) (interface{}, error) {
+		return orderService.GetOrdersForMember(member.ID)
+	})
+*/
+func (fa *FrameApplication) AddMemberDataExporter(name string, exporter MemberDataExporter) *FrameApplication {
+	if fa.siteAuth == nil {
+		fa.Logger.Fatalf("please configure site auth before adding member data exporters by calling AddSiteAuth()")
+	}
+
+	fa.memberManagement.dataExporters = append(fa.memberManagement.dataExporters, namedMemberDataExporter{
+		name:     name,
+		exporter: exporter,
+	})
+
+	return fa
+}
+
+func (sa *SiteAuth) dataExportEnabled() bool {
+	return sa.dataExportEmailTemplateID != ""
+}
+
+/*
+GET, POST /member/profile/export
+
+Posting starts a new export. It is built in the background, and the member
+is emailed a link to download it when it's ready.
+*/
+func (mm *MemberManagement) handleMemberDataExport(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		token  string
+		export MemberDataExport
+	)
+
+	if isImpersonating(r) {
+		mm.sendImpersonationForbidden(w, "You can't export a member's data while impersonating them.")
+		return
+	}
+
+	member, _ := MemberFromContext(r.Context())
+
+	data := MemberDataExportData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		},
+		Success: true,
+	}
+
+	if data.Export, err = mm.memberService.GetLatestMemberDataExport(member.ID); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error getting latest data export")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if data.Export != nil && time.Since(data.Export.CreatedAt) < dataExportRequestInterval {
+			data.Success = false
+			data.Message = "You recently asked for a copy of your data. Please check your email, or try again later."
+			mm.webApp.RenderTemplate(w, "member-data-export.tmpl", data)
+			return
+		}
+
+		if export, token, err = mm.memberService.CreateMemberDataExport(member.ID, mm.siteAuth.dataExportTTL); err != nil {
+			mm.logger.WithError(err).WithField("memberID", member.ID).Error("error creating data export")
+			mm.webApp.UnexpectedError(w, r)
+			return
+		}
+
+		mm.startMemberDataExport(member.ID, export, token)
+
+		_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionDataExportRequested, AuditTargetMember, member.ID))
+
+		mm.logger.WithFields(logrus.Fields{
+			"memberID": member.ID,
+			"exportID": export.ID,
+		}).Info("member requested a data export")
+
+		data.Export = &export
+		data.Message = "We are gathering your data. You will get an email with a download link when it's ready."
+	}
+
+	mm.webApp.RenderTemplate(w, "member-data-export.tmpl", data)
+}
+
+/*
+GET /member/profile/export/download
+
+Only the member the export belongs to can download it.
+*/
+func (mm *MemberManagement) handleMemberDataExportDownload(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		archive []byte
+		export  MemberDataExport
+	)
+
+	if isImpersonating(r) {
+		mm.sendImpersonationForbidden(w, "You can't export a member's data while impersonating them.")
+		return
+	}
+
+	member, _ := MemberFromContext(r.Context())
+
+	export, archive, err = mm.memberService.GetMemberDataExportArchive(r.URL.Query().Get("token"))
+
+	if errors.Is(err, ErrInvalidDataExport) || (err == nil && export.MemberID != member.ID) {
+		http.Redirect(w, r, MemberProfileDataExportPath, http.StatusFound)
+		return
+	}
+
+	if err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error getting data export archive")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	fileName := "data-export-" + export.CreatedAt.Format("2006-01-02") + ".zip"
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(archive)
+}
+
+/*
+startMemberDataExport builds an export in the background. A panic while
+building it is logged, and the export is removed like any other failure.
+*/
+func (mm *MemberManagement) startMemberDataExport(memberID string, export MemberDataExport, token string) {
+	mm.runningDataExports.add(export.ID)
+
+	go func() {
+		defer mm.runningDataExports.done(export.ID)
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				mm.logger.WithFields(logrus.Fields{
+					"memberID": memberID,
+					"exportID": export.ID,
+					"panic":    recovered,
+				}).Error("panic building data export")
+
+				if err := mm.memberService.DeleteMemberDataExport(export.ID); err != nil {
+					mm.logger.WithError(err).WithField("exportID", export.ID).Error("error removing failed data export")
+				}
+			}
+		}()
+
+		mm.buildMemberDataExport(memberID, export, token)
+	}()
+}
+
+/*
+stopDataExports waits for exports being built to finish. Any still running
+when ctx is done are removed, so the members who asked for them aren't
+left with an export that never completes.
+*/
+func (mm *MemberManagement) stopDataExports(ctx context.Context) {
+	finished := make(chan struct{})
+
+	go func() {
+		mm.runningDataExports.wait.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return
+
+	case <-ctx.Done():
+	}
+
+	for _, id := range mm.runningDataExports.running() {
+		mm.logger.WithField("exportID", id).Warn("data export didn't finish before shutdown. removing it")
+
+		if err := mm.memberService.DeleteMemberDataExport(id); err != nil {
+			mm.logger.WithError(err).WithField("exportID", id).Error("error removing unfinished data export")
+		}
+	}
+}
+
+/*
+buildMemberDataExport builds an export's archive and emails the member a
+link to it. It runs in the background. If it fails the export is removed,
+so the member may ask again right away.
+*/
+func (mm *MemberManagement) buildMemberDataExport(memberID string, export MemberDataExport, token string) {
+	var (
+		err     error
+		archive []byte
+		member  Member
+	)
+
+	logger := mm.logger.WithFields(logrus.Fields{
+		"memberID": memberID,
+		"exportID": export.ID,
+	})
+
+	fail := func(err error, message string) {
+		logger.WithError(err).Error(message)
+
+		if err = mm.memberService.DeleteMemberDataExport(export.ID); err != nil {
+			logger.WithError(err).Error("error removing failed data export")
+		}
+	}
+
+	if member, err = mm.memberService.GetMemberByID(memberID, false); err != nil {
+		fail(err, "error getting member for data export")
+		return
+	}
+
+	if archive, err = mm.buildMemberDataArchive(member); err != nil {
+		fail(err, "error building data export")
+		return
+	}
+
+	if err = mm.memberService.CompleteMemberDataExport(export.ID, archive); err != nil {
+		fail(err, "error saving data export")
+		return
+	}
+
+	emailData := map[string]interface{}{
+		"downloadLink": mm.siteAuth.siteLink(MemberDataExportDownloadPath, url.Values{"token": {token}}),
+		"expiresAt":    export.ExpiresAt.Format("January 2, 2006"),
+	}
+
+	if err = mm.siteAuth.sendMemberEmail(mm.siteAuth.dataExportEmailTemplateID, member, emailData); err != nil {
+		logger.WithError(err).Error("error sending data export email")
+		return
+	}
+
+	logger.WithField("size", len(archive)).Info("member data export is ready")
+}
+
+/*
+buildMemberDataArchive gathers everything Frame, and the application's
+exporters, know about a member into a zip file. It holds member-data.json
+and, if they uploaded one, their avatar.
+*/
+func (mm *MemberManagement) buildMemberDataArchive(member Member) ([]byte, error) {
+	var (
+		err         error
+		apiTokens   []MemberApiToken
+		auditEvents []AuditEvent
+		avatar      []byte
+		avatarName  string
+		content     []byte
+		sessions    []DatabaseSession
+		file        io.Writer
+	)
+
+	if apiTokens, err = mm.memberService.GetMemberApiTokens(member.ID); err != nil {
+		return nil, fmt.Errorf("error getting API tokens: %w", err)
+	}
+
+	if auditEvents, err = mm.auditLogger.GetMemberAuditEvents(member.ID); err != nil {
+		return nil, fmt.Errorf("error getting audit events: %w", err)
+	}
+
+	if sessions, err = mm.sessionService.GetMemberSessions(member.ID); err != nil {
+		return nil, fmt.Errorf("error getting sessions: %w", err)
+	}
+
+	applicationData := map[string]interface{}{}
+
+	for _, dataExporter := range mm.dataExporters {
+		if applicationData[dataExporter.name], err = dataExporter.exporter(member); err != nil {
+			return nil, fmt.Errorf("error running data exporter '%s': %w", dataExporter.name, err)
+		}
+	}
+
+	memberData := map[string]interface{}{
+		"exportedAt":    time.Now().UTC(),
+		"profile":       member,
+		"statusHistory": memberStatusHistory(member, auditEvents),
+		"sessions":      sessions,
+		"apiTokens":     apiTokens,
+		"auditEvents":   auditEvents,
+		"application":   applicationData,
+	}
+
+	if content, err = json.MarshalIndent(memberData, "", "  "); err != nil {
+		return nil, fmt.Errorf("error encoding member data: %w", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+
+	if file, err = archive.Create("member-data.json"); err != nil {
+		return nil, err
+	}
+
+	if _, err = file.Write(content); err != nil {
+		return nil, err
+	}
+
+	/*
+	 * The avatar is nice to have. Don't fail the export over it.
+	 */
+	if avatar, avatarName, err = downloadMemberAvatar(member.AvatarURL); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Warn("error downloading avatar for data export")
+	}
+
+	if len(avatar) > 0 {
+		if file, err = archive.Create(avatarName); err != nil {
+			return nil, err
+		}
+
+		if _, err = file.Write(avatar); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+/*
+memberStatusHistory lists when a member was created, and every audit event
+that changed their status, oldest first.
+*/
+func memberStatusHistory(member Member, auditEvents []AuditEvent) []memberStatusChange {
+	result := []memberStatusChange{
+		{At: member.CreatedAt, Event: "member.created"},
+	}
+
+	for _, event := range auditEvents {
+		if _, ok := memberStatusAuditActions[event.Action]; ok && event.TargetID == member.ID {
+			result = append(result, memberStatusChange{At: event.CreatedAt, Event: event.Action, By: event.Actor})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].At.Before(result[j].At)
+	})
+
+	return result
+}
+
+/*
+downloadMemberAvatar fetches an uploaded avatar. Avatars that aren't
+absolute URLs, such as the default picture, were never uploaded and are
+skipped.
+*/
+func downloadMemberAvatar(avatarURL string) ([]byte, string, error) {
+	var (
+		err      error
+		content  []byte
+		parsed   *url.URL
+		response *http.Response
+	)
+
+	if parsed, err = url.Parse(avatarURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, "", nil
+	}
+
+	client := &http.Client{Timeout: time.Second * 30}
+
+	if response, err = client.Get(avatarURL); err != nil {
+		return nil, "", err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("avatar download returned status %d", response.StatusCode)
+	}
+
+	if content, err = io.ReadAll(io.LimitReader(response.Body, maxExportAvatarSize+1)); err != nil {
+		return nil, "", err
+	}
+
+	if len(content) > maxExportAvatarSize {
+		return nil, "", fmt.Errorf("avatar is larger than %d bytes", maxExportAvatarSize)
+	}
+
+	extension := strings.ToLower(path.Ext(parsed.Path))
+
+	if extension == "" {
+		if extensions, _ := mime.ExtensionsByType(response.Header.Get("Content-Type")); len(extensions) > 0 {
+			extension = extensions[0]
+		}
+	}
+
+	return content, "avatar" + extension, nil
+}
+
+/*
+CreateMemberDataExport starts a new data export for a member. The returned
+token is only ever handed to the member. Only its hash is stored.
+*/
+func (s MemberService) CreateMemberDataExport(memberID string, ttl time.Duration) (MemberDataExport, string, error) {
+	var (
+		err   error
+		token string
+	)
+
+	now := time.Now().UTC()
+
+	result := MemberDataExport{
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		MemberID:  memberID,
+	}
+
+	if token, err = generateSecureToken(); err != nil {
+		return result, "", err
+	}
+
+	query := `
+		INSERT INTO member_data_exports (
+			created_at,
+			expires_at,
+			member_id,
+			token_hash
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4
+		) RETURNING id
+	`
+
+	err = s.db.QueryRow(query, result.CreatedAt, result.ExpiresAt, memberID, hashToken(token)).Scan(&result.ID)
+	return result, token, err
+}
+
+/*
+CompleteMemberDataExport stores a built archive. It can be downloaded from
+then on.
+*/
+func (s MemberService) CompleteMemberDataExport(id string, archive []byte) error {
+	_, err := s.db.Exec(`UPDATE member_data_exports SET archive = $1, completed_at = $2 WHERE id = $3`, archive, time.Now().UTC(), id)
+	return err
+}
+
+/*
+DeleteMemberDataExport removes a data export.
+*/
+func (s MemberService) DeleteMemberDataExport(id string) error {
+	_, err := s.db.Exec(`DELETE FROM member_data_exports WHERE id = $1`, id)
+	return err
+}
+
+/*
+DeleteExpiredMemberDataExports removes exports that can no longer be
+downloaded, and returns how many were removed.
+*/
+func (s MemberService) DeleteExpiredMemberDataExports() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM member_data_exports WHERE expires_at < $1`, time.Now().UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/*
+GetLatestMemberDataExport returns a member's newest unexpired export, or
+nil if they don't have one.
+*/
+func (s MemberService) GetLatestMemberDataExport(memberID string) (*MemberDataExport, error) {
+	query := `
+		SELECT
+			id,
+			created_at,
+			expires_at,
+			completed_at,
+			member_id
+		FROM member_data_exports
+		WHERE 1=1
+			AND member_id = $1
+			AND expires_at > $2
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+
+	result := MemberDataExport{}
+	err := s.db.QueryRow(query, memberID, time.Now().UTC()).Scan(&result.ID, &result.CreatedAt, &result.ExpiresAt, &result.CompletedAt, &result.MemberID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+/*
+GetMemberDataExportArchive returns a finished, unexpired export and its
+archive by download token. ErrInvalidDataExport is returned otherwise.
+*/
+func (s MemberService) GetMemberDataExportArchive(token string) (MemberDataExport, []byte, error) {
+	var (
+		archive []byte
+	)
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			expires_at,
+			completed_at,
+			member_id,
+			archive
+		FROM member_data_exports
+		WHERE 1=1
+			AND token_hash = $1
+			AND expires_at > $2
+			AND completed_at IS NOT NULL
+	`
+
+	result := MemberDataExport{}
+	err := s.db.QueryRow(query, hashToken(token), time.Now().UTC()).Scan(&result.ID, &result.CreatedAt, &result.ExpiresAt, &result.CompletedAt, &result.MemberID, &archive)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, nil, ErrInvalidDataExport
+	}
+
+	return result, archive, err
+}
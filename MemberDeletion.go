@@ -0,0 +1,419 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/jackskj/carta"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	anonymizedMemberFirstName string = "Deleted"
+	anonymizedMemberLastName  string = "Member"
+
+	/*
+	 * Members who can't re-enter a password must have logged in this
+	 * recently to delete their account.
+	 */
+	reauthenticationWindow = time.Minute * 10
+)
+
+/*
+MemberDeleteAccountData is used by the delete account page.
+*/
+type MemberDeleteAccountData struct {
+	BaseViewModel
+	Deleted       bool
+	GracePeriod   int
+	MagicLink     bool
+	Member        Member
+	Message       string
+	NeedsPassword bool
+	Recent        bool
+	SendLink      bool
+}
+
+/*
+recentlyAuthenticated returns true when the member in the request's session
+logged in within the reauthentication window.
+*/
+func (sa *SiteAuth) recentlyAuthenticated(r *http.Request) bool {
+	session, err := sa.sessionStore.Get(r, sa.sessionName)
+
+	if err != nil {
+		return false
+	}
+
+	authenticatedAt, _ := session.Values["authenticatedAt"].(int64)
+	return time.Since(time.Unix(authenticatedAt, 0)) < reauthenticationWindow
+}
+
+/*
+anonymizeDeletedMembers anonymizes every member who was deleted longer ago
+than the grace period. It is run by a daily cron job. A member who fails is
+logged and skipped, so the rest are still anonymized.
+*/
+func (sa *SiteAuth) anonymizeDeletedMembers(memberService *MemberService) (int, error) {
+	var (
+		err     error
+		members []Member
+	)
+
+	if members, err = memberService.GetMembersToAnonymize(time.Now().UTC().Add(-sa.accountDeletionGracePeriod)); err != nil {
+		return 0, err
+	}
+
+	anonymized := 0
+
+	for _, member := range members {
+		if err = memberService.AnonymizeMember(member, sa.onAnonymizeMember); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error anonymizing deleted member")
+			continue
+		}
+
+		_ = sa.auditLogger.Record(AuditEvent{
+			Action:     AuditActionMemberAnonymized,
+			Actor:      "system",
+			TargetID:   member.ID,
+			TargetType: AuditTargetMember,
+		})
+
+		anonymized++
+	}
+
+	return anonymized, nil
+}
+
+/*
+GET, POST /member/profile/delete-account
+
+Members confirm with their password, and a two-factor code when they have
+it turned on. When magic links are enabled members can instead be emailed
+a fresh one, and may delete their account for a few minutes after using
+it.
+*/
+func (mm *MemberManagement) handleMemberDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		session *sessions.Session
+		valid   bool
+		wait    time.Duration
+	)
+
+	principal, _ := PrincipalFromContext(r.Context())
+	member, _ := MemberFromContext(r.Context())
+
+	data := MemberDeleteAccountData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		},
+		GracePeriod:   int(mm.siteAuth.accountDeletionGracePeriod.Hours() / 24),
+		MagicLink:     mm.siteAuth.magicLinkEnabled(),
+		NeedsPassword: mm.siteAuth.passwordLoginEnabled(),
+		Recent:        mm.siteAuth.recentlyAuthenticated(r),
+	}
+
+	if data.Member, err = mm.memberService.GetMemberByEmail(member.Email, false); err != nil {
+		mm.logger.WithError(err).Error("error getting member information in handleMemberDeleteAccount()")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	/*
+	 * An admin impersonating a member must not be able to delete them
+	 */
+	if principal != nil && principal.ImpersonatorUserName != "" {
+		data.Message = "You can't delete an account while impersonating its member."
+		mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+		return
+	}
+
+	_ = r.ParseForm()
+
+	if r.FormValue("action") == "send-link" && data.MagicLink {
+		if err = mm.siteAuth.sendMagicLink(mm.memberService, data.Member, MemberProfileDeletePath); err != nil {
+			mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error sending magic link to confirm account deletion")
+			mm.webApp.UnexpectedError(w, r)
+			return
+		}
+
+		data.SendLink = true
+		mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+		return
+	}
+
+	if r.FormValue("confirm") != "yes" {
+		data.Message = "Please confirm that you want to delete your account."
+		mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+		return
+	}
+
+	/*
+	 * Members who just followed a magic link don't need their password
+	 */
+	if !data.MagicLink || !data.Recent {
+		if !data.NeedsPassword {
+			data.Message = "Please confirm it's you with a new login link first."
+			mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+			return
+		}
+
+		/*
+		 * Password guesses here count towards the same limits as logins, so
+		 * a stolen session can't be used to guess the password
+		 */
+		if wait, err = mm.siteAuth.checkLoginThrottle(data.Member.Email, RealIP(r), LoginTypeMember); err != nil {
+			mm.logger.WithError(err).Error("error checking login attempts")
+			mm.webApp.UnexpectedError(w, r)
+			return
+		}
+
+		if wait > 0 {
+			data.Message = "Too many failed attempts. Please try again in " + formatRetryAfter(wait) + "."
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+			return
+		}
+
+		if !mm.memberService.IsPasswordCorrect(data.Member, r.FormValue("password")) {
+			if err = mm.siteAuth.recordFailedLogin(r, mm.memberService, data.Member, LoginTypeMember); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error recording failed login")
+			}
+
+			data.Message = "That password is not correct."
+			mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+			return
+		}
+
+		if data.Member.TotpEnabledAt != nil {
+			if valid, err = mm.memberService.VerifyMemberSecondFactor(data.Member, r.FormValue("code")); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error verifying second factor")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			if !valid {
+				if err = mm.siteAuth.recordFailedLogin(r, mm.memberService, data.Member, LoginTypeMember); err != nil {
+					mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error recording failed login")
+				}
+
+				data.Message = "That code is not valid. Please try again."
+				mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+				return
+			}
+		}
+	}
+
+	if err = mm.memberService.DeleteMember(data.Member.ID); err != nil {
+		mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error deleting member account")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	mm.logger.WithFields(logrus.Fields{
+		"memberID": data.Member.ID,
+		"ip":       RealIP(r),
+	}).Info("member deleted their account")
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberDeleted, AuditTargetMember, data.Member.ID))
+
+	if session, err = mm.webApp.GetSessionStore().Get(r, mm.webApp.GetSessionName()); err == nil {
+		session.Options.MaxAge = -1
+
+		if err = mm.webApp.GetSessionStore().Save(r, w, session); err != nil {
+			mm.logger.WithError(err).Error("error deleting session")
+		}
+	}
+
+	data.Deleted = true
+	mm.webApp.RenderTemplate(w, "member-delete-account.tmpl", data)
+}
+
+/*
+PUT /admin/api/member/purge/{id}
+
+Anonymizes a deleted member now, without waiting for the grace period.
+*/
+func (mm *MemberManagement) handleMemberPurge(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		member Member
+	)
+
+	vars := mux.Vars(r)
+
+	member, err = mm.memberService.GetMemberByID(vars["id"], true)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, CreateGenericErrorResponse("Member not found", "", ""))
+		return
+	}
+
+	if err != nil {
+		mm.logger.WithError(err).WithField("memberID", vars["id"]).Error("error getting member information in handleMemberPurge()")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error purging member", err.Error(), ""))
+		return
+	}
+
+	if member.DeletedAt == nil {
+		WriteJSON(w, http.StatusBadRequest, CreateGenericErrorResponse("Only deleted members can be purged", "", ""))
+		return
+	}
+
+	if member.AnonymizedAt != nil {
+		WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Member was already purged"))
+		return
+	}
+
+	if err = mm.memberService.AnonymizeMember(member, mm.siteAuth.onAnonymizeMember); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error purging member")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error purging member", err.Error(), ""))
+		return
+	}
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberAnonymized, AuditTargetMember, member.ID))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Member purged"))
+}
+
+/*
+GetMembersToAnonymize returns deleted members who were deleted before
+deletedBefore and haven't been anonymized yet.
+*/
+func (s MemberService) GetMembersToAnonymize(deletedBefore time.Time) ([]Member, error) {
+	members := []Member{}
+
+	query := selectMembersQuery + " AND members.deleted_at < $1 AND members.anonymized_at IS NULL"
+	rows, err := s.db.Query(query, deletedBefore)
+
+	if err != nil {
+		return members, err
+	}
+
+	defer rows.Close()
+
+	if err = carta.Map(rows, &members); err != nil {
+		return members, err
+	}
+
+	return members, nil
+}
+
+/*
+AnonymizeMember scrubs a member's personal information. Their email, name,
+avatar, password, and external ID are replaced, and their tokens, sessions,
+data exports, and login attempts are removed. Their email and name are
+removed from earlier audit events about them. The member row itself is kept so anything
+that refers to it still works. scrub, if provided, runs first in the same
+transaction and gets the member as they were.
+*/
+func (s MemberService) AnonymizeMember(member Member, scrub func(tx *sql.Tx, member Member) error) error {
+	var (
+		err      error
+		password string
+		tx       *sql.Tx
+	)
+
+	if password, err = generateSecureToken(); err != nil {
+		return err
+	}
+
+	if password, err = s.HashPassword(password); err != nil {
+		return err
+	}
+
+	if tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if scrub != nil {
+		if err = scrub(tx, member); err != nil {
+			return fmt.Errorf("error scrubbing application data: %w", err)
+		}
+	}
+
+	now := time.Now().UTC()
+
+	query := `
+		UPDATE members SET
+			updated_at = $1,
+			anonymized_at = $1,
+			deleted_at = COALESCE(deleted_at, $1),
+			avatar_url = '',
+			email = $2,
+			external_id = '',
+			first_name = $3,
+			last_name = $4,
+			password = $5,
+			totp_secret = '',
+			totp_enabled_at = NULL,
+			session_epoch = session_epoch + 1
+		WHERE id = $6
+	`
+
+	anonymizedEmail := "deleted-" + member.ID + "@deleted.invalid"
+
+	if _, err = tx.Exec(query, now, anonymizedEmail, anonymizedMemberFirstName, anonymizedMemberLastName, password, member.ID); err != nil {
+		return fmt.Errorf("error anonymizing member: %w", err)
+	}
+
+	for _, table := range []string{"member_tokens", "member_recovery_codes", "member_api_tokens", "member_refresh_tokens", "member_data_exports", "sessions"} {
+		if _, err = tx.Exec("DELETE FROM "+table+" WHERE member_id = $1", member.ID); err != nil {
+			return fmt.Errorf("error deleting %s: %w", table, err)
+		}
+	}
+
+	if _, err = tx.Exec(`DELETE FROM login_attempts WHERE LOWER(email) = LOWER($1)`, member.Email); err != nil {
+		return fmt.Errorf("error deleting login attempts: %w", err)
+	}
+
+	/*
+	 * Earlier audit events about the member, or their invitation, may hold
+	 * their old email and name in their changes
+	 */
+	query = `
+		UPDATE audit_events SET
+			changes = changes - ARRAY['avatarURL', 'email', 'firstName', 'lastName']
+		WHERE 1=1
+			AND (
+				(target_type = $1 AND target_id = $2)
+				OR (target_type = $3 AND target_id IN (
+					SELECT id::text FROM member_invitations WHERE member_id::text = $2 OR LOWER(email) = LOWER($4)
+				))
+			)
+	`
+
+	if _, err = tx.Exec(query, AuditTargetMember, member.ID, AuditTargetInvitation, member.Email); err != nil {
+		return fmt.Errorf("error scrubbing audit event changes: %w", err)
+	}
+
+	if _, err = tx.Exec(`UPDATE member_invitations SET email = $1 WHERE member_id = $2 OR LOWER(email) = LOWER($3)`, anonymizedEmail, member.ID, member.Email); err != nil {
+		return fmt.Errorf("error anonymizing invitations: %w", err)
+	}
+
+	if _, err = tx.Exec(`UPDATE audit_events SET actor = $1 WHERE actor = $2`, anonymizedEmail, member.Email); err != nil {
+		return fmt.Errorf("error anonymizing audit events: %w", err)
+	}
+
+	return tx.Commit()
+}
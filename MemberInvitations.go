@@ -0,0 +1,585 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/app-nerds/kit/v6/passwords"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ErrInvalidMemberInvitation is returned when an invitation does not exist,
+has already been accepted, was revoked, or has expired.
+*/
+var ErrInvalidMemberInvitation = errors.New("invalid or expired invitation")
+
+/*
+MemberInvitation is an admin's invitation for someone to become a member.
+Accepting it creates an active member with the invitation's role.
+*/
+type MemberInvitation struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	Email      string     `json:"email"`
+	InvitedBy  string     `json:"invitedBy"`
+	MemberID   string     `json:"memberID"`
+	Role       MemberRole `json:"role"`
+}
+
+type MembersInviteData struct {
+	BaseViewModel
+	Email       string
+	Invitations []MemberInvitation
+	Message     string
+	RoleID      uint
+	Roles       []MemberRole
+	Success     bool
+}
+
+/*
+GET, POST /admin/members/invite
+*/
+func (mm *MemberManagement) handleAdminMembersInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	data := MembersInviteData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets:        []string{},
+		},
+		Success: true,
+	}
+
+	if r.Method == http.MethodPost {
+		_ = r.ParseForm()
+
+		switch r.FormValue("action") {
+		case "invite":
+			data.Success, data.Message = mm.inviteMember(r)
+
+			if !data.Success {
+				data.Email = strings.TrimSpace(r.FormValue("email"))
+				roleID, _ := strconv.Atoi(r.FormValue("role"))
+				data.RoleID = uint(roleID)
+			}
+
+		case "revoke":
+			invitationID := r.FormValue("invitationID")
+
+			if err = mm.memberService.RevokeMemberInvitation(invitationID); err != nil {
+				mm.logger.WithError(err).WithField("invitationID", invitationID).Error("error revoking invitation")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionInvitationRevoked, AuditTargetInvitation, invitationID))
+			data.Message = "The invitation has been revoked."
+		}
+	}
+
+	if data.Roles, err = mm.memberService.GetMemberRoles(); err != nil {
+		mm.logger.WithError(err).Error("error retrieving roles in handleAdminMembersInvite")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	if data.RoleID == 0 {
+		for _, role := range data.Roles {
+			if role.Role == BaseMemberRole {
+				data.RoleID = role.ID
+			}
+		}
+	}
+
+	if data.Invitations, err = mm.memberService.GetPendingMemberInvitations(); err != nil {
+		mm.logger.WithError(err).Error("error retrieving invitations in handleAdminMembersInvite")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	mm.webApp.RenderTemplate(w, "admin-members-invite.tmpl", data)
+}
+
+/*
+inviteMember creates an invitation from the invite form and emails it. It
+returns whether it worked, and a message for the admin.
+*/
+func (mm *MemberManagement) inviteMember(r *http.Request) (bool, string) {
+	var (
+		err        error
+		invitation MemberInvitation
+		role       MemberRole
+		token      string
+	)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+
+	if email == "" {
+		return false, "Please provide the email address to send the invitation to."
+	}
+
+	roleID, err := strconv.Atoi(r.FormValue("role"))
+
+	if err != nil {
+		return false, "Invalid Role selected"
+	}
+
+	if role, err = mm.memberService.GetMemberRoleByID(roleID); err != nil {
+		return false, "There was a problem getting role information"
+	}
+
+	if _, err = mm.memberService.GetMemberByEmail(email, true); err == nil {
+		return false, "A member with this email address already exists."
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		mm.logger.WithError(err).Error("error checking for existing member in inviteMember")
+		return false, "There was a problem checking for an existing member. Please try again."
+	}
+
+	invitedBy := ""
+
+	if admin, ok := AdminPrincipalFromContext(r.Context()); ok {
+		invitedBy = admin.Email
+	}
+
+	if invitation, token, err = mm.memberService.CreateMemberInvitation(email, role.ID, invitedBy, mm.siteAuth.invitationTTL); err != nil {
+		mm.logger.WithError(err).Error("error creating invitation")
+		return false, "There was a problem creating the invitation. Please try again."
+	}
+
+	invitation.Role = role
+
+	if err = mm.siteAuth.sendInvitationEmail(invitation, token); err != nil {
+		mm.logger.WithError(err).WithField("invitationID", invitation.ID).Error("error sending invitation email")
+
+		if err = mm.memberService.RevokeMemberInvitation(invitation.ID); err != nil {
+			mm.logger.WithError(err).WithField("invitationID", invitation.ID).Error("error revoking unsent invitation")
+		}
+
+		return false, "There was a problem sending the invitation email. Please try again."
+	}
+
+	mm.logger.WithFields(logrus.Fields{
+		"invitationID": invitation.ID,
+		"invitedBy":    invitedBy,
+		"role":         role.Role,
+	}).Info("member invited")
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberInvited, AuditTargetInvitation, invitation.ID).WithChanges(nil, map[string]interface{}{
+		"email": invitation.Email,
+		"role":  role.Role,
+	}))
+
+	return true, "An invitation has been sent to " + email + "."
+}
+
+/*
+GET, POST /member/accept-invitation
+*/
+func (mm *MemberManagement) handleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var (
+		err        error
+		invitation MemberInvitation
+		member     Member
+		password   string
+	)
+
+	data := struct {
+		CSRFToken     string
+		Email         string
+		ErrorMessage  string
+		FirstName     string
+		Invalid       bool
+		LastName      string
+		PasswordLogin bool
+		Stylesheets   []string
+		Token         string
+	}{
+		CSRFToken:     CSRFToken(r),
+		PasswordLogin: mm.siteAuth.passwordLoginEnabled(),
+		Stylesheets: []string{
+			"/frame-static/css/frame-page-styles.css",
+		},
+	}
+
+	render := func() {
+		mm.webApp.RenderTemplate(w, "accept-invitation.tmpl", data)
+	}
+
+	if r.Method == http.MethodGet {
+		data.Token = r.URL.Query().Get("token")
+	} else {
+		_ = r.ParseForm()
+		data.Token = r.FormValue("token")
+	}
+
+	invitation, err = mm.memberService.GetMemberInvitationByToken(data.Token)
+
+	if errors.Is(err, ErrInvalidMemberInvitation) {
+		data.Invalid = true
+		data.ErrorMessage = "This invitation is invalid or has expired. Please ask for a new one."
+		render()
+		return
+	}
+
+	if err != nil {
+		mm.logger.WithError(err).Error("error getting invitation in handleAcceptInvitation()")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	data.Email = invitation.Email
+
+	if r.Method == http.MethodGet {
+		render()
+		return
+	}
+
+	data.FirstName = strings.TrimSpace(r.FormValue("firstName"))
+	data.LastName = strings.TrimSpace(r.FormValue("lastName"))
+
+	if data.FirstName == "" || data.LastName == "" {
+		data.ErrorMessage = "Please provide your first and last name."
+		render()
+		return
+	}
+
+	/*
+	 * Members who log in with magic links don't need a password. They get
+	 * a random one, as members who sign up through external providers do.
+	 */
+	if data.PasswordLogin {
+		password = r.FormValue("password")
+
+		if password == "" {
+			data.ErrorMessage = "Please provide a password."
+			render()
+			return
+		}
+
+		if password != r.FormValue("reenterPassword") {
+			data.ErrorMessage = "The passwords you provided don't match. Please re-type them and try submitting again."
+			render()
+			return
+		}
+
+		if err = mm.siteAuth.passwordPolicy.Validate(password, invitation.Email); err != nil {
+			data.ErrorMessage = err.Error()
+			render()
+			return
+		}
+	} else if password, err = generateSecureToken(); err != nil {
+		mm.logger.WithError(err).Error("error generating password in handleAcceptInvitation()")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	if _, err = mm.memberService.GetMemberByEmail(invitation.Email, true); err == nil {
+		data.Invalid = true
+		data.ErrorMessage = "A member with this email address already exists. Please log in instead."
+		render()
+		return
+	}
+
+	member = Member{
+		FirstName: data.FirstName,
+		LastName:  data.LastName,
+		Password:  passwords.HashedPasswordString(password),
+	}
+
+	err = mm.memberService.AcceptMemberInvitation(data.Token, &member)
+
+	if errors.Is(err, ErrInvalidMemberInvitation) {
+		data.Invalid = true
+		data.ErrorMessage = "This invitation is invalid or has expired. Please ask for a new one."
+		render()
+		return
+	}
+
+	if err != nil {
+		mm.logger.WithError(err).WithField("invitationID", invitation.ID).Error("error accepting invitation")
+		http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+		return
+	}
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionInvitationAccepted, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+	/*
+	 * Log the new member straight in
+	 */
+	if member, err = mm.memberService.GetMemberByID(member.ID, false); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error getting new member in handleAcceptInvitation()")
+		http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+		return
+	}
+
+	if err = mm.siteAuth.writeMemberSession(w, r, member); err != nil {
+		mm.logger.WithError(err).Error("error saving session")
+		http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+/*******************************************************************************
+ * Services
+ ******************************************************************************/
+
+const selectMemberInvitationsQuery = `
+	SELECT
+		member_invitations.id,
+		member_invitations.created_at,
+		member_invitations.expires_at,
+		member_invitations.accepted_at,
+		member_invitations.revoked_at,
+		member_invitations.email,
+		member_invitations.invited_by,
+		COALESCE(member_invitations.member_id::text, ''),
+		member_roles.id,
+		member_roles.role,
+		member_roles.color
+	FROM member_invitations
+		INNER JOIN member_roles ON member_invitations.role_id = member_roles.id
+	WHERE 1=1
+`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMemberInvitation(row rowScanner) (MemberInvitation, error) {
+	result := MemberInvitation{}
+
+	err := row.Scan(
+		&result.ID,
+		&result.CreatedAt,
+		&result.ExpiresAt,
+		&result.AcceptedAt,
+		&result.RevokedAt,
+		&result.Email,
+		&result.InvitedBy,
+		&result.MemberID,
+		&result.Role.ID,
+		&result.Role.Role,
+		&result.Role.Color,
+	)
+
+	return result, err
+}
+
+/*
+CreateMemberInvitation invites email to become a member with the given
+role. Earlier invitations to the same address that haven't been accepted
+are revoked. The plaintext token is returned to the caller. Only a hash of
+it is stored.
+*/
+func (s MemberService) CreateMemberInvitation(email string, roleID uint, invitedBy string, ttl time.Duration) (MemberInvitation, string, error) {
+	var (
+		err   error
+		token string
+		tx    *sql.Tx
+	)
+
+	if token, err = generateSecureToken(); err != nil {
+		return MemberInvitation{}, "", err
+	}
+
+	now := time.Now().UTC()
+
+	result := MemberInvitation{
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Email:     email,
+		InvitedBy: invitedBy,
+		Role:      MemberRole{ID: roleID},
+	}
+
+	if tx, err = s.db.Begin(); err != nil {
+		return MemberInvitation{}, "", err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`UPDATE member_invitations SET revoked_at = $1 WHERE LOWER(email) = LOWER($2) AND accepted_at IS NULL AND revoked_at IS NULL`, now, email); err != nil {
+		return MemberInvitation{}, "", err
+	}
+
+	query := `
+		INSERT INTO member_invitations (
+			created_at,
+			expires_at,
+			email,
+			invited_by,
+			role_id,
+			token_hash
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6
+		)
+		RETURNING id
+	`
+
+	if err = tx.QueryRow(query, result.CreatedAt, result.ExpiresAt, email, invitedBy, roleID, hashToken(token)).Scan(&result.ID); err != nil {
+		return MemberInvitation{}, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return MemberInvitation{}, "", err
+	}
+
+	return result, token, nil
+}
+
+/*
+GetMemberInvitationByToken returns the invitation for a token. If it has
+been accepted, revoked, or has expired ErrInvalidMemberInvitation is
+returned.
+*/
+func (s MemberService) GetMemberInvitationByToken(token string) (MemberInvitation, error) {
+	query := selectMemberInvitationsQuery + `
+		AND member_invitations.token_hash = $1
+		AND member_invitations.accepted_at IS NULL
+		AND member_invitations.revoked_at IS NULL
+		AND member_invitations.expires_at > $2
+	`
+
+	result, err := scanMemberInvitation(s.db.QueryRow(query, hashToken(token), time.Now().UTC()))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return MemberInvitation{}, ErrInvalidMemberInvitation
+	}
+
+	return result, err
+}
+
+/*
+GetPendingMemberInvitations returns invitations that can still be accepted,
+newest first.
+*/
+func (s MemberService) GetPendingMemberInvitations() ([]MemberInvitation, error) {
+	var (
+		err        error
+		rows       *sql.Rows
+		invitation MemberInvitation
+	)
+
+	result := []MemberInvitation{}
+
+	query := selectMemberInvitationsQuery + `
+		AND member_invitations.accepted_at IS NULL
+		AND member_invitations.revoked_at IS NULL
+		AND member_invitations.expires_at > $1
+		ORDER BY member_invitations.created_at DESC
+	`
+
+	if rows, err = s.db.Query(query, time.Now().UTC()); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if invitation, err = scanMemberInvitation(rows); err != nil {
+			return result, err
+		}
+
+		result = append(result, invitation)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+RevokeMemberInvitation stops an invitation from being accepted.
+*/
+func (s MemberService) RevokeMemberInvitation(id string) error {
+	_, err := s.db.Exec(`UPDATE member_invitations SET revoked_at = $1 WHERE id = $2 AND accepted_at IS NULL AND revoked_at IS NULL`, time.Now().UTC(), id)
+	return err
+}
+
+/*
+AcceptMemberInvitation uses up an invitation and creates member from it.
+The member gets the invitation's email address and role, is active, is
+approved by the invitation, and their email address is verified. If the invitation can't be used
+ErrInvalidMemberInvitation is returned.
+*/
+func (s MemberService) AcceptMemberInvitation(token string, member *Member) error {
+	var (
+		err          error
+		invitationID string
+		tx           *sql.Tx
+	)
+
+	now := time.Now().UTC()
+
+	if tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE member_invitations SET
+			accepted_at = $1
+		WHERE 1=1
+			AND token_hash = $2
+			AND accepted_at IS NULL
+			AND revoked_at IS NULL
+			AND expires_at > $1
+		RETURNING id, email, role_id
+	`
+
+	err = tx.QueryRow(query, now, hashToken(token)).Scan(&invitationID, &member.Email, &member.Role.ID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidMemberInvitation
+	}
+
+	if err != nil {
+		return fmt.Errorf("error accepting invitation: %w", err)
+	}
+
+	member.Status = MembersStatus{
+		ID:     MemberActiveID,
+		Status: MemberActive,
+	}
+
+	if err = s.createMember(tx, member); err != nil {
+		return fmt.Errorf("error creating member from invitation: %w", err)
+	}
+
+	member.ApprovedBy = "invitation:" + invitationID
+
+	if _, err = tx.Exec(`UPDATE members SET email_verified_at = $1, approved_at = $1, approved_by = $2 WHERE id = $3`, now, member.ApprovedBy, member.ID); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`UPDATE member_invitations SET member_id = $1 WHERE id = $2`, member.ID, invitationID); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	member.ApprovedAt = &now
+	member.EmailVerifiedAt = &now
+	return nil
+}
@@ -0,0 +1,148 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	MemberTokenMagicLink     string = "magic-link"
+	MemberTokenPasswordReset string = "password-reset"
+)
+
+/*
+ErrInvalidMemberToken is returned when a member token does not exist,
+has already been used, or has expired.
+*/
+var ErrInvalidMemberToken = errors.New("invalid or expired token")
+
+/*
+CreateMemberToken issues a new single-use token for a member. The token
+is only valid for the provided purpose and expires after ttl. The plaintext
+token is returned to the caller. Only a hash of it is stored.
+*/
+func (s MemberService) CreateMemberToken(memberID, purpose string, ttl time.Duration) (string, error) {
+	var (
+		err   error
+		token string
+	)
+
+	if token, err = generateSecureToken(); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	query := `
+		INSERT INTO member_tokens (
+			created_at,
+			expires_at,
+			member_id,
+			purpose,
+			token_hash
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5
+		)
+	`
+
+	if _, err = s.db.Exec(query, now, now.Add(ttl), memberID, purpose, hashToken(token)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/*
+ConsumeMemberToken marks a token as used and returns the ID of the member
+it was issued to. A token can only be consumed once. If the token is unknown,
+used, expired, or was issued for a different purpose ErrInvalidMemberToken
+is returned.
+*/
+func (s MemberService) ConsumeMemberToken(purpose, token string) (string, error) {
+	var (
+		err      error
+		memberID string
+	)
+
+	now := time.Now().UTC()
+
+	query := `
+		UPDATE member_tokens SET
+			used_at = $1
+		WHERE 1=1
+			AND token_hash = $2
+			AND purpose = $3
+			AND used_at IS NULL
+			AND expires_at > $1
+		RETURNING member_id
+	`
+
+	err = s.db.QueryRow(query, now, hashToken(token), purpose).Scan(&memberID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidMemberToken
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("error consuming member token: %w", err)
+	}
+
+	return memberID, nil
+}
+
+/*
+PeekMemberToken returns the ID of the member a token was issued to without
+using it up. It fails the same way ConsumeMemberToken does.
+*/
+func (s MemberService) PeekMemberToken(purpose, token string) (string, error) {
+	var (
+		err      error
+		memberID string
+	)
+
+	query := `
+		SELECT member_id
+		FROM member_tokens
+		WHERE 1=1
+			AND token_hash = $1
+			AND purpose = $2
+			AND used_at IS NULL
+			AND expires_at > $3
+	`
+
+	err = s.db.QueryRow(query, hashToken(token), purpose, time.Now().UTC()).Scan(&memberID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidMemberToken
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("error reading member token: %w", err)
+	}
+
+	return memberID, nil
+}
+
+/*
+InvalidateMemberTokens marks all outstanding tokens for a member and
+purpose as used.
+*/
+func (s MemberService) InvalidateMemberTokens(memberID, purpose string) error {
+	query := `
+		UPDATE member_tokens SET
+			used_at = $1
+		WHERE 1=1
+			AND member_id = $2
+			AND purpose = $3
+			AND used_at IS NULL
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), memberID, purpose)
+	return err
+}
@@ -0,0 +1,226 @@
+package frame
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount  int    = 10
+	recoveryCodeLength int    = 10
+	recoveryCodeChars  string = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+/*
+EnableMemberTOTP stores a confirmed TOTP secret for a member and turns on
+two-factor authentication for them. step is the time step of the code
+they confirmed it with, so that code can't be used again to log in.
+*/
+func (s MemberService) EnableMemberTOTP(memberID, secret string, step int64) error {
+	query := `
+		UPDATE members SET
+			updated_at = $1,
+			totp_secret = $2,
+			totp_enabled_at = $1,
+			totp_last_step = $3
+		WHERE id = $4
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), secret, step, memberID)
+	return err
+}
+
+/*
+DisableMemberTOTP turns off two-factor authentication for a member. Their
+secret and any remaining recovery codes are removed.
+*/
+func (s MemberService) DisableMemberTOTP(memberID string) error {
+	var (
+		err error
+		tx  *sql.Tx
+	)
+
+	if tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE members SET
+			updated_at = $1,
+			totp_secret = '',
+			totp_enabled_at = NULL,
+			totp_last_step = 0
+		WHERE id = $2
+	`
+
+	if _, err = tx.Exec(query, time.Now().UTC(), memberID); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM member_recovery_codes WHERE member_id = $1`, memberID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+CreateMemberRecoveryCodes replaces a member's recovery codes with a fresh
+set. The plaintext codes are returned so they can be shown to the member
+once. Only hashes are stored.
+*/
+func (s MemberService) CreateMemberRecoveryCodes(memberID string) ([]string, error) {
+	var (
+		err   error
+		tx    *sql.Tx
+		codes []string
+	)
+
+	if tx, err = s.db.Begin(); err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM member_recovery_codes WHERE member_id = $1`, memberID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO member_recovery_codes (
+			created_at,
+			member_id,
+			code_hash
+		) VALUES (
+			$1,
+			$2,
+			$3
+		)
+	`
+
+	now := time.Now().UTC()
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		var code string
+
+		if code, err = generateRecoveryCode(); err != nil {
+			return nil, err
+		}
+
+		if _, err = tx.Exec(query, now, memberID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+/*
+ConsumeMemberRecoveryCode marks a recovery code as used. It returns false
+if the code does not belong to the member or was already used.
+*/
+func (s MemberService) ConsumeMemberRecoveryCode(memberID, code string) (bool, error) {
+	var (
+		err error
+		id  string
+	)
+
+	query := `
+		UPDATE member_recovery_codes SET
+			used_at = $1
+		WHERE 1=1
+			AND member_id = $2
+			AND code_hash = $3
+			AND used_at IS NULL
+		RETURNING id
+	`
+
+	err = s.db.QueryRow(query, time.Now().UTC(), memberID, hashToken(normalizeRecoveryCode(code))).Scan(&id)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("error consuming recovery code: %w", err)
+	}
+
+	return true, nil
+}
+
+/*
+VerifyMemberSecondFactor checks a code entered by a member against their
+authenticator app. Each app code can only be used once. If that fails the
+code is tried as a recovery code.
+*/
+func (s MemberService) VerifyMemberSecondFactor(member Member, code string) (bool, error) {
+	if member.TotpEnabledAt == nil || member.TotpSecret == "" {
+		return false, nil
+	}
+
+	if step, valid := validateTOTPCode(member.TotpSecret, code, time.Now()); valid {
+		return s.useMemberTOTPStep(member.ID, step)
+	}
+
+	return s.ConsumeMemberRecoveryCode(member.ID, code)
+}
+
+/*
+useMemberTOTPStep records the time step of a TOTP code a member just used.
+It returns false when that step, or a later one, was already used, so a
+code can't be replayed while it is still valid.
+*/
+func (s MemberService) useMemberTOTPStep(memberID string, step int64) (bool, error) {
+	query := `
+		UPDATE members SET
+			totp_last_step = $1
+		WHERE id = $2
+			AND totp_last_step < $1
+	`
+
+	result, err := s.db.Exec(query, step, memberID)
+
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeLength)
+	max := big.NewInt(int64(len(recoveryCodeChars)))
+
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+
+		if err != nil {
+			return "", fmt.Errorf("error generating recovery code: %w", err)
+		}
+
+		b[i] = recoveryCodeChars[n.Int64()]
+	}
+
+	half := recoveryCodeLength / 2
+	return string(b[:half]) + "-" + string(b[half:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
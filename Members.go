@@ -4,14 +4,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"html/template"
 	"mime/multipart"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/app-nerds/gobucket/v2/cmd/gobucketgo"
-	"github.com/app-nerds/gobucket/v2/pkg/requestcontracts"
-	"github.com/app-nerds/gobucket/v2/pkg/responsecontracts"
 	"github.com/app-nerds/kit/v6/passwords"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -25,29 +23,39 @@ import (
 
 type InternalMemberManagementConfig struct {
 	AppName                  string
+	AuditLogger              *AuditLogger
 	CustomMemberSignupConfig *CustomMemberSignupConfig
-	GobucketClient           *gobucketgo.GoBucket
 	Logger                   *logrus.Entry
 	MemberService            *MemberService
+	SessionService           *SessionService
+	SiteAuth                 *SiteAuth
 	WebApp                   *WebApp
 }
 
 type MemberManagement struct {
 	appName                  string
+	auditLogger              *AuditLogger
+	avatarUploader           AvatarUploader
 	customMemberSignupConfig *CustomMemberSignupConfig
-	gobucketClient           *gobucketgo.GoBucket
+	dataExporters            []namedMemberDataExporter
 	logger                   *logrus.Entry
 	memberService            *MemberService
+	runningDataExports       *runningDataExports
+	sessionService           *SessionService
+	siteAuth                 *SiteAuth
 	webApp                   *WebApp
 }
 
 func NewMemberManagement(internalConfig InternalMemberManagementConfig) *MemberManagement {
 	result := &MemberManagement{
 		appName:                  internalConfig.AppName,
+		auditLogger:              internalConfig.AuditLogger,
 		customMemberSignupConfig: internalConfig.CustomMemberSignupConfig,
-		gobucketClient:           internalConfig.GobucketClient,
 		logger:                   internalConfig.Logger,
 		memberService:            internalConfig.MemberService,
+		runningDataExports:       newRunningDataExports(),
+		sessionService:           internalConfig.SessionService,
+		siteAuth:                 internalConfig.SiteAuth,
 		webApp:                   internalConfig.WebApp,
 	}
 
@@ -59,25 +67,51 @@ func NewMemberManagement(internalConfig InternalMemberManagementConfig) *MemberM
  ******************************************************************************/
 
 func (mm *MemberManagement) RegisterRoutes(router *mux.Router, adminRouter *mux.Router) {
-	if mm.customMemberSignupConfig != nil {
-		router.HandleFunc(MemberSignUpPath, mm.customMemberSignupConfig.Handler).Methods(http.MethodGet, http.MethodPost)
+	routes := mm.siteAuth.routes
+
+	/*
+	 * Invite only sites have no public sign up page
+	 */
+	if mm.siteAuth.inviteOnly {
+		mm.logger.Info("invite only. public sign up is turned off")
+	} else if mm.customMemberSignupConfig != nil {
+		routes.public(router.HandleFunc(MemberSignUpPath, mm.customMemberSignupConfig.Handler).Methods(http.MethodGet, http.MethodPost))
 	} else {
-		router.HandleFunc(MemberSignUpPath, mm.handleMemberSignup).Methods(http.MethodGet, http.MethodPost)
-	}
-
-	router.HandleFunc(MemberApiCurrentMember, mm.handleMemberCurrent).Methods(http.MethodGet)
-	router.HandleFunc(MemberApiLogOut, mm.handleMemberLogout).Methods(http.MethodGet)
-	router.HandleFunc(MemberProfilePath, mm.handleMemberProfile).Methods(http.MethodGet, http.MethodPost)
-	router.HandleFunc(MemberProfileAvatarPath, mm.handleEditAvatar).Methods(http.MethodGet, http.MethodPost)
-	adminRouter.HandleFunc("/members/manage", mm.handleAdminMembersManage).Methods(http.MethodGet)
-	adminRouter.HandleFunc("/members/edit/{id}", mm.handleAdminMembersEdit).Methods(http.MethodGet, http.MethodPost)
-	adminRouter.HandleFunc("/roles/manage", mm.handleAdminRolesManage).Methods(http.MethodGet)
-	adminRouter.HandleFunc("/roles/create", mm.handleAdminRolesCreate).Methods(http.MethodGet, http.MethodPost)
-	adminRouter.HandleFunc("/roles/edit/{id}", mm.handleAdminRolesEdit).Methods(http.MethodGet, http.MethodPost)
-	adminRouter.HandleFunc("/api/members", mm.handleAdminApiGetMembers).Methods(http.MethodGet)
-	adminRouter.HandleFunc("/api/member/activate", mm.handleMemberActivate).Methods(http.MethodPut)
-	adminRouter.HandleFunc("/api/member/delete/{id}", mm.handleMemberDelete).Methods(http.MethodDelete)
-	adminRouter.HandleFunc("/api/member/role", mm.handleGetMemberRoles).Methods(http.MethodGet)
+		routes.public(router.HandleFunc(MemberSignUpPath, mm.handleMemberSignup).Methods(http.MethodGet, http.MethodPost))
+	}
+
+	routes.public(router.HandleFunc(MemberAcceptInvitationPath, mm.handleAcceptInvitation).Methods(http.MethodGet, http.MethodPost))
+
+	routes.member(router.HandleFunc(MemberApiCurrentMember, mm.handleMemberCurrent).Methods(http.MethodGet), AuthResponseJSON)
+	routes.member(router.HandleFunc(MemberApiLogOut, mm.handleMemberLogout).Methods(http.MethodGet), AuthResponseJSON)
+	routes.member(router.HandleFunc(MemberProfilePath, mm.handleMemberProfile).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.member(router.HandleFunc(MemberProfileAvatarPath, mm.handleEditAvatar).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.member(router.HandleFunc(MemberProfileTwoFactorPath, mm.handleMemberTwoFactor).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.member(router.HandleFunc(MemberProfileApiTokensPath, mm.handleMemberApiTokens).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.member(router.HandleFunc(MemberProfileDeletePath, mm.handleMemberDeleteAccount).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+
+	if mm.siteAuth.dataExportEnabled() {
+		routes.member(router.HandleFunc(MemberProfileDataExportPath, mm.handleMemberDataExport).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+		routes.member(router.HandleFunc(MemberDataExportDownloadPath, mm.handleMemberDataExportDownload).Methods(http.MethodGet), AuthResponseHTML)
+	}
+
+	routes.admin(adminRouter.HandleFunc("/members/manage", mm.handleAdminMembersManage).Methods(http.MethodGet), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/members/edit/{id}", mm.handleAdminMembersEdit).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/members/invite", mm.handleAdminMembersInvite).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/roles/manage", mm.handleAdminRolesManage).Methods(http.MethodGet), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/roles/create", mm.handleAdminRolesCreate).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/roles/edit/{id}", mm.handleAdminRolesEdit).Methods(http.MethodGet, http.MethodPost), AuthResponseHTML)
+	routes.admin(adminRouter.HandleFunc("/api/members", mm.handleAdminApiGetMembers).Methods(http.MethodGet), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/activate", mm.handleMemberActivate).Methods(http.MethodPut), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/delete/{id}", mm.handleMemberDelete).Methods(http.MethodDelete), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/purge/{id}", mm.handleMemberPurge).Methods(http.MethodPut), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/role", mm.handleGetMemberRoles).Methods(http.MethodGet), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/reset-two-factor/{id}", mm.handleMemberResetTwoFactor).Methods(http.MethodPut), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/unlock/{id}", mm.handleMemberUnlock).Methods(http.MethodPut), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/impersonate/{id}", mm.handleMemberImpersonate).Methods(http.MethodPut), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/sessions/{id}", mm.handleGetMemberSessions).Methods(http.MethodGet), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/sessions/{id}", mm.handleRevokeMemberSessions).Methods(http.MethodDelete), AuthResponseJSON)
+	routes.admin(adminRouter.HandleFunc("/api/member/sessions/{id}/{sessionID}", mm.handleRevokeMemberSession).Methods(http.MethodDelete), AuthResponseJSON)
 }
 
 func (mm *MemberManagement) RegisterAdminTemplate() TemplateCollection {
@@ -85,6 +119,7 @@ func (mm *MemberManagement) RegisterAdminTemplate() TemplateCollection {
 
 	result = append(result, Template{Name: "admin-members-manage.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	result = append(result, Template{Name: "admin-members-edit.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
+	result = append(result, Template{Name: "admin-members-invite.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	result = append(result, Template{Name: "admin-roles-manage.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	result = append(result, Template{Name: "admin-roles-create.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	result = append(result, Template{Name: "admin-roles-edit.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
@@ -97,6 +132,11 @@ func (mm *MemberManagement) RegisterTemplates() TemplateCollection {
 
 	result = append(result, Template{Name: "member-profile.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
 	result = append(result, Template{Name: "member-edit-avatar.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	result = append(result, Template{Name: "member-two-factor.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	result = append(result, Template{Name: "member-api-tokens.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	result = append(result, Template{Name: "member-delete-account.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	result = append(result, Template{Name: "member-data-export.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	result = append(result, Template{Name: "accept-invitation.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
 
 	return result
 }
@@ -111,7 +151,8 @@ func (mm *MemberManagement) handleAdminMembersManage(w http.ResponseWriter, r *h
 			JavascriptIncludes: JavascriptIncludes{
 				{Type: "module", Src: "/pages/admin-members-manage.js"},
 			},
-			AppName: mm.appName,
+			AppName:   mm.appName,
+			CSRFToken: CSRFToken(r),
 		},
 	}
 
@@ -132,8 +173,10 @@ func (mm *MemberManagement) handleAdminMembersEdit(w http.ResponseWriter, r *htt
 			JavascriptIncludes: JavascriptIncludes{
 				{Type: "module", Src: "/pages/admin-members-edit.js"},
 			},
-			AppName: mm.appName,
+			AppName:   mm.appName,
+			CSRFToken: CSRFToken(r),
 		},
+		DatabaseSessions: mm.webApp.sessionType == DatabaseSessionType,
 	}
 
 	if data.Member, err = mm.memberService.GetMemberByID(id, false); err != nil {
@@ -183,10 +226,26 @@ func (mm *MemberManagement) handleAdminMembersEdit(w http.ResponseWriter, r *htt
 			goto rendermembersedit
 		}
 
+		password := r.FormValue("password")
+
+		if password != "" {
+			if err = mm.siteAuth.passwordPolicy.Validate(password, data.Member.Email); err != nil {
+				data.Success = false
+				data.Message = err.Error()
+				goto rendermembersedit
+			}
+		}
+
+		before := data.Member
+
 		data.Member.FirstName = r.FormValue("firstName")
 		data.Member.LastName = r.FormValue("lastName")
 		data.Member.Role = role
 
+		if password != "" {
+			data.Member.Password = passwords.HashedPasswordString(password)
+		}
+
 		if err = mm.memberService.UpdateMember(data.Member); err != nil {
 			mm.logger.WithError(err).WithFields(logrus.Fields{
 				"memberID": data.Member.ID,
@@ -196,6 +255,12 @@ func (mm *MemberManagement) handleAdminMembersEdit(w http.ResponseWriter, r *htt
 			return
 		}
 
+		_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberUpdated, AuditTargetMember, data.Member.ID).WithChanges(before, data.Member))
+
+		if password != "" {
+			_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionPasswordReset, AuditTargetMember, data.Member.ID))
+		}
+
 		data.Success = true
 		data.Message = "Member updated successfully!"
 	}
@@ -209,21 +274,29 @@ func (mm *MemberManagement) handleMemberProfile(w http.ResponseWriter, r *http.R
 		err error
 	)
 
-	ctx := r.Context()
-	memberEmail, _ := ctx.Value("email").(string)
+	member, _ := MemberFromContext(r.Context())
+	memberEmail := member.Email
 
 	data := MemberProfileData{
 		BaseViewModel: BaseViewModel{
 			JavascriptIncludes: JavascriptIncludes{},
 			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
 			Stylesheets: []string{
 				"/frame-static/css/frame-page-styles.css",
 			},
 		},
-		EditAvatarPath: MemberProfileAvatarPath,
-		Member:         Member{},
-		Message:        "",
-		Success:        true,
+		EditAvatarPath:    MemberProfileAvatarPath,
+		Member:            Member{},
+		Message:           "",
+		Success:           true,
+		TwoFactorPath:     MemberProfileTwoFactorPath,
+		ApiTokensPath:     MemberProfileApiTokensPath,
+		DeleteAccountPath: MemberProfileDeletePath,
+	}
+
+	if mm.siteAuth.dataExportEnabled() {
+		data.DataExportPath = MemberProfileDataExportPath
 	}
 
 	if data.Member, err = mm.memberService.GetMemberByEmail(memberEmail, false); err != nil {
@@ -249,6 +322,27 @@ func (mm *MemberManagement) handleMemberProfile(w http.ResponseWriter, r *http.R
 			data.Message = "Please provide a first name."
 		}
 
+		/*
+		 * A password set by an impersonating admin would outlive the
+		 * impersonation
+		 */
+		if data.Success && r.FormValue("password") != "" && isImpersonating(r) {
+			data.Success = false
+			data.Message = "You can't change a member's password while impersonating them."
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			mm.webApp.RenderTemplate(w, "member-profile.tmpl", data)
+			return
+		}
+
+		if data.Success && r.FormValue("password") != "" {
+			if err = mm.siteAuth.passwordPolicy.Validate(r.FormValue("password"), data.Member.Email); err != nil {
+				data.Success = false
+				data.Message = err.Error()
+			}
+		}
+
 		if data.Success {
 			data.Member.FirstName = r.FormValue("firstName")
 			data.Member.LastName = r.FormValue("lastName")
@@ -266,6 +360,10 @@ func (mm *MemberManagement) handleMemberProfile(w http.ResponseWriter, r *http.R
 				return
 			}
 
+			if err = mm.siteAuth.refreshMemberSession(w, r, mm.memberService, data.Member.ID); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error refreshing member session")
+			}
+
 			data.Success = true
 			data.Message = "Member updated successfully!"
 		}
@@ -282,17 +380,16 @@ func (mm *MemberManagement) handleEditAvatar(w http.ResponseWriter, r *http.Requ
 		imageURL string
 	)
 
-	ctx := r.Context()
-	memberEmail, _ := ctx.Value("email").(string)
-	memberFirstName, _ := ctx.Value("firstName").(string)
-	memberLastName, _ := ctx.Value("lastName").(string)
+	member, _ := MemberFromContext(r.Context())
+	memberEmail := member.Email
 
 	data := EditAvatarData{
 		BaseViewModel: BaseViewModel{
 			JavascriptIncludes: JavascriptIncludes{
 				{Type: "module", Src: "/frame-static/js/member-edit-avatar.js"},
 			},
-			AppName: mm.appName,
+			AppName:   mm.appName,
+			CSRFToken: CSRFToken(r),
 			Stylesheets: []string{
 				"/frame-static/css/frame-page-styles.css",
 			},
@@ -333,39 +430,22 @@ func (mm *MemberManagement) handleEditAvatar(w http.ResponseWriter, r *http.Requ
 		defer file.Close()
 
 		/*
-		 * I am supporting two types of uploads: file system, and GoBucket. If GoBucket is
-		 * configured use it.
+		 * Where avatars are stored is up to the application
 		 */
-		if mm.gobucketClient != nil {
-			var createImageResponse *responsecontracts.CreateImageResponse
-
-			createImageRequest := &requestcontracts.CreateImageRequest{
-				Author:       fmt.Sprintf("%s %s", memberFirstName, memberLastName),
-				Bucket:       "avatars",
-				Caption:      fmt.Sprintf("Avatar for %s %s", memberFirstName, memberLastName),
-				DateTime:     time.Now().Format("2006-01-02T15:03:04"),
-				FileContents: file,
-				FileName:     header.Filename,
-				Metadata:     map[string]string{},
-				Name:         fmt.Sprintf("avatar-%s-%s", memberFirstName, memberLastName),
-				ScaleImage:   false,
-				SortIndex:    0,
-				Tags:         []string{},
-			}
-
-			if createImageResponse, err = mm.gobucketClient.CreateImage(createImageRequest); err != nil {
-				mm.logger.WithError(err).Error("error uploading image to Gobucket")
+		if mm.avatarUploader == nil {
+			data.Success = false
+			data.Message = "Avatar uploads aren't available."
+			goto rendereditavatar
+		}
 
-				data.Success = false
-				data.Message = "There was an error uploading your image. Please try again."
-				goto rendereditavatar
-			}
+		if imageURL, err = mm.avatarUploader(data.Member, header.Filename, file); err != nil {
+			mm.logger.WithError(err).Error("error uploading avatar")
 
-			imageURL = createImageResponse.UploadedImages[0].URL
+			data.Success = false
+			data.Message = "There was an error uploading your image. Please try again."
+			goto rendereditavatar
 		}
 
-		// TODO: Add local file upload support
-
 		// Update member record
 		data.Member.AvatarURL = imageURL
 
@@ -377,6 +457,10 @@ func (mm *MemberManagement) handleEditAvatar(w http.ResponseWriter, r *http.Requ
 			goto rendereditavatar
 		}
 
+		if err = mm.siteAuth.refreshMemberSession(w, r, mm.memberService, data.Member.ID); err != nil {
+			mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error refreshing member session")
+		}
+
 		data.Success = true
 		data.Message = "Avatar uploaded successfully!"
 	}
@@ -385,6 +469,164 @@ rendereditavatar:
 	mm.webApp.RenderTemplate(w, "member-edit-avatar.tmpl", data)
 }
 
+/*
+GET, POST /member/profile/two-factor
+*/
+func (mm *MemberManagement) handleMemberTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		session *sessions.Session
+		valid   bool
+	)
+
+	/*
+	 * An impersonating admin could enroll their own authenticator app, and
+	 * keep access to the account after the impersonation ends
+	 */
+	if isImpersonating(r) {
+		mm.sendImpersonationForbidden(w, "You can't change two-factor authentication while impersonating a member.")
+		return
+	}
+
+	member, _ := MemberFromContext(r.Context())
+	memberEmail := member.Email
+
+	data := MemberTwoFactorData{
+		BaseViewModel: BaseViewModel{
+			JavascriptIncludes: JavascriptIncludes{},
+			AppName:            mm.appName,
+			CSRFToken:          CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		},
+		Member:  Member{},
+		Message: "",
+		Success: true,
+	}
+
+	if data.Member, err = mm.memberService.GetMemberByEmail(memberEmail, false); err != nil {
+		mm.logger.WithError(err).Error("error getting member information in handleMemberTwoFactor()")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	if session, err = mm.webApp.GetSessionStore().Get(r, mm.webApp.GetSessionName()); err != nil {
+		mm.logger.WithError(err).Error("error getting session information in handleMemberTwoFactor()")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	/*
+	 * POST
+	 */
+	if r.Method == http.MethodPost {
+		_ = r.ParseForm()
+
+		switch r.FormValue("action") {
+		case "confirm":
+			pendingSecret, _ := session.Values["totpPendingSecret"].(string)
+			step, valid := validateTOTPCode(pendingSecret, r.FormValue("code"), time.Now())
+
+			if pendingSecret == "" || !valid {
+				data.Success = false
+				data.Message = "That code is not valid. Please try again."
+				break
+			}
+
+			if err = mm.memberService.EnableMemberTOTP(data.Member.ID, pendingSecret, step); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error enabling two-factor authentication")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			if data.RecoveryCodes, err = mm.memberService.CreateMemberRecoveryCodes(data.Member.ID); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error creating recovery codes")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			delete(session.Values, "totpPendingSecret")
+			_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionTwoFactorEnabled, AuditTargetMember, data.Member.ID))
+
+			now := time.Now().UTC()
+			data.Member.TotpEnabledAt = &now
+			data.Member.TotpSecret = pendingSecret
+			data.Message = "Two-factor authentication is now enabled."
+
+		case "disable", "regenerate":
+			if valid, err = mm.memberService.VerifyMemberSecondFactor(data.Member, r.FormValue("code")); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error verifying second factor")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			if !valid {
+				data.Success = false
+				data.Message = "That code is not valid. Please try again."
+				break
+			}
+
+			if r.FormValue("action") == "disable" {
+				if err = mm.memberService.DisableMemberTOTP(data.Member.ID); err != nil {
+					mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error disabling two-factor authentication")
+					mm.webApp.UnexpectedError(w, r)
+					return
+				}
+
+				_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionTwoFactorDisabled, AuditTargetMember, data.Member.ID))
+
+				data.Member.TotpEnabledAt = nil
+				data.Member.TotpSecret = ""
+				data.Message = "Two-factor authentication has been disabled."
+				break
+			}
+
+			if data.RecoveryCodes, err = mm.memberService.CreateMemberRecoveryCodes(data.Member.ID); err != nil {
+				mm.logger.WithError(err).WithField("memberID", data.Member.ID).Error("error creating recovery codes")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			data.Message = "New recovery codes have been generated. Your old codes no longer work."
+		}
+	}
+
+	/*
+	 * If two-factor isn't turned on, show the member a secret to enroll. The
+	 * secret is held in the session until they confirm it with a valid code.
+	 */
+	if data.Member.TotpEnabledAt == nil {
+		pendingSecret, _ := session.Values["totpPendingSecret"].(string)
+
+		if pendingSecret == "" {
+			if pendingSecret, err = generateTOTPSecret(); err != nil {
+				mm.logger.WithError(err).Error("error generating TOTP secret")
+				mm.webApp.UnexpectedError(w, r)
+				return
+			}
+
+			session.Values["totpPendingSecret"] = pendingSecret
+		}
+
+		data.Secret = pendingSecret
+
+		if data.QRCode, err = totpQRCodeDataURI(totpProvisioningURI(mm.appName, data.Member.Email, pendingSecret)); err != nil {
+			mm.logger.WithError(err).Error("error creating TOTP QR code")
+			mm.webApp.UnexpectedError(w, r)
+			return
+		}
+	}
+
+	if err = session.Save(r, w); err != nil {
+		mm.logger.WithError(err).Error("error saving session in handleMemberTwoFactor()")
+		mm.webApp.UnexpectedError(w, r)
+		return
+	}
+
+	mm.webApp.RenderTemplate(w, "member-two-factor.tmpl", data)
+}
+
 func (mm *MemberManagement) handleAdminApiGetMembers(w http.ResponseWriter, r *http.Request) {
 	var (
 		err     error
@@ -392,8 +634,9 @@ func (mm *MemberManagement) handleAdminApiGetMembers(w http.ResponseWriter, r *h
 	)
 
 	page := GetPageFromRequest(r)
+	includeDeleted := r.URL.Query().Get("deleted") == "true"
 
-	if members, err = mm.memberService.GetMembers(page, false); err != nil {
+	if members, err = mm.memberService.GetMembers(page, includeDeleted); err != nil {
 		mm.logger.WithError(err).Error("error getting members")
 		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("There was a problem retrieving members", err.Error(), ""))
 		return
@@ -407,20 +650,38 @@ PUT /admin/api/member/activate
 */
 func (mm *MemberManagement) handleMemberActivate(w http.ResponseWriter, r *http.Request) {
 	var (
-		err error
-		id  string
+		err    error
+		id     string
+		member Member
 	)
 
 	r.ParseForm()
 
 	id = r.FormValue("id")
+	approvedBy := "admin"
 
-	if err = mm.memberService.ActivateMember(id); err != nil {
+	if member, err = mm.memberService.GetMemberByID(id, false); err != nil {
+		mm.logger.WithError(err).Error("error getting member to activate")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error activating member", err.Error(), ""))
+		return
+	}
+
+	if admin, ok := AdminPrincipalFromContext(r.Context()); ok {
+		approvedBy = "admin:" + admin.Email
+	}
+
+	if err = mm.memberService.ApproveMember(id, approvedBy); err != nil {
 		mm.logger.WithError(err).Error("error activating member")
 		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error activating member", err.Error(), ""))
 		return
 	}
 
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberActivated, AuditTargetMember, id))
+
+	if member.Status.ID != MemberActiveID {
+		mm.siteAuth.notifyMemberApproved(member)
+	}
+
 	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Member activated!"))
 }
 
@@ -433,10 +694,14 @@ func (mm *MemberManagement) handleMemberCurrent(w http.ResponseWriter, r *http.R
 		member Member
 	)
 
-	ctx := r.Context()
-	email := ctx.Value("email").(string)
+	principal, ok := PrincipalFromContext(r.Context())
 
-	if member, err = mm.memberService.GetMemberByEmail(email, false); err != nil {
+	if !ok {
+		WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("User unauthorized", "", ""))
+		return
+	}
+
+	if member, err = principal.LoadMember(); err != nil {
 		mm.logger.WithError(err).Error("error getting member in handleMemberCurrent()")
 		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error retrieving member information", err.Error(), ""))
 		return
@@ -460,6 +725,7 @@ func (mm *MemberManagement) handleMemberLogout(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	mm.siteAuth.endImpersonation(r, session)
 	session.Options.MaxAge = -1
 
 	if err = mm.webApp.GetSessionStore().Save(r, w, session); err != nil {
@@ -482,6 +748,7 @@ func (mm *MemberManagement) handleMemberSignup(w http.ResponseWriter, r *http.Re
 	)
 
 	data := struct {
+		CSRFToken    string
 		ErrorMessage string
 		Stylesheets  []string
 		User         struct {
@@ -490,6 +757,7 @@ func (mm *MemberManagement) handleMemberSignup(w http.ResponseWriter, r *http.Re
 			Email     string
 		}
 	}{
+		CSRFToken: CSRFToken(r),
 		Stylesheets: []string{
 			"/frame-static/css/frame-page-styles.css",
 		},
@@ -545,6 +813,15 @@ func (mm *MemberManagement) handleMemberSignup(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if err = mm.siteAuth.passwordPolicy.Validate(password, email); err != nil {
+		data.User.FirstName = firstName
+		data.User.LastName = lastName
+		data.User.Email = email
+		data.ErrorMessage = err.Error()
+		render()
+		return
+	}
+
 	// Get the base member role
 	if role, err = mm.memberService.GetMemberRole(BaseMemberRole); err != nil {
 		mm.logger.WithError(err).Error("error retrieving member role in handleMemberSignup()")
@@ -577,6 +854,22 @@ func (mm *MemberManagement) handleMemberSignup(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if err = mm.siteAuth.applyApprovalPolicy(r, mm.memberService, &member); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error applying approval policy to new member")
+	}
+
+	if mm.siteAuth.verifyEmailAddresses {
+		if err = mm.siteAuth.sendVerificationEmail(member); err != nil {
+			mm.logger.WithError(err).WithField("memberID", member.ID).Error("error sending verification email to new member")
+		}
+	}
+
+	if member.Status.ID == MemberActiveID {
+		http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+		return
+	}
+
+	mm.siteAuth.notifyPendingApproval(mm.memberService, member)
 	http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusFound)
 }
 
@@ -595,9 +888,153 @@ func (mm *MemberManagement) handleMemberDelete(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberDeleted, AuditTargetMember, id))
+
 	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Member deleted successfully"))
 }
 
+/*
+PUT /admin/api/member/reset-two-factor/{id}
+*/
+func (mm *MemberManagement) handleMemberResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+		id  string
+	)
+
+	vars := mux.Vars(r)
+	id = vars["id"]
+
+	if err = mm.memberService.DisableMemberTOTP(id); err != nil {
+		mm.logger.WithError(err).WithField("memberID", id).Error("error resetting member two-factor authentication")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error resetting two-factor authentication", err.Error(), ""))
+		return
+	}
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionTwoFactorReset, AuditTargetMember, id))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Two-factor authentication reset successfully"))
+}
+
+/*
+PUT /admin/api/member/unlock/{id}
+*/
+func (mm *MemberManagement) handleMemberUnlock(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		member Member
+	)
+
+	vars := mux.Vars(r)
+
+	if member, err = mm.memberService.GetMemberByID(vars["id"], false); err != nil {
+		mm.logger.WithError(err).WithField("memberID", vars["id"]).Error("error getting member information in handleMemberUnlock()")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error unlocking account", err.Error(), ""))
+		return
+	}
+
+	if err = mm.siteAuth.unlockMember(mm.memberService, member); err != nil {
+		mm.logger.WithError(err).WithField("memberID", member.ID).Error("error unlocking member")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error unlocking account", err.Error(), ""))
+		return
+	}
+
+	mm.logger.WithFields(logrus.Fields{
+		"event":    "account_unlocked",
+		"memberID": member.ID,
+	}).Info("admin unlocked member account")
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionAccountUnlocked, AuditTargetMember, member.ID))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Account unlocked successfully"))
+}
+
+/*
+GET /admin/api/member/sessions/{id}
+*/
+func (mm *MemberManagement) handleGetMemberSessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		err            error
+		id             string
+		memberSessions []DatabaseSession
+	)
+
+	vars := mux.Vars(r)
+	id = vars["id"]
+
+	if memberSessions, err = mm.sessionService.GetMemberSessions(id); err != nil {
+		mm.logger.WithError(err).WithField("memberID", id).Error("error retrieving member sessions")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error retrieving sessions", err.Error(), ""))
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, memberSessions)
+}
+
+/*
+DELETE /admin/api/member/sessions/{id}
+*/
+func (mm *MemberManagement) handleRevokeMemberSessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+		id  string
+	)
+
+	vars := mux.Vars(r)
+	id = vars["id"]
+
+	if err = mm.sessionService.RevokeMemberSessions(id); err != nil {
+		mm.logger.WithError(err).WithField("memberID", id).Error("error revoking member sessions")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error revoking sessions", err.Error(), ""))
+		return
+	}
+
+	if err = mm.memberService.RevokeMemberRefreshTokens(id); err != nil {
+		mm.logger.WithError(err).WithField("memberID", id).Error("error revoking member refresh tokens")
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error revoking sessions", err.Error(), ""))
+		return
+	}
+
+	mm.logger.WithField("memberID", id).Info("revoked all member sessions")
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberSessionsRevoked, AuditTargetMember, id))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Sessions revoked successfully"))
+}
+
+/*
+DELETE /admin/api/member/sessions/{id}/{sessionID}
+*/
+func (mm *MemberManagement) handleRevokeMemberSession(w http.ResponseWriter, r *http.Request) {
+	var (
+		err       error
+		id        string
+		sessionID string
+	)
+
+	vars := mux.Vars(r)
+	id = vars["id"]
+	sessionID = vars["sessionID"]
+
+	if err = mm.sessionService.RevokeMemberSession(id, sessionID); err != nil {
+		mm.logger.WithError(err).WithFields(logrus.Fields{
+			"memberID":  id,
+			"sessionID": sessionID,
+		}).Error("error revoking member session")
+
+		WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error revoking session", err.Error(), ""))
+		return
+	}
+
+	mm.logger.WithFields(logrus.Fields{
+		"memberID":  id,
+		"sessionID": sessionID,
+	}).Info("revoked member session")
+
+	_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionMemberSessionRevoked, AuditTargetMember, id).WithChanges(map[string]string{"sessionID": sessionID}, nil))
+
+	WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Session revoked successfully"))
+}
+
 func (mm *MemberManagement) handleGetMemberRoles(w http.ResponseWriter, r *http.Request) {
 	var (
 		err   error
@@ -624,6 +1061,7 @@ func (mm *MemberManagement) handleAdminRolesManage(w http.ResponseWriter, r *htt
 				{Type: "module", Src: "/pages/admin-roles-manage.js"},
 			},
 			AppName:     mm.appName,
+			CSRFToken:   CSRFToken(r),
 			Stylesheets: []string{},
 		},
 		Roles: []MemberRole{},
@@ -650,6 +1088,7 @@ func (mm *MemberManagement) handleAdminRolesCreate(w http.ResponseWriter, r *htt
 				{Type: "module", Src: "/pages/admin-roles-create.js"},
 			},
 			AppName:     mm.appName,
+			CSRFToken:   CSRFToken(r),
 			Stylesheets: []string{},
 		},
 		Role:    MemberRole{},
@@ -704,6 +1143,8 @@ func (mm *MemberManagement) handleAdminRolesCreate(w http.ResponseWriter, r *htt
 			goto renderrolescreate
 		}
 
+		_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionRoleCreated, AuditTargetRole, strconv.Itoa(int(data.Role.ID))).WithChanges(nil, data.Role))
+
 		http.Redirect(w, r, "/admin/roles/manage", http.StatusFound)
 		return
 	}
@@ -728,6 +1169,7 @@ func (mm *MemberManagement) handleAdminRolesEdit(w http.ResponseWriter, r *http.
 				{Type: "module", Src: "/pages/admin-roles-edit.js"},
 			},
 			AppName:     mm.appName,
+			CSRFToken:   CSRFToken(r),
 			Stylesheets: []string{},
 		},
 		Role:    MemberRole{},
@@ -760,6 +1202,22 @@ func (mm *MemberManagement) handleAdminRolesEdit(w http.ResponseWriter, r *http.
 		goto renderrolesedit
 	}
 
+	if data.Permissions, err = mm.memberService.GetPermissions(); err != nil {
+		mm.logger.WithError(err).Error("error retrieving permissions in handleAdminRolesEdit")
+
+		data.Success = false
+		data.Message = "There was a problem retrieving permissions. Please try again."
+		goto renderrolesedit
+	}
+
+	if data.RolePermissions, err = mm.memberService.GetRolePermissions(data.Role.ID); err != nil {
+		mm.logger.WithError(err).Error("error retrieving role permissions in handleAdminRolesEdit")
+
+		data.Success = false
+		data.Message = "There was a problem retrieving permissions. Please try again."
+		goto renderrolesedit
+	}
+
 	/*
 	 * POST
 	 */
@@ -781,6 +1239,11 @@ func (mm *MemberManagement) handleAdminRolesEdit(w http.ResponseWriter, r *http.
 			goto renderrolesedit
 		}
 
+		before := struct {
+			MemberRole
+			Permissions []string `json:"permissions"`
+		}{MemberRole: data.Role, Permissions: data.RolePermissions.Names()}
+
 		data.Role.Role = roleName
 		data.Role.Color = color
 
@@ -792,6 +1255,24 @@ func (mm *MemberManagement) handleAdminRolesEdit(w http.ResponseWriter, r *http.
 			goto renderrolesedit
 		}
 
+		if err = mm.memberService.SetRolePermissions(data.Role.ID, r.Form["permissions"]); err != nil {
+			mm.logger.WithError(err).Error("error updating role permissions in handleAdminRolesEdit")
+
+			data.Success = false
+			data.Message = "There was a problem updating this role's permissions. Please try again."
+			goto renderrolesedit
+		}
+
+		after := before
+		after.MemberRole = data.Role
+		after.Permissions = []string{}
+
+		if permissions, err := mm.memberService.GetRolePermissions(data.Role.ID); err == nil {
+			after.Permissions = permissions.Names()
+		}
+
+		_ = mm.auditLogger.Record(NewAuditEvent(r, AuditActionRoleUpdated, AuditTargetRole, strconv.Itoa(int(data.Role.ID))).WithChanges(before, after))
+
 		http.Redirect(w, r, "/admin/roles/manage", http.StatusFound)
 		return
 	}
@@ -804,28 +1285,75 @@ renderrolesedit:
  * Services
  ******************************************************************************/
 
+/*
+selectMembersQuery is the base query used to retrieve members along with
+their status and role. Callers append additional conditions.
+*/
+const selectMembersQuery = `
+		SELECT
+			members.id AS member_id,
+			members.created_at AS member_created_at,
+			members.updated_at AS member_updated_at,
+			members.deleted_at AS member_deleted_at,
+			members.avatar_url AS member_avatar_url,
+			members.email AS member_email,
+			members.external_id AS member_external_id,
+			members.first_name AS member_first_name,
+			members.last_name AS member_last_name,
+			members.password AS member_password,
+			members.email_verified_at AS member_email_verified_at,
+			members.totp_enabled_at AS member_totp_enabled_at,
+			members.totp_secret AS member_totp_secret,
+			members.locked_at AS member_locked_at,
+			members.session_epoch AS member_session_epoch,
+			members.approved_at AS member_approved_at,
+			members.approved_by AS member_approved_by,
+			members.anonymized_at AS member_anonymized_at,
+			member_statuses.id AS status_id,
+			member_statuses.status AS status_status, 
+			member_roles.id AS role_id,
+			member_roles.role AS role_role,
+			member_roles.color
+		FROM members 
+			INNER JOIN member_statuses ON members.status_id = member_statuses.id
+			INNER JOIN member_roles ON members.role_id = member_roles.id
+		WHERE 1=1
+`
+
 type MemberServiceConfig struct {
-	DB       *sql.DB
-	PageSize int
+	DB             *sql.DB
+	PageSize       int
+	PasswordHasher PasswordHasher
 }
 
 type MemberService struct {
-	db       *sql.DB
-	pageSize int
+	db              *sql.DB
+	pageSize        int
+	passwordHasher  PasswordHasher
+	permissionCache *rolePermissionCache
 }
 
 func NewMemberService(config MemberServiceConfig) MemberService {
-	return MemberService{
-		db:       config.DB,
-		pageSize: config.PageSize,
+	result := MemberService{
+		db:              config.DB,
+		pageSize:        config.PageSize,
+		passwordHasher:  config.PasswordHasher,
+		permissionCache: newRolePermissionCache(),
 	}
+
+	if result.passwordHasher == nil {
+		result.passwordHasher = DefaultArgon2idHasher()
+	}
+
+	return result
 }
 
 func (s MemberService) ActivateMember(id string) error {
 	query := `
 		UPDATE members SET 
 			status_id = $1,
-			updated_at = $2
+			updated_at = $2,
+			session_epoch = session_epoch + 1
 		WHERE id = $3
 	`
 
@@ -833,8 +1361,38 @@ func (s MemberService) ActivateMember(id string) error {
 	return err
 }
 
+/*
+ApproveMember activates a member and records who approved them. A member
+who was approved before, and has since been inactivated, keeps their
+original approval.
+*/
+func (s MemberService) ApproveMember(id, approvedBy string) error {
+	query := `
+		UPDATE members SET
+			status_id = $1,
+			updated_at = $2,
+			approved_by = CASE WHEN approved_at IS NULL THEN $3 ELSE approved_by END,
+			approved_at = COALESCE(approved_at, $2),
+			session_epoch = session_epoch + 1
+		WHERE id = $4
+	`
+
+	_, err := s.db.Exec(query, MemberActiveID, time.Now().UTC(), approvedBy, id)
+	return err
+}
+
 func (s MemberService) CreateMember(member *Member) error {
-	member.Password = member.Password.Hash()
+	return s.createMember(s.db, member)
+}
+
+func (s MemberService) createMember(db sqlExecutor, member *Member) error {
+	hash, err := s.HashPassword(string(member.Password))
+
+	if err != nil {
+		return err
+	}
+
+	member.Password = passwords.HashedPasswordString(hash)
 
 	query := `
 		INSERT INTO members (
@@ -858,9 +1416,10 @@ func (s MemberService) CreateMember(member *Member) error {
 			$8,
 			$9
 		)
+		RETURNING id
 	`
 
-	_, err := s.db.Exec(
+	err = db.QueryRow(
 		query,
 		time.Now().UTC(),
 		member.AvatarURL,
@@ -871,7 +1430,7 @@ func (s MemberService) CreateMember(member *Member) error {
 		member.Password,
 		member.Role.ID,
 		member.Status.ID,
-	)
+	).Scan(&member.ID)
 
 	return err
 }
@@ -879,7 +1438,8 @@ func (s MemberService) CreateMember(member *Member) error {
 func (s MemberService) DeleteMember(id string) error {
 	query := `
 		UPDATE members SET
-			deleted_at = $1
+			deleted_at = $1,
+			session_epoch = session_epoch + 1
 		WHERE id = $2
 	`
 
@@ -888,27 +1448,7 @@ func (s MemberService) DeleteMember(id string) error {
 }
 
 func (s MemberService) GetMemberByEmail(email string, includeDeleted bool) (Member, error) {
-	query := `
-		SELECT
-			members.id AS member_id,
-			members.created_at AS member_created_at,
-			members.updated_at AS member_updated_at,
-			members.deleted_at AS member_deleted_at,
-			members.avatar_url AS member_avatar_url,
-			members.email AS member_email,
-			members.external_id AS member_external_id,
-			members.first_name AS member_first_name,
-			members.last_name AS member_last_name,
-			members.password AS member_password,
-			member_statuses.id AS status_id,
-			member_statuses.status AS status_status, 
-			member_roles.id AS role_id,
-			member_roles.role AS role_role,
-			member_roles.color
-		FROM members 
-			INNER JOIN member_statuses ON members.status_id = member_statuses.id
-			INNER JOIN member_roles ON members.role_id = member_roles.id
-		WHERE 1=1
+	query := selectMembersQuery + `
 			AND members.email = $1
 	`
 
@@ -937,28 +1477,42 @@ func (s MemberService) GetMemberByEmail(email string, includeDeleted bool) (Memb
 	return members[0], nil
 }
 
+/*
+GetMemberByExternalID retrieves a member by the ID assigned to them by an
+external authentication provider.
+*/
+func (s MemberService) GetMemberByExternalID(externalID string, includeDeleted bool) (Member, error) {
+	query := selectMembersQuery + `
+			AND members.external_id = $1
+	`
+
+	if !includeDeleted {
+		query += " AND members.deleted_at IS NULL"
+	}
+
+	rows, err := s.db.Query(query, externalID)
+
+	if err != nil {
+		return Member{}, err
+	}
+
+	defer rows.Close()
+
+	members := []Member{}
+
+	if err = carta.Map(rows, &members); err != nil {
+		return Member{}, err
+	}
+
+	if len(members) < 1 {
+		return Member{}, fmt.Errorf("member not found: %w", sql.ErrNoRows)
+	}
+
+	return members[0], nil
+}
+
 func (s MemberService) GetMemberByID(id string, includeDeleted bool) (Member, error) {
-	query := `
-		SELECT
-			members.id AS member_id,
-			members.created_at AS member_created_at,
-			members.updated_at AS member_updated_at,
-			members.deleted_at AS member_deleted_at,
-			members.avatar_url AS member_avatar_url,
-			members.email AS member_email,
-			members.external_id AS member_external_id,
-			members.first_name AS member_first_name,
-			members.last_name AS member_last_name,
-			members.password AS member_password,
-			member_statuses.id AS status_id,
-			member_statuses.status AS status_status, 
-			member_roles.id AS role_id,
-			member_roles.role AS role_role,
-			member_roles.color
-		FROM members 
-			INNER JOIN member_statuses ON members.status_id = member_statuses.id
-			INNER JOIN member_roles ON members.role_id = member_roles.id
-		WHERE 1=1
+	query := selectMembersQuery + `
 			AND members.id = $1
 	`
 
@@ -990,28 +1544,7 @@ func (s MemberService) GetMemberByID(id string, includeDeleted bool) (Member, er
 func (s MemberService) GetMembers(page int, includeDeleted bool) ([]Member, error) {
 	members := []Member{}
 
-	query := `
-		SELECT
-			members.id AS member_id,
-			members.created_at AS member_created_at,
-			members.updated_at AS member_updated_at,
-			members.deleted_at AS member_deleted_at,
-			members.avatar_url AS member_avatar_url,
-			members.email AS member_email,
-			members.external_id AS member_external_id,
-			members.first_name AS member_first_name,
-			members.last_name AS member_last_name,
-			members.password AS member_password,
-			member_statuses.id AS status_id,
-			member_statuses.status AS status_status, 
-			member_roles.id AS role_id,
-			member_roles.role AS role_role,
-			member_roles.color
-		FROM members 
-			INNER JOIN member_statuses ON members.status_id = member_statuses.id
-			INNER JOIN member_roles ON members.role_id = member_roles.id
-		WHERE 1=1
-	`
+	query := selectMembersQuery
 
 	if !includeDeleted {
 		query += " AND members.deleted_at IS NULL"
@@ -1034,6 +1567,28 @@ func (s MemberService) GetMembers(page int, includeDeleted bool) ([]Member, erro
 	return members, nil
 }
 
+/*
+GetActiveMembersByRole returns every active member with a role.
+*/
+func (s MemberService) GetActiveMembersByRole(roleID uint) ([]Member, error) {
+	members := []Member{}
+
+	query := selectMembersQuery + " AND members.deleted_at IS NULL AND members.status_id = $1 AND members.role_id = $2"
+	rows, err := s.db.Query(query, MemberActiveID, roleID)
+
+	if err != nil {
+		return members, err
+	}
+
+	defer rows.Close()
+
+	if err = carta.Map(rows, &members); err != nil {
+		return members, err
+	}
+
+	return members, nil
+}
+
 func (s MemberService) GetMemberRole(name string) (MemberRole, error) {
 	var (
 		err   error
@@ -1185,7 +1740,8 @@ func (s MemberService) InactivateMember(id uint) error {
 
 	query := `
 		UPDATE members SET 
-			status_id = $1
+			status_id = $1,
+			session_epoch = session_epoch + 1
 		WHERE id = $2
 	`
 
@@ -1196,9 +1752,54 @@ func (s MemberService) InactivateMember(id uint) error {
 	return nil
 }
 
+/*
+LinkMemberExternalID associates an existing member with an account at an
+external authentication provider.
+*/
+func (s MemberService) LinkMemberExternalID(id, externalID string) error {
+	query := `
+		UPDATE members SET
+			updated_at = $1,
+			external_id = $2
+		WHERE id = $3
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), externalID, id)
+	return err
+}
+
+/*
+GetMemberSessionEpoch returns a member's session epoch. It changes every
+time the member is updated, so sessions created before the change can be
+reloaded.
+*/
+func (s MemberService) GetMemberSessionEpoch(id string) (int, error) {
+	var epoch int
+
+	err := s.db.QueryRow(`SELECT session_epoch FROM members WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&epoch)
+	return epoch, err
+}
+
+/*
+MarkMemberEmailVerified records that a member has proven they own their
+email address.
+*/
+func (s MemberService) MarkMemberEmailVerified(id string) error {
+	query := `
+		UPDATE members SET
+			updated_at = $1,
+			email_verified_at = $1
+		WHERE id = $2
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), id)
+	return err
+}
+
 func (s MemberService) UpdateMember(member Member) error {
 	var (
-		err error
+		err  error
+		hash string
 	)
 
 	query := `
@@ -1210,7 +1811,8 @@ func (s MemberService) UpdateMember(member Member) error {
 			first_name = $5,
 			last_name = $6,
 			role_id = $7,
-			status_id = $8
+			status_id = $8,
+			session_epoch = session_epoch + 1
 	`
 
 	if member.Password != "" {
@@ -1224,7 +1826,11 @@ func (s MemberService) UpdateMember(member Member) error {
 	 * If we've got a password in the new member struct, we are changing it
 	 */
 	if member.Password != "" {
-		member.Password = member.Password.Hash()
+		if hash, err = s.HashPassword(string(member.Password)); err != nil {
+			return err
+		}
+
+		member.Password = passwords.HashedPasswordString(hash)
 	}
 
 	params := []interface{}{
@@ -1258,6 +1864,8 @@ func (s MemberService) UpdateMember(member Member) error {
 type MemberStatus string
 
 const (
+	AdminMemberRole         string       = "Admin"
+	AdminMemberRoleID       uint         = 1
 	BaseMemberRole          string       = "Member"
 	MemberPendingApprovalID uint         = 1
 	MemberPendingApproval   MemberStatus = "Pending Approval"
@@ -1268,18 +1876,26 @@ const (
 )
 
 type Member struct {
-	ID         string                         `json:"id" db:"member_id"`
-	CreatedAt  time.Time                      `json:"createdAt" db:"member_created_at"`
-	UpdatedAt  *time.Time                     `json:"updatedAt" db:"member_updated_at"`
-	DeletedAt  *time.Time                     `json:"deletedAt" db:"member_deleted_at"`
-	AvatarURL  string                         `json:"avatarURL" db:"member_avatar_url"`
-	Email      string                         `json:"email" db:"member_email"`
-	ExternalID string                         `json:"-" db:"member_external_id"`
-	FirstName  string                         `json:"firstName" db:"member_first_name"`
-	LastName   string                         `json:"lastName" db:"member_last_name"`
-	Password   passwords.HashedPasswordString `json:"-" db:"member_password"`
-	Role       MemberRole                     `json:"role"`
-	Status     MembersStatus                  `json:"memberStatus"`
+	ID              string                         `json:"id" db:"member_id"`
+	CreatedAt       time.Time                      `json:"createdAt" db:"member_created_at"`
+	UpdatedAt       *time.Time                     `json:"updatedAt" db:"member_updated_at"`
+	DeletedAt       *time.Time                     `json:"deletedAt" db:"member_deleted_at"`
+	ApprovedAt      *time.Time                     `json:"approvedAt" db:"member_approved_at"`
+	ApprovedBy      string                         `json:"approvedBy" db:"member_approved_by"`
+	AnonymizedAt    *time.Time                     `json:"anonymizedAt" db:"member_anonymized_at"`
+	AvatarURL       string                         `json:"avatarURL" db:"member_avatar_url"`
+	Email           string                         `json:"email" db:"member_email"`
+	EmailVerifiedAt *time.Time                     `json:"emailVerifiedAt" db:"member_email_verified_at"`
+	ExternalID      string                         `json:"-" db:"member_external_id"`
+	FirstName       string                         `json:"firstName" db:"member_first_name"`
+	LastName        string                         `json:"lastName" db:"member_last_name"`
+	LockedAt        *time.Time                     `json:"lockedAt" db:"member_locked_at"`
+	Password        passwords.HashedPasswordString `json:"-" db:"member_password"`
+	Role            MemberRole                     `json:"role"`
+	SessionEpoch    int                            `json:"-" db:"member_session_epoch"`
+	Status          MembersStatus                  `json:"memberStatus"`
+	TotpEnabledAt   *time.Time                     `json:"totpEnabledAt" db:"member_totp_enabled_at"`
+	TotpSecret      string                         `json:"-" db:"member_totp_secret"`
 }
 
 type MemberRole struct {
@@ -1302,16 +1918,31 @@ type MembersManageData struct {
 
 type MembersEditData struct {
 	BaseViewModel
-	Member  Member
-	Message string
-	Success bool
+	DatabaseSessions bool
+	Member           Member
+	Message          string
+	Success          bool
 }
 type MemberProfileData struct {
 	BaseViewModel
-	EditAvatarPath string
-	Member         Member
-	Message        string
-	Success        bool
+	ApiTokensPath     string
+	DataExportPath    string
+	DeleteAccountPath string
+	EditAvatarPath    string
+	Member            Member
+	Message           string
+	Success           bool
+	TwoFactorPath     string
+}
+
+type MemberTwoFactorData struct {
+	BaseViewModel
+	Member        Member
+	Message       string
+	QRCode        template.URL
+	RecoveryCodes []string
+	Secret        string
+	Success       bool
 }
 
 type EditAvatarData struct {
@@ -1335,7 +1966,9 @@ type RolesCreateData struct {
 
 type RolesEditData struct {
 	BaseViewModel
-	Role    MemberRole
-	Success bool
-	Message string
+	Permissions     []Permission
+	Role            MemberRole
+	RolePermissions PermissionSet
+	Success         bool
+	Message         string
 }
@@ -0,0 +1,363 @@
+package frame
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordHasherArgon2id string = "argon2id"
+	PasswordHasherBcrypt   string = "bcrypt"
+
+	argon2idPrefix string = "$argon2id$"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+/*
+argon2Slots limits how many Argon2id hashes run at once. Each one holds its
+full memory cost while it runs, and logins are unauthenticated, so without
+a limit a burst of them could use all of the server's memory. Extra hashes
+wait for a slot.
+*/
+var argon2Slots = make(chan struct{}, runtime.NumCPU())
+
+/*
+PasswordHasher hashes and verifies member passwords. Every hash it makes
+must start with a prefix naming its algorithm, so hashes made by different
+hashers can be told apart. When a member logs in with a password hashed by
+a different algorithm, or with different parameters, it is rehashed with
+the current hasher.
+*/
+type PasswordHasher interface {
+	/*
+	 * Hash returns an encoded hash of password, including its algorithm
+	 * prefix and any parameters needed to verify it later.
+	 */
+	Hash(password string) (string, error)
+
+	/*
+	 * Recognizes returns true when hash was made by this hasher's algorithm.
+	 */
+	Recognizes(hash string) bool
+
+	/*
+	 * Verify returns true when password matches hash.
+	 */
+	Verify(hash, password string) (bool, error)
+
+	/*
+	 * NeedsRehash returns true when hash was made by this hasher's
+	 * algorithm, but with different parameters than it uses now.
+	 */
+	NeedsRehash(hash string) bool
+}
+
+/*
+Argon2idHasher hashes passwords with Argon2id. Hashes are stored in the
+PHC string format, such as $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+Memory is in KiB.
+*/
+type Argon2idHasher struct {
+	Iterations  uint32
+	KeyLength   uint32
+	Memory      uint32
+	Parallelism uint8
+	SaltLength  uint32
+}
+
+/*
+DefaultArgon2idHasher returns an Argon2idHasher with 64MB of memory, 3
+iterations, and 2 threads.
+*/
+func DefaultArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Iterations:  3,
+		KeyLength:   32,
+		Memory:      64 * 1024,
+		Parallelism: 2,
+		SaltLength:  16,
+	}
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+
+	key := argon2IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+/*
+Verify uses the parameters stored in hash, so hashes made with older
+parameters can still be checked.
+*/
+func (h Argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hash)
+
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2idHash(hash)
+
+	if err != nil {
+		return true
+	}
+
+	return params.Iterations != h.Iterations ||
+		params.Memory != h.Memory ||
+		params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength ||
+		uint32(len(key)) != h.KeyLength
+}
+
+func argon2IDKey(password, salt []byte, iterations, memory uint32, parallelism uint8, keyLength uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+
+	return argon2.IDKey(password, salt, iterations, memory, parallelism, keyLength)
+}
+
+func decodeArgon2idHash(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var (
+		err     error
+		key     []byte
+		params  Argon2idHasher
+		salt    []byte
+		version int
+	)
+
+	/*
+	 * "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	 */
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 6 || parts[1] != PasswordHasherArgon2id {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	params.KeyLength = uint32(len(key))
+	params.SaltLength = uint32(len(salt))
+	return params, salt, key, nil
+}
+
+/*
+BcryptHasher hashes passwords with bcrypt. This is how Frame hashed
+passwords before Argon2id, and those hashes are still verified with it.
+*/
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	result, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(result), err
+}
+
+func (h BcryptHasher) Recognizes(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+func (h BcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+/*
+newPasswordHasherFromConfig builds the hasher chosen by the
+PASSWORD_HASHER setting.
+*/
+func newPasswordHasherFromConfig(config *Config) (PasswordHasher, error) {
+	switch config.PasswordHasher {
+	case PasswordHasherArgon2id, "":
+		hasher := DefaultArgon2idHasher()
+
+		if int64(config.Argon2Iterations) > math.MaxUint32 {
+			return nil, fmt.Errorf("argon2 iterations must be at most %d", uint32(math.MaxUint32))
+		}
+
+		if int64(config.Argon2Memory) > math.MaxUint32 {
+			return nil, fmt.Errorf("argon2 memory must be at most %d KiB", uint32(math.MaxUint32))
+		}
+
+		if config.Argon2Parallelism > math.MaxUint8 {
+			return nil, fmt.Errorf("argon2 parallelism must be at most %d", math.MaxUint8)
+		}
+
+		if config.Argon2Iterations > 0 {
+			hasher.Iterations = uint32(config.Argon2Iterations)
+		}
+
+		if config.Argon2Memory > 0 {
+			hasher.Memory = uint32(config.Argon2Memory)
+		}
+
+		if config.Argon2Parallelism > 0 {
+			hasher.Parallelism = uint8(config.Argon2Parallelism)
+		}
+
+		return hasher, nil
+
+	case PasswordHasherBcrypt:
+		cost := config.BcryptCost
+
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		return BcryptHasher{Cost: cost}, nil
+	}
+
+	return nil, fmt.Errorf("unknown password hasher '%s'", config.PasswordHasher)
+}
+
+/*
+HashPassword hashes a plaintext password with the current password hasher.
+*/
+func (s MemberService) HashPassword(password string) (string, error) {
+	return s.passwordHasher.Hash(password)
+}
+
+/*
+IsPasswordCorrect returns true when password matches the member's stored
+hash. The hash may have been made by the current hasher, by Argon2id with
+any parameters, or by bcrypt.
+*/
+func (s MemberService) IsPasswordCorrect(member Member, password string) bool {
+	hash := string(member.Password)
+
+	for _, hasher := range s.knownPasswordHashers() {
+		if hasher.Recognizes(hash) {
+			valid, _ := hasher.Verify(hash, password)
+			return valid
+		}
+	}
+
+	return false
+}
+
+/*
+RehashPasswordIfNeeded rehashes the member's password with the current
+hasher when their stored hash used another algorithm or other parameters.
+Call it only after IsPasswordCorrect has returned true for password. The
+update is skipped if the password changed in the meantime, and doesn't
+end the member's other sessions.
+*/
+func (s MemberService) RehashPasswordIfNeeded(member Member, password string) (bool, error) {
+	var (
+		err    error
+		hash   string
+		result sql.Result
+	)
+
+	current := string(member.Password)
+
+	if s.passwordHasher.Recognizes(current) && !s.passwordHasher.NeedsRehash(current) {
+		return false, nil
+	}
+
+	if hash, err = s.passwordHasher.Hash(password); err != nil {
+		return false, err
+	}
+
+	query := `
+		UPDATE members SET
+			password = $1
+		WHERE id = $2
+			AND password = $3
+	`
+
+	if result, err = s.db.Exec(query, hash, member.ID, current); err != nil {
+		return false, err
+	}
+
+	updated, _ := result.RowsAffected()
+	return updated > 0, nil
+}
+
+/*
+upgradePasswordHash is called after a successful password login. It
+rehashes the member's password when needed. Failures are only logged, so
+they never stop the member from logging in.
+*/
+func upgradePasswordHash(logger *logrus.Entry, memberService *MemberService, member Member, password string) {
+	upgraded, err := memberService.RehashPasswordIfNeeded(member, password)
+
+	if err != nil {
+		logger.WithError(err).WithField("memberID", member.ID).Error("error rehashing member password")
+		return
+	}
+
+	if upgraded {
+		logger.WithField("memberID", member.ID).Info("rehashed member password")
+	}
+}
+
+func (s MemberService) knownPasswordHashers() []PasswordHasher {
+	return []PasswordHasher{
+		s.passwordHasher,
+		Argon2idHasher{},
+		BcryptHasher{},
+	}
+}
@@ -0,0 +1,155 @@
+package frame
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+/*
+PasswordPolicy sets the rules new passwords must follow. It is enforced
+when members sign up, accept an invitation, reset or change their
+password, and when an admin sets one. Choose one with
+SiteAuthConfig.PasswordPolicy. The default is DefaultPasswordPolicy().
+*/
+type PasswordPolicy struct {
+	MinLength        int
+	RequireLowercase bool
+	RequireUppercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+
+	/*
+	 * DisallowEmail rejects passwords that are the member's email address,
+	 * or the part of it before the @.
+	 */
+	DisallowEmail bool
+
+	/*
+	 * DisallowCommon rejects passwords found in the file named by
+	 * PASSWORD_LIST_FILE. Frame doesn't ship one. Use a list of breached
+	 * passwords at least as long as the top 100,000. Site auth won't start
+	 * without it while this is turned on.
+	 */
+	DisallowCommon bool
+
+	commonPasswords map[string]struct{}
+}
+
+/*
+DefaultPasswordPolicy requires at least 10 characters, and rejects the
+member's email address and the passwords in PASSWORD_LIST_FILE. It doesn't
+require any particular kinds of characters.
+*/
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      10,
+		DisallowEmail:  true,
+		DisallowCommon: true,
+	}
+}
+
+/*
+Validate checks a password against the policy. The error describes the
+first rule that was broken, and is written to be shown to the member.
+*/
+func (p PasswordPolicy) Validate(password, email string) error {
+	var (
+		hasLower  bool
+		hasUpper  bool
+		hasDigit  bool
+		hasSymbol bool
+	)
+
+	if password == "" {
+		return errors.New("Please provide a password.")
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("Your password must be at least %d characters long.", p.MinLength)
+	}
+
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+
+	if p.RequireLowercase && !hasLower {
+		return errors.New("Your password must contain a lowercase letter.")
+	}
+
+	if p.RequireUppercase && !hasUpper {
+		return errors.New("Your password must contain an uppercase letter.")
+	}
+
+	if p.RequireDigit && !hasDigit {
+		return errors.New("Your password must contain a number.")
+	}
+
+	if p.RequireSymbol && !hasSymbol {
+		return errors.New("Your password must contain a symbol, such as ! or #.")
+	}
+
+	if p.DisallowEmail && email != "" {
+		lowerPassword := strings.ToLower(password)
+		lowerEmail := strings.ToLower(strings.TrimSpace(email))
+		localPart, _, _ := strings.Cut(lowerEmail, "@")
+
+		if lowerPassword == lowerEmail || lowerPassword == localPart {
+			return errors.New("Your password can't be your email address.")
+		}
+	}
+
+	if p.DisallowCommon {
+		if _, ok := p.commonPasswords[strings.ToLower(password)]; ok {
+			return errors.New("That password is too common and easy to guess. Please choose another.")
+		}
+	}
+
+	return nil
+}
+
+/*
+loadCommonPasswords reads the passwords DisallowCommon rejects from path,
+one per line. Blank lines and lines starting with # are skipped.
+*/
+func (p *PasswordPolicy) loadCommonPasswords(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	result := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		result[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	p.commonPasswords = result
+	return nil
+}
@@ -0,0 +1,394 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Permission is a named action, such as "invoices.write", that can be granted
+to member roles. Checking permissions instead of role names means handlers
+keep working when a role is renamed.
+*/
+type Permission struct {
+	ID          uint       `json:"id"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   *time.Time `json:"updatedAt"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+}
+
+/*
+PermissionSet is the set of permission names granted to a member's role.
+*/
+type PermissionSet map[string]struct{}
+
+/*
+Has returns true if the set contains the named permission.
+*/
+func (ps PermissionSet) Has(name string) bool {
+	_, ok := ps[name]
+	return ok
+}
+
+/*
+Names returns the permission names in the set, sorted.
+*/
+func (ps PermissionSet) Names() []string {
+	result := make([]string, 0, len(ps))
+
+	for name := range ps {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+/*
+rolePermissionCacheTTL is how long a role's permissions are cached. Other
+instances of the application can't clear this one's cache, so it is how
+long a change made on one of them can take to reach the rest.
+*/
+const rolePermissionCacheTTL = time.Second * 30
+
+/*
+rolePermissionCache keeps each role's permissions in memory so the site
+auth middleware doesn't query the database on every request. It is
+cleared whenever permissions or role grants change, and entries expire
+after rolePermissionCacheTTL.
+*/
+type rolePermissionCache struct {
+	lock  *sync.RWMutex
+	roles map[uint]cachedRolePermissions
+}
+
+type cachedRolePermissions struct {
+	loadedAt    time.Time
+	permissions PermissionSet
+}
+
+func newRolePermissionCache() *rolePermissionCache {
+	return &rolePermissionCache{
+		lock:  &sync.RWMutex{},
+		roles: map[uint]cachedRolePermissions{},
+	}
+}
+
+func (c *rolePermissionCache) get(roleID uint) (PermissionSet, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	cached, ok := c.roles[roleID]
+
+	if !ok || time.Since(cached.loadedAt) > rolePermissionCacheTTL {
+		return nil, false
+	}
+
+	return cached.permissions, true
+}
+
+func (c *rolePermissionCache) set(roleID uint, permissions PermissionSet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.roles[roleID] = cachedRolePermissions{
+		loadedAt:    time.Now(),
+		permissions: permissions,
+	}
+}
+
+func (c *rolePermissionCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.roles = map[uint]cachedRolePermissions{}
+}
+
+/*
+RegisterPermissions registers the permissions your application uses. They
+are written to the database when Start() is called, and show up as options
+on the admin role edit page. Registering an existing name updates its
+description.
+
+	app.RegisterPermissions(
+		frame.Permission{Name: "invoices.read", Description: "View invoices"},
+		frame.Permission{Name: "invoices.write", Description: "Create and edit invoices"},
+	)
+*/
+func (fa *FrameApplication) RegisterPermissions(permissions ...Permission) *FrameApplication {
+	fa.permissions = append(fa.permissions, permissions...)
+	return fa
+}
+
+/*
+RequirePermission returns middleware that only lets members whose role has
+the named permission through. Responses for members without it are the
+same as RequireRole.
+*/
+func (fa *FrameApplication) RequirePermission(name string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if HasPermission(r.Context(), name) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			member, _ := MemberFromContext(r.Context())
+
+			logger := fa.Logger.WithFields(logrus.Fields{
+				"ip":         RealIP(r),
+				"path":       r.URL.Path,
+				"permission": name,
+			})
+
+			if member.Email == "" {
+				logger.Error("user is not authorized")
+
+				if fa.siteAuth != nil {
+					fa.siteAuth.sendUnauthorizedResponse(w, r)
+					return
+				}
+
+				sendJSONStatusResponse(w, http.StatusUnauthorized, "User unauthorized")
+				return
+			}
+
+			logger.Error("member does not have a required permission")
+			fa.sendForbiddenResponse(w, r)
+		})
+	}
+}
+
+/*
+HasPermission returns true if the logged in member's role has the named
+permission. ctx is the request context set up by the site auth middleware.
+*/
+func HasPermission(ctx context.Context, name string) bool {
+	return PermissionsFromContext(ctx).Has(name)
+}
+
+/*
+PermissionsFromContext returns the logged in member's permissions. Put the
+result in your view model's Permissions field to check permissions from a
+template:
+
+	{{if HasPermission .Permissions "invoices.write"}}
+*/
+func PermissionsFromContext(ctx context.Context) PermissionSet {
+	principal, ok := PrincipalFromContext(ctx)
+
+	if !ok {
+		return PermissionSet{}
+	}
+
+	return principal.Permissions
+}
+
+/*
+SyncPermissions creates or updates the provided permissions. Permissions
+that are no longer registered are left alone so existing grants aren't
+lost.
+*/
+func (s MemberService) SyncPermissions(permissions []Permission) error {
+	var (
+		err error
+		tx  *sql.Tx
+	)
+
+	if tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO permissions (
+			created_at,
+			name,
+			description
+		) VALUES (
+			$1,
+			$2,
+			$3
+		)
+		ON CONFLICT (name) DO UPDATE SET
+			updated_at = EXCLUDED.created_at,
+			description = EXCLUDED.description
+	`
+
+	now := time.Now().UTC()
+
+	for _, permission := range permissions {
+		if _, err = tx.Exec(query, now, permission.Name, permission.Description); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.clearPermissionCache()
+	return nil
+}
+
+/*
+GetPermissions returns every permission, ordered by name.
+*/
+func (s MemberService) GetPermissions() ([]Permission, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	result := []Permission{}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			updated_at,
+			name,
+			description
+		FROM permissions
+		ORDER BY name
+	`
+
+	if rows, err = s.db.Query(query); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		permission := Permission{}
+
+		if err = rows.Scan(&permission.ID, &permission.CreatedAt, &permission.UpdatedAt, &permission.Name, &permission.Description); err != nil {
+			return result, err
+		}
+
+		result = append(result, permission)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+GetRolePermissions returns the permissions granted to a role. The Admin
+role has every permission.
+*/
+func (s MemberService) GetRolePermissions(roleID uint) (PermissionSet, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	if s.permissionCache != nil {
+		if permissions, ok := s.permissionCache.get(roleID); ok {
+			return permissions, nil
+		}
+	}
+
+	result := PermissionSet{}
+
+	query := `
+		SELECT
+			p.name
+		FROM permissions AS p
+			INNER JOIN member_role_permissions AS mrp ON mrp.permission_id = p.id
+		WHERE mrp.role_id = $1
+	`
+
+	args := []interface{}{roleID}
+
+	if roleID == AdminMemberRoleID {
+		query = `SELECT name FROM permissions`
+		args = []interface{}{}
+	}
+
+	if rows, err = s.db.Query(query, args...); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			return result, err
+		}
+
+		result[name] = struct{}{}
+	}
+
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	if s.permissionCache != nil {
+		s.permissionCache.set(roleID, result)
+	}
+
+	return result, nil
+}
+
+/*
+SetRolePermissions replaces the permissions granted to a role with the
+named permissions. Unknown names are ignored.
+*/
+func (s MemberService) SetRolePermissions(roleID uint, names []string) error {
+	var (
+		err error
+		tx  *sql.Tx
+	)
+
+	if tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM member_role_permissions WHERE role_id = $1`, roleID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO member_role_permissions (
+			role_id,
+			permission_id,
+			created_at
+		)
+		SELECT $1, id, $2 FROM permissions WHERE name = $3
+		ON CONFLICT DO NOTHING
+	`
+
+	now := time.Now().UTC()
+
+	for _, name := range names {
+		if _, err = tx.Exec(query, roleID, now, name); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.clearPermissionCache()
+	return nil
+}
+
+func (s MemberService) clearPermissionCache() {
+	if s.permissionCache != nil {
+		s.permissionCache.clear()
+	}
+}
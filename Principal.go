@@ -0,0 +1,144 @@
+package frame
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+contextKey is the type of every value Frame puts in a request context. It
+is unexported so other packages can't collide with, or overwrite, them.
+*/
+type contextKey string
+
+const (
+	adminPrincipalContextKey contextKey = "adminPrincipal"
+	csrfTokenContextKey      contextKey = "csrfToken"
+	principalContextKey      contextKey = "principal"
+)
+
+/*
+AuthMethod describes how a request was authenticated.
+*/
+type AuthMethod string
+
+const (
+	AuthMethodAdminSession AuthMethod = "admin-session"
+	AuthMethodApiToken     AuthMethod = "api-token"
+	AuthMethodJwt          AuthMethod = "jwt"
+	AuthMethodRootUser     AuthMethod = "root-user"
+	AuthMethodSession      AuthMethod = "session"
+)
+
+/*
+Principal is who is making a request. The site auth middleware puts one in
+the request context for members, and the admin auth middleware puts one in
+for admins. Only what is stored in the session or token is available
+without a database query. Call LoadMember to get the full member.
+*/
+type Principal struct {
+	AuthMethod  AuthMethod
+	ApiTokenID  string
+	AvatarURL   string
+	Email       string
+	FirstName   string
+	LastName    string
+	MemberID    string
+	Permissions PermissionSet
+	Role        string
+	RoleID      uint
+	Status      MemberStatus
+
+	/*
+	 * ImpersonatorUserName is set when an admin is impersonating the member
+	 */
+	ImpersonatorUserName string
+
+	loadErr       error
+	loadOnce      *sync.Once
+	member        Member
+	memberService *MemberService
+}
+
+func newPrincipal(authMethod AuthMethod, memberService *MemberService) *Principal {
+	return &Principal{
+		AuthMethod:    authMethod,
+		Permissions:   PermissionSet{},
+		loadOnce:      &sync.Once{},
+		memberService: memberService,
+	}
+}
+
+/*
+Member returns a Member with the fields known from the session or token.
+*/
+func (p *Principal) Member() Member {
+	return Member{
+		ID:        p.MemberID,
+		AvatarURL: p.AvatarURL,
+		Email:     p.Email,
+		FirstName: p.FirstName,
+		LastName:  p.LastName,
+		Role: MemberRole{
+			ID:   p.RoleID,
+			Role: p.Role,
+		},
+		Status: MembersStatus{
+			Status: p.Status,
+		},
+	}
+}
+
+/*
+LoadMember retrieves the full member from the database. It is only queried
+once per request. The root admin user is not a member, so it has nothing
+to load.
+*/
+func (p *Principal) LoadMember() (Member, error) {
+	if p.MemberID == "" || p.memberService == nil || p.loadOnce == nil {
+		return Member{}, fmt.Errorf("principal is not a member that can be loaded")
+	}
+
+	p.loadOnce.Do(func() {
+		p.member, p.loadErr = p.memberService.GetMemberByID(p.MemberID, false)
+	})
+
+	return p.member, p.loadErr
+}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, principal)
+}
+
+/*
+PrincipalFromContext returns the member making a request. ok is false on
+routes that are excluded from auth and when nobody is logged in.
+*/
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey).(*Principal)
+	return principal, ok && principal != nil
+}
+
+/*
+MemberFromContext returns the member making a request, with the fields
+known from their session or token. ok is false when nobody is logged in.
+*/
+func MemberFromContext(ctx context.Context) (Member, bool) {
+	principal, ok := PrincipalFromContext(ctx)
+
+	if !ok {
+		return Member{}, false
+	}
+
+	return principal.Member(), true
+}
+
+/*
+AdminPrincipalFromContext returns the admin making a request to an /admin
+route. Admins logged in as the root user have no member ID.
+*/
+func AdminPrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(adminPrincipalContextKey).(*Principal)
+	return principal, ok && principal != nil
+}
@@ -0,0 +1,123 @@
+package frame
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+RequireRole returns middleware that only lets members with one of the
+provided roles through. On admin routes the admin's role is checked
+instead. Visitors who aren't logged in get the usual unauthorized response. Members without a matching role get a 403. If the
+path matches one of the site auth HtmlPaths the 403 is an HTML page,
+otherwise it is JSON. A route's declared AuthResponse takes precedence.
+
+	{Path: "/reports", Methods: []string{http.MethodGet}, HandlerFunc: handleReports, MiddlewareFunc: app.RequireRole("Admin", "Manager")}
+
+Roles can also be set on an Endpoint using RequiredRoles.
+*/
+func (fa *FrameApplication) RequireRole(roles ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if MemberHasRole(r, roles...) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			role, loggedIn := requestRole(r)
+
+			logger := fa.Logger.WithFields(logrus.Fields{
+				"ip":            RealIP(r),
+				"path":          r.URL.Path,
+				"role":          role,
+				"requiredRoles": roles,
+			})
+
+			if !loggedIn {
+				logger.Error("user is not authorized")
+
+				if fa.siteAuth != nil {
+					fa.siteAuth.sendUnauthorizedResponse(w, r)
+					return
+				}
+
+				sendJSONStatusResponse(w, http.StatusUnauthorized, "User unauthorized")
+				return
+			}
+
+			logger.Error("member does not have a required role")
+			fa.sendForbiddenResponse(w, r)
+		})
+	}
+}
+
+/*
+MemberHasRole returns true if the member making this request has one of
+the provided roles. On admin routes it checks the admin's role.
+*/
+func MemberHasRole(r *http.Request, roles ...string) bool {
+	role, _ := requestRole(r)
+
+	if role == "" {
+		return false
+	}
+
+	for _, requiredRole := range roles {
+		if role == requiredRole {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+requestRole returns the role of whoever is making this request. That is the
+admin on admin routes, and the logged in member everywhere else. It returns
+false if nobody is logged in.
+*/
+func requestRole(r *http.Request) (string, bool) {
+	if admin, ok := AdminPrincipalFromContext(r.Context()); ok {
+		return admin.Role, true
+	}
+
+	member, _ := MemberFromContext(r.Context())
+	return member.Role.Role, member.Email != ""
+}
+
+func (fa *FrameApplication) sendForbiddenResponse(w http.ResponseWriter, r *http.Request) {
+	if fa.siteAuth != nil && fa.webApp != nil && fa.routes.wantsHTML(r, fa.siteAuth.htmlPaths) {
+		data := struct {
+			Stylesheets []string
+		}{
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fa.webApp.RenderTemplate(w, "forbidden.tmpl", data)
+		return
+	}
+
+	sendJSONStatusResponse(w, http.StatusForbidden, "Forbidden")
+}
+
+func sendJSONStatusResponse(w http.ResponseWriter, status int, message string) {
+	result := map[string]interface{}{
+		"success": false,
+		"error":   message,
+		"status":  status,
+	}
+
+	b, _ := json.Marshal(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprint(w, string(b))
+}
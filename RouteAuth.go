@@ -0,0 +1,196 @@
+package frame
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+AuthLevel is who may call a route. Routes without one fall back to the
+site auth PathsExcludedFromAuth list.
+*/
+type AuthLevel string
+
+const (
+	AuthPublic AuthLevel = "public"
+	AuthMember AuthLevel = "member"
+	AuthAdmin  AuthLevel = "admin"
+)
+
+/*
+AuthResponse is what a visitor gets when they aren't allowed to call a
+route. HTML routes redirect to the login page. JSON routes get a 401.
+Routes without one fall back to the site auth HtmlPaths list.
+*/
+type AuthResponse string
+
+const (
+	AuthResponseHTML AuthResponse = "html"
+	AuthResponseJSON AuthResponse = "json"
+)
+
+type routeAuth struct {
+	level    AuthLevel
+	response AuthResponse
+}
+
+/*
+routeRegistry remembers the auth level declared for each route. Auth
+middleware looks up the route mux matched, so a route's level can't be
+picked up by another route that happens to share a prefix.
+*/
+type routeRegistry struct {
+	routes map[*mux.Route]routeAuth
+}
+
+func newRouteRegistry() *routeRegistry {
+	return &routeRegistry{
+		routes: map[*mux.Route]routeAuth{},
+	}
+}
+
+/*
+add declares the auth level of a route and returns the route.
+*/
+func (rr *routeRegistry) add(route *mux.Route, level AuthLevel, response AuthResponse) *mux.Route {
+	rr.routes[route] = routeAuth{
+		level:    level,
+		response: response,
+	}
+
+	return route
+}
+
+func (rr *routeRegistry) public(route *mux.Route) *mux.Route {
+	return rr.add(route, AuthPublic, "")
+}
+
+func (rr *routeRegistry) member(route *mux.Route, response AuthResponse) *mux.Route {
+	return rr.add(route, AuthMember, response)
+}
+
+func (rr *routeRegistry) admin(route *mux.Route, response AuthResponse) *mux.Route {
+	return rr.add(route, AuthAdmin, response)
+}
+
+func (rr *routeRegistry) hasLevel(level AuthLevel) bool {
+	for _, auth := range rr.routes {
+		if auth.level == level {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+lookup returns the auth declared for the route that matched this request.
+*/
+func (rr *routeRegistry) lookup(r *http.Request) (routeAuth, bool) {
+	if rr == nil {
+		return routeAuth{}, false
+	}
+
+	route := mux.CurrentRoute(r)
+
+	if route == nil {
+		return routeAuth{}, false
+	}
+
+	result, ok := rr.routes[route]
+	return result, ok
+}
+
+/*
+wantsHTML returns true when an unauthorized request should be redirected
+to a login page instead of getting JSON. A declared response wins.
+Otherwise the path is checked against htmlPaths.
+*/
+func (rr *routeRegistry) wantsHTML(r *http.Request, htmlPaths []string) bool {
+	if auth, ok := rr.lookup(r); ok && auth.response != "" {
+		return auth.response == AuthResponseHTML
+	}
+
+	return pathHasAnyPrefix(r.URL.Path, htmlPaths)
+}
+
+/*
+pathHasPrefix returns true when path is prefix, or is below it. Matching
+happens on whole path segments, so /static matches /static/app.js but not
+/static-reports. A prefix of / only matches /.
+*/
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return path == "/"
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func pathHasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if pathHasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+logRoutes logs every registered route along with who may call it. Routes
+without a declared level are logged with the level the site auth path
+lists give them.
+*/
+func (fa *FrameApplication) logRoutes() {
+	_ = fa.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+
+		path, err := route.GetPathTemplate()
+
+		if err != nil {
+			return nil
+		}
+
+		methods, _ := route.GetMethods()
+		auth, declared := fa.routes.routes[route]
+
+		if !declared {
+			auth = fa.undeclaredRouteAuth(path)
+		}
+
+		fa.Logger.WithFields(logrus.Fields{
+			"path":     path,
+			"methods":  methods,
+			"auth":     auth.level,
+			"response": auth.response,
+			"declared": declared,
+		}).Info("route")
+
+		return nil
+	})
+}
+
+/*
+undeclaredRouteAuth works out what the site auth path lists do with a
+route that has no declared level.
+*/
+func (fa *FrameApplication) undeclaredRouteAuth(path string) routeAuth {
+	if fa.siteAuth == nil || pathHasAnyPrefix(path, fa.siteAuth.pathsExcludedFromAuth) {
+		return routeAuth{level: AuthPublic}
+	}
+
+	result := routeAuth{level: AuthMember, response: AuthResponseJSON}
+
+	if pathHasAnyPrefix(path, fa.siteAuth.htmlPaths) {
+		result.response = AuthResponseHTML
+	}
+
+	return result
+}
@@ -1,14 +1,32 @@
 package frame
 
 const (
-	AdminLoginPath             string = "/admin/login"
-	MemberApiCurrentMember     string = "/api/member/current"
-	MemberApiLogOut            string = "/api/member/logout"
-	MemberSignUpPath           string = "/member/create-account"
-	MemberProfilePath          string = "/member/profile"
-	MemberProfileAvatarPath    string = "/member/profile/avatar"
-	UnexpectedErrorPath        string = "/errors/unexpected"
-	SiteAuthLoginPath          string = "/member/login"
-	SiteAuthLogoutPath         string = "/member/logout"
-	SiteAuthAccountPendingPath string = "/member/account-pending"
+	AdminLoginPath               string = "/admin/login"
+	ExternalAuthPath             string = "/auth/{provider}"
+	ExternalAuthCallbackPath     string = "/auth/{provider}/callback"
+	MemberApiCurrentMember       string = "/api/member/current"
+	MemberApiLogOut              string = "/api/member/logout"
+	MemberApiTokenPath           string = "/api/member/token"
+	MemberApiTokenRefreshPath    string = "/api/member/token/refresh"
+	MemberApiTokenLogoutPath     string = "/api/member/token/logout"
+	MemberSignUpPath             string = "/member/create-account"
+	MemberAcceptInvitationPath   string = "/member/accept-invitation"
+	MemberProfilePath            string = "/member/profile"
+	MemberProfileAvatarPath      string = "/member/profile/avatar"
+	MemberProfileTwoFactorPath   string = "/member/profile/two-factor"
+	MemberProfileApiTokensPath   string = "/member/profile/tokens"
+	MemberProfileDeletePath      string = "/member/profile/delete-account"
+	MemberProfileDataExportPath  string = "/member/profile/export"
+	MemberDataExportDownloadPath string = "/member/profile/export/download"
+	UnexpectedErrorPath          string = "/errors/unexpected"
+	SiteAuthLoginPath            string = "/member/login"
+	SiteAuthTwoFactorPath        string = "/member/login/two-factor"
+	SiteAuthMagicLinkPath        string = "/member/login/magic-link"
+	SiteAuthLogoutPath           string = "/member/logout"
+	SiteAuthAccountPendingPath   string = "/member/account-pending"
+	SiteAuthForgotPasswordPath   string = "/member/forgot-password"
+	SiteAuthResetPasswordPath    string = "/member/reset-password"
+	SiteAuthVerifyEmailPath      string = "/member/verify-email"
+	SiteAuthUnlockAccountPath    string = "/member/unlock-account"
+	SiteAuthEndImpersonationPath string = "/member/impersonation/end"
 )
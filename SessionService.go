@@ -0,0 +1,237 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+SessionServiceConfig configures the service used to store server-side
+sessions.
+*/
+type SessionServiceConfig struct {
+	DB *sql.DB
+}
+
+/*
+SessionService reads and writes sessions stored in the database. It backs
+DatabaseSessionStore, and lets admins see and revoke a member's sessions.
+*/
+type SessionService struct {
+	db *sql.DB
+}
+
+/*
+DatabaseSession is a single server-side session. Data holds the encoded
+session values.
+*/
+type DatabaseSession struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	SessionName string    `json:"sessionName"`
+	MemberID    string    `json:"memberID"`
+	IPAddress   string    `json:"ipAddress"`
+	UserAgent   string    `json:"userAgent"`
+	Data        []byte    `json:"-"`
+}
+
+func NewSessionService(config SessionServiceConfig) SessionService {
+	return SessionService{
+		db: config.DB,
+	}
+}
+
+/*
+GetSessionByToken retrieves an unexpired session by the token stored in
+the session cookie.
+*/
+func (s SessionService) GetSessionByToken(token string) (DatabaseSession, error) {
+	var (
+		err      error
+		memberID sql.NullString
+	)
+
+	result := DatabaseSession{}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			updated_at,
+			expires_at,
+			session_name,
+			member_id,
+			ip_address,
+			user_agent,
+			data
+		FROM sessions
+		WHERE 1=1
+			AND token_hash = $1
+			AND expires_at > $2
+	`
+
+	err = s.db.QueryRow(query, hashToken(token), time.Now().UTC()).Scan(
+		&result.ID,
+		&result.CreatedAt,
+		&result.UpdatedAt,
+		&result.ExpiresAt,
+		&result.SessionName,
+		&memberID,
+		&result.IPAddress,
+		&result.UserAgent,
+		&result.Data,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, fmt.Errorf("session not found: %w", err)
+	}
+
+	result.MemberID = memberID.String
+	return result, err
+}
+
+/*
+SaveSession creates or updates the session for a token.
+*/
+func (s SessionService) SaveSession(token string, session DatabaseSession) error {
+	now := time.Now().UTC()
+
+	query := `
+		INSERT INTO sessions (
+			created_at,
+			updated_at,
+			expires_at,
+			session_name,
+			token_hash,
+			member_id,
+			ip_address,
+			user_agent,
+			data
+		) VALUES (
+			$1,
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8
+		)
+		ON CONFLICT (token_hash) DO UPDATE SET
+			updated_at = EXCLUDED.updated_at,
+			expires_at = EXCLUDED.expires_at,
+			member_id = EXCLUDED.member_id,
+			ip_address = EXCLUDED.ip_address,
+			user_agent = EXCLUDED.user_agent,
+			data = EXCLUDED.data
+	`
+
+	memberID := sql.NullString{String: session.MemberID, Valid: session.MemberID != ""}
+
+	_, err := s.db.Exec(
+		query,
+		now,
+		session.ExpiresAt.UTC(),
+		session.SessionName,
+		hashToken(token),
+		memberID,
+		session.IPAddress,
+		session.UserAgent,
+		session.Data,
+	)
+
+	return err
+}
+
+/*
+DeleteSessionByToken removes the session for a token. This is used when a
+session is logged out.
+*/
+func (s SessionService) DeleteSessionByToken(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token_hash = $1`, hashToken(token))
+	return err
+}
+
+/*
+GetMemberSessions returns all unexpired sessions for a member, most
+recently used first.
+*/
+func (s SessionService) GetMemberSessions(memberID string) ([]DatabaseSession, error) {
+	var (
+		err  error
+		rows *sql.Rows
+	)
+
+	result := []DatabaseSession{}
+
+	query := `
+		SELECT
+			id,
+			created_at,
+			updated_at,
+			expires_at,
+			session_name,
+			ip_address,
+			user_agent
+		FROM sessions
+		WHERE 1=1
+			AND member_id = $1
+			AND expires_at > $2
+		ORDER BY updated_at DESC
+	`
+
+	if rows, err = s.db.Query(query, memberID, time.Now().UTC()); err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		session := DatabaseSession{MemberID: memberID}
+
+		if err = rows.Scan(&session.ID, &session.CreatedAt, &session.UpdatedAt, &session.ExpiresAt, &session.SessionName, &session.IPAddress, &session.UserAgent); err != nil {
+			return result, err
+		}
+
+		result = append(result, session)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+RevokeMemberSession deletes a single session belonging to a member. The
+next request using that session is treated as logged out.
+*/
+func (s SessionService) RevokeMemberSession(memberID, sessionID string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = $1 AND member_id = $2`, sessionID, memberID)
+	return err
+}
+
+/*
+RevokeMemberSessions deletes every session belonging to a member, logging
+them out on all devices.
+*/
+func (s SessionService) RevokeMemberSessions(memberID string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE member_id = $1`, memberID)
+	return err
+}
+
+/*
+DeleteExpiredSessions removes sessions that have expired. It returns the
+number of sessions removed.
+*/
+func (s SessionService) DeleteExpiredSessions() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= $1`, time.Now().UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
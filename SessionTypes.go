@@ -3,5 +3,6 @@ package frame
 type FrameSessionType string
 
 const (
-	CookieSessionType FrameSessionType = "cookies"
+	CookieSessionType   FrameSessionType = "cookies"
+	DatabaseSessionType FrameSessionType = "database"
 )
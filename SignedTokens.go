@@ -0,0 +1,79 @@
+package frame
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ErrInvalidSignedToken is returned when a signed token is malformed, has
+been tampered with, was signed for a different purpose, or has expired.
+*/
+var ErrInvalidSignedToken = errors.New("invalid or expired signed token")
+
+/*
+signToken creates a stateless token that carries a subject, such as a
+member ID, and an expiration. The token is signed with an HMAC-SHA256 of
+the payload using key. The purpose is part of the signature so a token
+issued for one flow cannot be replayed against another.
+*/
+func signToken(key, purpose, subject string, expiresAt time.Time) string {
+	payload := subject + "|" + strconv.FormatInt(expiresAt.Unix(), 10)
+	encodedPayload := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encodedPayload + "." + signTokenPayload(key, purpose, encodedPayload)
+}
+
+/*
+verifySignedToken checks the signature and expiration of a token created
+with signToken() and returns its subject.
+*/
+func verifySignedToken(key, purpose, token string) (string, error) {
+	var (
+		err       error
+		payload   []byte
+		expiresAt int64
+	)
+
+	encodedPayload, signature, found := strings.Cut(token, ".")
+
+	if !found {
+		return "", ErrInvalidSignedToken
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signTokenPayload(key, purpose, encodedPayload))) {
+		return "", ErrInvalidSignedToken
+	}
+
+	if payload, err = base64.RawURLEncoding.DecodeString(encodedPayload); err != nil {
+		return "", ErrInvalidSignedToken
+	}
+
+	separator := strings.LastIndex(string(payload), "|")
+
+	if separator < 0 {
+		return "", ErrInvalidSignedToken
+	}
+
+	if expiresAt, err = strconv.ParseInt(string(payload[separator+1:]), 10, 64); err != nil {
+		return "", ErrInvalidSignedToken
+	}
+
+	if time.Now().Unix() > expiresAt {
+		return "", ErrInvalidSignedToken
+	}
+
+	return string(payload[:separator]), nil
+}
+
+func signTokenPayload(key, purpose, encodedPayload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose + "." + encodedPayload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -2,11 +2,15 @@ package frame
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -14,21 +18,59 @@ import (
 )
 
 type InternalSiteAuthConfig struct {
-	FrameStaticFS fs.FS
-	Logger        *logrus.Entry
-	SessionName   string
-	SessionStore  sessions.Store
+	AuditLogger         *AuditLogger
+	EmailService        *EmailServicer
+	FrameConfig         *Config
+	FrameStaticFS       fs.FS
+	Logger              *logrus.Entry
+	LoginAttemptService *LoginAttemptService
+	Routes              *routeRegistry
+	SessionName         string
+	SessionStore        sessions.Store
 }
 
 type SiteAuth struct {
-	contentTemplateName   string
-	frameStaticFS         fs.FS
-	htmlPaths             []string
-	layoutName            string
-	logger                *logrus.Entry
-	pathsExcludedFromAuth []string
-	sessionName           string
-	sessionStore          sessions.Store
+	accountDeletionGracePeriod       time.Duration
+	approvalPolicy                   ApprovalPolicy
+	auditLogger                      *AuditLogger
+	contentTemplateName              string
+	dataExportEmailTemplateID        string
+	dataExportTTL                    time.Duration
+	accountUnlockEmailTemplateID     string
+	emailLock                        *sync.Mutex
+	emailService                     *EmailServicer
+	emailVerificationEmailTemplateID string
+	emailVerificationTokenTTL        time.Duration
+	externalAuthProviders            []string
+	frameConfig                      *Config
+	frameStaticFS                    fs.FS
+	htmlPaths                        []string
+	impersonationTTL                 time.Duration
+	invitationEmailTemplateID        string
+	invitationTTL                    time.Duration
+	inviteOnly                       bool
+	jwtAccessTokenTTL                time.Duration
+	jwtAuthEnabled                   bool
+	jwtRefreshTokenTTL               time.Duration
+	layoutName                       string
+	logger                           *logrus.Entry
+	loginAttemptService              *LoginAttemptService
+	loginMethod                      LoginMethod
+	magicLinkEmailTemplateID         string
+	magicLinkTokenTTL                time.Duration
+	onAnonymizeMember                func(tx *sql.Tx, member Member) error
+	memberApprovedEmailTemplateID    string
+	passwordPolicy                   PasswordPolicy
+	passwordResetEmailTemplateID     string
+	passwordResetTokenTTL            time.Duration
+	pendingApprovalEmailTemplateID   string
+	pendingApprovalNotifyRoleID      uint
+	pathsExcludedFromAuth            []string
+	requireVerifiedEmail             bool
+	routes                           *routeRegistry
+	sessionName                      string
+	sessionStore                     sessions.Store
+	verifyEmailAddresses             bool
 }
 
 /*
@@ -36,11 +78,26 @@ NewSiteAuth sets up authentication for the public site. This authentication make
 mechanism. It registers the following endpoints, each with baked in HTML:
 
 - /member/login
+- /member/login/two-factor
 - /member/account-pending
 - /member/create-account
+- /member/forgot-password
+- /member/reset-password
+- /member/verify-email
+- /member/unlock-account
 - /api/member/current
 - /api/member/logout
 
+If LoginMethod allows magic links this page is registered as well:
+
+- /member/login/magic-link
+
+If EnableJwtAuth is set these JSON endpoints are registered as well:
+
+- /api/member/token
+- /api/member/token/refresh
+- /api/member/token/logout
+
 All pages in SiteAuth have a few expectations.
 
 1. They define a content area called "Title". This is so layouts can use "Title" to set the page title
@@ -49,25 +106,126 @@ All pages in SiteAuth have a few expectations.
 */
 func NewSiteAuth(internalConfig InternalSiteAuthConfig, siteAuthConfig SiteAuthConfig) *SiteAuth {
 	result := &SiteAuth{
-		contentTemplateName:   siteAuthConfig.ContentTemplateName,
-		frameStaticFS:         internalConfig.FrameStaticFS,
-		htmlPaths:             siteAuthConfig.HtmlPaths,
-		layoutName:            siteAuthConfig.LayoutName,
-		logger:                internalConfig.Logger,
-		pathsExcludedFromAuth: siteAuthConfig.PathsExcludedFromAuth,
-		sessionName:           internalConfig.SessionName,
-		sessionStore:          internalConfig.SessionStore,
+		accountDeletionGracePeriod:       siteAuthConfig.AccountDeletionGracePeriod,
+		dataExportEmailTemplateID:        siteAuthConfig.DataExportEmailTemplateID,
+		dataExportTTL:                    siteAuthConfig.DataExportTTL,
+		approvalPolicy:                   siteAuthConfig.ApprovalPolicy,
+		auditLogger:                      internalConfig.AuditLogger,
+		accountUnlockEmailTemplateID:     siteAuthConfig.AccountUnlockEmailTemplateID,
+		contentTemplateName:              siteAuthConfig.ContentTemplateName,
+		emailLock:                        &sync.Mutex{},
+		emailService:                     internalConfig.EmailService,
+		emailVerificationEmailTemplateID: siteAuthConfig.EmailVerificationEmailTemplateID,
+		emailVerificationTokenTTL:        siteAuthConfig.EmailVerificationTokenTTL,
+		frameConfig:                      internalConfig.FrameConfig,
+		frameStaticFS:                    internalConfig.FrameStaticFS,
+		htmlPaths:                        siteAuthConfig.HtmlPaths,
+		impersonationTTL:                 siteAuthConfig.ImpersonationTTL,
+		invitationEmailTemplateID:        siteAuthConfig.InvitationEmailTemplateID,
+		invitationTTL:                    siteAuthConfig.InvitationTTL,
+		inviteOnly:                       siteAuthConfig.InviteOnly,
+		jwtAccessTokenTTL:                siteAuthConfig.JwtAccessTokenTTL,
+		jwtAuthEnabled:                   siteAuthConfig.EnableJwtAuth,
+		jwtRefreshTokenTTL:               siteAuthConfig.JwtRefreshTokenTTL,
+		layoutName:                       siteAuthConfig.LayoutName,
+		logger:                           internalConfig.Logger,
+		loginAttemptService:              internalConfig.LoginAttemptService,
+		loginMethod:                      siteAuthConfig.LoginMethod,
+		magicLinkEmailTemplateID:         siteAuthConfig.MagicLinkEmailTemplateID,
+		memberApprovedEmailTemplateID:    siteAuthConfig.MemberApprovedEmailTemplateID,
+		onAnonymizeMember:                siteAuthConfig.OnAnonymizeMember,
+		magicLinkTokenTTL:                siteAuthConfig.MagicLinkTokenTTL,
+		passwordResetEmailTemplateID:     siteAuthConfig.PasswordResetEmailTemplateID,
+		pendingApprovalEmailTemplateID:   siteAuthConfig.PendingApprovalEmailTemplateID,
+		pendingApprovalNotifyRoleID:      siteAuthConfig.PendingApprovalNotifyRoleID,
+		passwordResetTokenTTL:            siteAuthConfig.PasswordResetTokenTTL,
+		pathsExcludedFromAuth:            siteAuthConfig.PathsExcludedFromAuth,
+		requireVerifiedEmail:             siteAuthConfig.RequireVerifiedEmail,
+		routes:                           internalConfig.Routes,
+		sessionName:                      internalConfig.SessionName,
+		sessionStore:                     internalConfig.SessionStore,
+		verifyEmailAddresses:             siteAuthConfig.VerifyEmailAddresses || siteAuthConfig.RequireVerifiedEmail,
 	}
 
-	/*
-	 * Make sure specific paths are excluded from auth
-	 */
+	if result.impersonationTTL <= 0 {
+		result.impersonationTTL = time.Hour
+	}
+
+	if result.passwordResetTokenTTL <= 0 {
+		result.passwordResetTokenTTL = time.Hour
+	}
+
+	if result.emailVerificationTokenTTL <= 0 {
+		result.emailVerificationTokenTTL = time.Hour * 48
+	}
+
+	if result.approvalPolicy == nil {
+		result.approvalPolicy = ManualApprovalPolicy()
+	}
+
+	if result.accountDeletionGracePeriod <= 0 {
+		result.accountDeletionGracePeriod = time.Hour * 24 * 30
+	}
+
+	if siteAuthConfig.PasswordPolicy != nil {
+		result.passwordPolicy = *siteAuthConfig.PasswordPolicy
+	} else {
+		result.passwordPolicy = DefaultPasswordPolicy()
+	}
+
+	if result.passwordPolicy.DisallowCommon {
+		if result.frameConfig.PasswordListFile == "" {
+			result.logger.Fatalf("the password policy rejects common passwords, which requires PASSWORD_LIST_FILE. set DisallowCommon to false to turn this off")
+		}
+
+		if err := result.passwordPolicy.loadCommonPasswords(result.frameConfig.PasswordListFile); err != nil {
+			result.logger.WithError(err).Fatalf("error loading PASSWORD_LIST_FILE")
+		}
+	}
+
+	if result.dataExportTTL <= 0 {
+		result.dataExportTTL = time.Hour * 24 * 7
+	}
+
+	if result.pendingApprovalNotifyRoleID == 0 {
+		result.pendingApprovalNotifyRoleID = AdminMemberRoleID
+	}
+
+	if result.invitationTTL <= 0 {
+		result.invitationTTL = time.Hour * 24 * 7
+	}
+
+	if result.inviteOnly && result.invitationEmailTemplateID == "" {
+		result.logger.Fatalf("invite only sites require InvitationEmailTemplateID")
+	}
+
+	if result.loginMethod == "" {
+		result.loginMethod = LoginMethodPassword
+	}
+
+	if result.magicLinkTokenTTL <= 0 {
+		result.magicLinkTokenTTL = time.Minute * 15
+	}
 
-	result.pathsExcludedFromAuth = append(result.pathsExcludedFromAuth, "/static", "/admin-static", "/frame-static", SiteAuthAccountPendingPath, SiteAuthLoginPath,
-		SiteAuthLogoutPath, MemberSignUpPath, UnexpectedErrorPath, "/admin")
+	if result.magicLinkEnabled() && result.magicLinkEmailTemplateID == "" {
+		result.logger.Fatalf("magic link login requires MagicLinkEmailTemplateID")
+	}
 
-	// These paths need to redirect to an HTML error or login page when the user is not authorized
-	result.htmlPaths = append(result.htmlPaths, "/member/profile", "/member/profile/avatar")
+	if result.jwtAccessTokenTTL <= 0 {
+		result.jwtAccessTokenTTL = time.Minute * 15
+	}
+
+	if result.jwtRefreshTokenTTL <= 0 {
+		result.jwtRefreshTokenTTL = time.Hour * 24 * 30
+	}
+
+	if result.jwtAuthEnabled && len(result.frameConfig.JwtSigningKey) < 32 {
+		result.logger.Fatalf("JWT auth requires JWT_SIGNING_KEY to be at least 32 characters")
+	}
+
+	if len(result.frameConfig.TokenSigningKey) < 32 {
+		result.logger.Fatalf("site auth requires TOKEN_SIGNING_KEY to be at least 32 characters")
+	}
 
 	return result
 }
@@ -75,17 +233,34 @@ func NewSiteAuth(internalConfig InternalSiteAuthConfig, siteAuthConfig SiteAuthC
 func (sa *SiteAuth) RegisterStaticFrameAssetsRoute(router *mux.Router) {
 	sa.logger.Info("registering static frame assets...")
 	frameStaticFS := http.FileServer(http.FS(sa.frameStaticFS))
-	router.PathPrefix("/frame-static/").Handler(frameStaticFS).Methods(http.MethodGet)
+	sa.routes.public(router.PathPrefix("/frame-static/").Handler(frameStaticFS).Methods(http.MethodGet))
 }
 
 func (sa *SiteAuth) RegisterSiteAuthRoutes(router *mux.Router, webApp *WebApp, memberService *MemberService) {
-	router.HandleFunc(SiteAuthLoginPath, sa.handleSiteAuthLogin(webApp, memberService)).Methods(http.MethodGet, http.MethodPost)
-	router.HandleFunc(SiteAuthAccountPendingPath, sa.handleAccountPending(webApp)).Methods(http.MethodGet)
+	sa.routes.public(router.HandleFunc(SiteAuthLoginPath, sa.handleSiteAuthLogin(webApp, memberService)).Methods(http.MethodGet, http.MethodPost))
+	sa.routes.public(router.HandleFunc(SiteAuthTwoFactorPath, sa.handleTwoFactorLogin(webApp, memberService)).Methods(http.MethodGet, http.MethodPost))
 
-	sa.setupMiddleware(router)
+	if sa.magicLinkEnabled() {
+		sa.routes.public(router.HandleFunc(SiteAuthMagicLinkPath, sa.handleMagicLinkLogin(webApp, memberService)).Methods(http.MethodGet, http.MethodPost))
+	}
+
+	sa.routes.public(router.HandleFunc(SiteAuthAccountPendingPath, sa.handleAccountPending(webApp)).Methods(http.MethodGet))
+	sa.routes.public(router.HandleFunc(SiteAuthForgotPasswordPath, sa.handleForgotPassword(webApp, memberService)).Methods(http.MethodGet, http.MethodPost))
+	sa.routes.public(router.HandleFunc(SiteAuthResetPasswordPath, sa.handleResetPassword(webApp, memberService)).Methods(http.MethodGet, http.MethodPost))
+	sa.routes.public(router.HandleFunc(SiteAuthVerifyEmailPath, sa.handleVerifyEmail(webApp, memberService)).Methods(http.MethodGet))
+	sa.routes.public(router.HandleFunc(SiteAuthUnlockAccountPath, sa.handleUnlockAccount(webApp, memberService)).Methods(http.MethodGet))
+	sa.routes.public(router.HandleFunc(SiteAuthEndImpersonationPath, sa.handleEndImpersonation).Methods(http.MethodPost))
+
+	if sa.jwtAuthEnabled {
+		sa.routes.public(router.HandleFunc(MemberApiTokenRefreshPath, sa.handleJwtRefresh(memberService)).Methods(http.MethodPost))
+		sa.routes.public(router.HandleFunc(MemberApiTokenLogoutPath, sa.handleJwtLogout(memberService)).Methods(http.MethodPost))
+		sa.routes.public(router.HandleFunc(MemberApiTokenPath, sa.handleJwtLogin(memberService)).Methods(http.MethodPost))
+	}
+
+	sa.setupMiddleware(router, memberService)
 }
 
-func (sa *SiteAuth) setupMiddleware(router *mux.Router) {
+func (sa *SiteAuth) setupMiddleware(router *mux.Router, memberService *MemberService) {
 	middleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var (
@@ -97,18 +272,50 @@ func (sa *SiteAuth) setupMiddleware(router *mux.Router) {
 			)
 
 			/*
-			 * If this path is excluded from auth, just keep going
+			 * Routes that declare an auth level only need a member when
+			 * they say so. Admin routes are checked by the admin
+			 * middleware. Anything else falls back to the excluded paths.
 			 */
-			for _, excludedPath := range sa.pathsExcludedFromAuth {
-				if excludedPath == "/" && r.URL.Path == "/" {
+			if auth, declared := sa.routes.lookup(r); declared {
+				if auth.level != AuthMember {
 					next.ServeHTTP(w, r)
 					return
 				}
+			} else if pathHasAnyPrefix(r.URL.Path, sa.pathsExcludedFromAuth) {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-				if strings.HasPrefix(r.URL.Path, excludedPath) && excludedPath != "/" {
-					next.ServeHTTP(w, r)
+			/*
+			 * Requests from scripts and other tools authenticate with a
+			 * personal API token instead of a cookie. SPA and mobile clients
+			 * send a JWT access token.
+			 */
+			if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+				var ctx context.Context
+
+				bearerToken := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+
+				if strings.HasPrefix(bearerToken, MemberApiTokenPrefix) {
+					ctx, err = sa.authenticateApiToken(r, memberService, bearerToken)
+				} else if sa.jwtAuthEnabled {
+					ctx, err = sa.authenticateJwt(r, memberService, bearerToken)
+				} else {
+					err = fmt.Errorf("unrecognized bearer token")
+				}
+
+				if err != nil {
+					sa.logger.WithError(err).WithFields(logrus.Fields{
+						"ip":   RealIP(r),
+						"path": r.URL.Path,
+					}).Error("bearer token is not authorized")
+
+					sendJSONStatusResponse(w, http.StatusUnauthorized, "User unauthorized")
 					return
 				}
+
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
 			}
 
 			/*
@@ -128,7 +335,7 @@ func (sa *SiteAuth) setupMiddleware(router *mux.Router) {
 					"path": r.URL.Path,
 				}).Error("user is not authorized")
 
-				sa.sendUnauthorizedResponse(w, r, sa.htmlPaths)
+				sa.sendUnauthorizedResponse(w, r)
 				return
 			}
 
@@ -138,10 +345,42 @@ func (sa *SiteAuth) setupMiddleware(router *mux.Router) {
 					"path": r.URL.Path,
 				}).Error("user is not authorized")
 
-				sa.sendUnauthorizedResponse(w, r, sa.htmlPaths)
+				sa.sendUnauthorizedResponse(w, r)
+				return
+			}
+
+			/*
+			 * Pick up changes made to the member since they logged in
+			 */
+			if ok, err = sa.syncMemberSession(w, r, session, memberService); err != nil {
+				sa.logger.WithError(err).Error("error checking member session epoch")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			if !ok {
+				sa.sendUnauthorizedResponse(w, r)
 				return
 			}
 
+			/*
+			 * Impersonation sessions end after a while, even if the admin
+			 * never ends them
+			 */
+			if sa.impersonationExpired(session) {
+				sa.endImpersonation(r, session)
+				session.Options.MaxAge = -1
+
+				if err = sa.sessionStore.Save(r, w, session); err != nil {
+					sa.logger.WithError(err).Error("error deleting expired impersonation session")
+				}
+
+				sa.sendUnauthorizedResponse(w, r)
+				return
+			}
+
+			email, _ = session.Values["email"].(string)
+
 			status, ok := session.Values["status"].(string)
 			if !ok {
 				status = ""
@@ -177,28 +416,179 @@ func (sa *SiteAuth) setupMiddleware(router *mux.Router) {
 				avatarURL = ""
 			}
 
-			ctx := context.WithValue(r.Context(), "firstName", firstName)
-			ctx = context.WithValue(ctx, "lastName", lastName)
-			ctx = context.WithValue(ctx, "email", email)
-			ctx = context.WithValue(ctx, "avatarURL", avatarURL)
-			ctx = context.WithValue(ctx, "memberID", memberID)
-			ctx = context.WithValue(ctx, "status", status)
+			role, ok := session.Values["role"].(string)
+			if !ok {
+				role = ""
+			}
+
+			roleID, ok := session.Values["roleID"].(uint)
+			if !ok {
+				roleID = 0
+			}
+
+			permissions, err := memberService.GetRolePermissions(roleID)
 
-			next.ServeHTTP(w, r.WithContext(ctx))
+			if err != nil {
+				sa.logger.WithError(err).Error("error getting member permissions")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			principal := newPrincipal(AuthMethodSession, memberService)
+			principal.AvatarURL = avatarURL
+			principal.Email = email
+			principal.FirstName = firstName
+			principal.LastName = lastName
+			principal.MemberID = memberID
+			principal.Permissions = permissions
+			principal.Role = role
+			principal.RoleID = roleID
+			principal.Status = MemberStatus(status)
+			principal.ImpersonatorUserName, _ = session.Values["impersonatorUserName"].(string)
+
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
 		})
 	}
 
 	router.Use(middleware)
 }
 
-func (sa *SiteAuth) sendUnauthorizedResponse(w http.ResponseWriter, r *http.Request, htmlResponsePaths []string) {
-	for _, path := range htmlResponsePaths {
-		if strings.HasPrefix(r.URL.Path, path) {
-			http.Redirect(w, r, fmt.Sprintf("%s?referer=%s", SiteAuthLoginPath, r.URL.Path), http.StatusFound)
-			return
+/*
+writeMemberSession stores a member's information in their session. This is
+what marks a visitor as logged in.
+*/
+func (sa *SiteAuth) writeMemberSession(w http.ResponseWriter, r *http.Request, member Member) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+		return fmt.Errorf("error getting session: %w", err)
+	}
+
+	if store, ok := sa.sessionStore.(*DatabaseSessionStore); ok {
+		if err = store.renewSessionID(session); err != nil {
+			return fmt.Errorf("error renewing session: %w", err)
+		}
+	}
+
+	setMemberSessionValues(session, member)
+	session.Values["authenticatedAt"] = time.Now().Unix()
+
+	if _, err = renewCSRFToken(session); err != nil {
+		return fmt.Errorf("error renewing csrf token: %w", err)
+	}
+
+	return sa.sessionStore.Save(r, w, session)
+}
+
+/*
+refreshMemberSession copies a member's current information into the
+session of the request, if that session belongs to them. Call it after a
+member edits their own profile so the change shows up right away.
+*/
+func (sa *SiteAuth) refreshMemberSession(w http.ResponseWriter, r *http.Request, memberService *MemberService, memberID string) error {
+	var (
+		err     error
+		member  Member
+		session *sessions.Session
+	)
+
+	if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+		return fmt.Errorf("error getting session: %w", err)
+	}
+
+	if sessionMemberID, _ := session.Values["memberID"].(string); sessionMemberID != memberID {
+		return nil
+	}
+
+	if member, err = memberService.GetMemberByID(memberID, false); err != nil {
+		return fmt.Errorf("error getting member: %w", err)
+	}
+
+	setMemberSessionValues(session, member)
+	return sa.sessionStore.Save(r, w, session)
+}
+
+/*
+syncMemberSession compares the session epoch stored at login with the
+member's current epoch. The epoch changes whenever the member is updated,
+activated, inactivated, or deleted. When it has changed the session is
+reloaded from the database, or ended if the member may no longer log in.
+It returns false if the session was ended.
+*/
+func (sa *SiteAuth) syncMemberSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, memberService *MemberService) (bool, error) {
+	var (
+		err          error
+		currentEpoch int
+		member       Member
+	)
+
+	memberID, _ := session.Values["memberID"].(string)
+	sessionEpoch, _ := session.Values["sessionEpoch"].(int)
+
+	if memberID == "" {
+		return true, nil
+	}
+
+	currentEpoch, err = memberService.GetMemberSessionEpoch(memberID)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return true, err
+	}
+
+	if err == nil && currentEpoch == sessionEpoch {
+		return true, nil
+	}
+
+	if err == nil {
+		member, err = memberService.GetMemberByID(memberID, false)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return true, err
 		}
 	}
 
+	logger := sa.logger.WithFields(logrus.Fields{
+		"ip":       RealIP(r),
+		"memberID": memberID,
+	})
+
+	/*
+	 * Deleted and inactive members are logged out
+	 */
+	if err != nil || member.Status.ID == MemberInactiveID {
+		logger.Info("member can no longer log in. ending their session")
+
+		session.Options.MaxAge = -1
+		return false, sa.sessionStore.Save(r, w, session)
+	}
+
+	logger.Debug("member changed. reloading their session")
+
+	setMemberSessionValues(session, member)
+	return true, sa.sessionStore.Save(r, w, session)
+}
+
+func setMemberSessionValues(session *sessions.Session, member Member) {
+	session.Values["memberID"] = member.ID
+	session.Values["email"] = member.Email
+	session.Values["firstName"] = member.FirstName
+	session.Values["lastName"] = member.LastName
+	session.Values["avatarURL"] = member.AvatarURL
+	session.Values["status"] = string(member.Status.Status)
+	session.Values["role"] = member.Role.Role
+	session.Values["roleID"] = member.Role.ID
+	session.Values["sessionEpoch"] = member.SessionEpoch
+}
+
+func (sa *SiteAuth) sendUnauthorizedResponse(w http.ResponseWriter, r *http.Request) {
+	if sa.routes.wantsHTML(r, sa.htmlPaths) {
+		http.Redirect(w, r, fmt.Sprintf("%s?referer=%s", SiteAuthLoginPath, r.URL.Path), http.StatusFound)
+		return
+	}
+
 	result := map[string]interface{}{
 		"success": false,
 		"error":   "User unauthorized",
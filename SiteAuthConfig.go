@@ -1,8 +1,151 @@
 package frame
 
+import (
+	"database/sql"
+	"time"
+)
+
+/*
+LoginMethod is how members log in on /member/login.
+*/
+type LoginMethod string
+
+const (
+	LoginMethodPassword            LoginMethod = "password"
+	LoginMethodMagicLink           LoginMethod = "magic-link"
+	LoginMethodPasswordOrMagicLink LoginMethod = "password-or-magic-link"
+)
+
 type SiteAuthConfig struct {
-	ContentTemplateName   string
+	ContentTemplateName string
+	LayoutName          string
+
+	/*
+	 * Path lists. These only apply to routes that don't declare an Auth
+	 * level on their Endpoint. Routes below a path in PathsExcludedFromAuth
+	 * are public; everything else needs a logged in member. Unauthorized
+	 * requests below a path in HtmlPaths are redirected to the login page
+	 * instead of getting a JSON 401. Paths match whole segments, so
+	 * "/static" doesn't match "/static-reports".
+	 */
 	HtmlPaths             []string
-	LayoutName            string
 	PathsExcludedFromAuth []string
+
+	/*
+	 * Approval. Decides whether new members are active right away or wait
+	 * for an admin. Defaults to ManualApprovalPolicy. See AutoApprovePolicy,
+	 * AutoApproveDomainsPolicy, VerifiedEmailApprovalPolicy, and
+	 * ApprovalPolicyFunc.
+	 */
+	ApprovalPolicy ApprovalPolicy
+
+	/*
+	 * Approval notifications. When a new member is left waiting for
+	 * approval, active members with the PendingApprovalNotifyRoleID role
+	 * (Admin by default) are sent PendingApprovalEmailTemplateID. Its
+	 * template receives "memberEmail", "memberFirstName", "memberLastName",
+	 * and "reviewLink". Members are sent MemberApprovedEmailTemplateID when
+	 * they are approved; its template receives "loginLink". Leave a
+	 * template ID empty to skip that email. These are sent in the
+	 * background, and failures are only logged.
+	 */
+	MemberApprovedEmailTemplateID  string
+	PendingApprovalEmailTemplateID string
+	PendingApprovalNotifyRoleID    uint
+
+	/*
+	 * Account deletion. Members can delete their own account from
+	 * /member/profile/delete-account. Deleted members are anonymized once
+	 * AccountDeletionGracePeriod has passed, which defaults to 30 days.
+	 * OnAnonymizeMember lets the app scrub its own tables. It runs in the
+	 * same transaction, before the member's email and name are replaced,
+	 * and returning an error rolls the whole thing back.
+	 */
+	AccountDeletionGracePeriod time.Duration
+	OnAnonymizeMember          func(tx *sql.Tx, member Member) error
+
+	/*
+	 * Data export. Setting DataExportEmailTemplateID lets members download
+	 * a copy of their data from /member/profile/export. Exports are built in
+	 * the background and the member is emailed when theirs is ready. The
+	 * template receives "downloadLink" and "expiresAt". Exports can be
+	 * downloaded for DataExportTTL, which defaults to 7 days. Add your own
+	 * data with AddMemberDataExporter().
+	 */
+	DataExportEmailTemplateID string
+	DataExportTTL             time.Duration
+
+	/*
+	 * Impersonation. Admins can impersonate active members from the admin
+	 * section. Impersonation sessions end after ImpersonationTTL, which
+	 * defaults to one hour.
+	 */
+	ImpersonationTTL time.Duration
+
+	/*
+	 * Passwords. The rules new passwords must follow. Leave it nil for
+	 * DefaultPasswordPolicy().
+	 */
+	PasswordPolicy *PasswordPolicy
+
+	/*
+	 * Invitations. Admins invite people from /admin/members/invite. The
+	 * template receives "invitationLink", "invitedBy", and "roleName". The
+	 * invitation TTL defaults to 7 days. When InviteOnly is true the public
+	 * /member/create-account page is turned off, and external logins can't
+	 * create new members.
+	 */
+	InvitationEmailTemplateID string
+	InvitationTTL             time.Duration
+	InviteOnly                bool
+
+	/*
+	 * Login method. Members log in with a password by default. With
+	 * LoginMethodMagicLink they enter only their email address and are sent a
+	 * single-use link that logs them in. LoginMethodPasswordOrMagicLink lets
+	 * them choose. The template receives "firstName", "lastName", and
+	 * "loginLink". The link TTL defaults to 15 minutes.
+	 */
+	LoginMethod              LoginMethod
+	MagicLinkEmailTemplateID string
+	MagicLinkTokenTTL        time.Duration
+
+	/*
+	 * Password reset. The template ID is a SendGrid dynamic template. It
+	 * receives "firstName", "lastName", and "resetLink". The token TTL
+	 * defaults to one hour.
+	 */
+	PasswordResetEmailTemplateID string
+	PasswordResetTokenTTL        time.Duration
+
+	/*
+	 * Email verification. When VerifyEmailAddresses is true new members are
+	 * sent a signed link to confirm they own their email address. The template
+	 * receives "firstName", "lastName", and "verificationLink". Setting
+	 * RequireVerifiedEmail blocks login until the address is verified, and
+	 * implies VerifyEmailAddresses. The token TTL defaults to 48 hours.
+	 */
+	EmailVerificationEmailTemplateID string
+	EmailVerificationTokenTTL        time.Duration
+	RequireVerifiedEmail             bool
+	VerifyEmailAddresses             bool
+
+	/*
+	 * Account lockout. Members whose accounts are locked after too many failed
+	 * logins are sent a signed link to unlock them. The template receives
+	 * "firstName", "lastName", and "unlockLink". Thresholds are set with the
+	 * LOGIN_* configuration values.
+	 */
+	AccountUnlockEmailTemplateID string
+
+	/*
+	 * JWT auth for SPA and mobile clients. When EnableJwtAuth is true members
+	 * can log in through JSON endpoints that return a signed access token and
+	 * a refresh token. Access tokens are signed with JWT_SIGNING_KEY. The
+	 * access token TTL defaults to 15 minutes, and the refresh token TTL to
+	 * 30 days.
+	 */
+	EnableJwtAuth      bool
+	JwtAccessTokenTTL  time.Duration
+	JwtRefreshTokenTTL time.Duration
 }
@@ -0,0 +1,183 @@
+package frame
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signedTokenAccountUnlock     string = "account-unlock"
+	signedTokenEmailVerification string = "email-verification"
+
+	accountUnlockTokenTTL = time.Hour * 24
+)
+
+/*
+sendMemberEmail sends a SendGrid dynamic template email to a member. The
+member's first and last name are always added to the template data. The
+email service is a shared builder, so sends are serialized.
+*/
+func (sa *SiteAuth) sendMemberEmail(templateID string, member Member, data map[string]interface{}) error {
+	if sa.emailService == nil || *sa.emailService == nil {
+		return fmt.Errorf("email service is not configured. please call AddEmailService()")
+	}
+
+	if templateID == "" {
+		return fmt.Errorf("no email template ID configured")
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	data["firstName"] = member.FirstName
+	data["lastName"] = member.LastName
+
+	sa.emailLock.Lock()
+	defer sa.emailLock.Unlock()
+
+	return (*sa.emailService).
+		Clear().
+		From(sa.frameConfig.MailFromEmail, sa.frameConfig.MailFromName).
+		To(member.Email, strings.TrimSpace(member.FirstName+" "+member.LastName)).
+		TemplateData(member.Email, data).
+		Send(templateID)
+}
+
+/*
+siteLink builds an absolute link to a path on this site, using the
+configured site URL, with the provided query parameters.
+*/
+func (sa *SiteAuth) siteLink(path string, query url.Values) string {
+	result := strings.TrimSuffix(sa.frameConfig.SiteURL, "/") + path
+
+	if len(query) > 0 {
+		result += "?" + query.Encode()
+	}
+
+	return result
+}
+
+/*
+sendVerificationEmail sends a member a signed link they can use to verify
+their email address. The link is tied to both the member ID and the
+current email address, so it stops working if the address changes.
+*/
+func (sa *SiteAuth) sendVerificationEmail(member Member) error {
+	subject := member.ID + ":" + member.Email
+	token := signToken(sa.frameConfig.TokenSigningKey, signedTokenEmailVerification, subject, time.Now().Add(sa.emailVerificationTokenTTL))
+
+	emailData := map[string]interface{}{
+		"verificationLink": sa.siteLink(SiteAuthVerifyEmailPath, url.Values{"token": {token}}),
+	}
+
+	return sa.sendMemberEmail(sa.emailVerificationEmailTemplateID, member, emailData)
+}
+
+/*
+sendInvitationEmail sends an invitation to the invited email address. The
+invitee isn't a member yet, so the template gets empty names.
+*/
+func (sa *SiteAuth) sendInvitationEmail(invitation MemberInvitation, token string) error {
+	emailData := map[string]interface{}{
+		"invitationLink": sa.siteLink(MemberAcceptInvitationPath, url.Values{"token": {token}}),
+		"invitedBy":      invitation.InvitedBy,
+		"roleName":       invitation.Role.Role,
+	}
+
+	return sa.sendMemberEmail(sa.invitationEmailTemplateID, Member{Email: invitation.Email}, emailData)
+}
+
+/*
+sendUnlockEmail sends a member a signed link to unlock their account. The
+link is tied to the time the account was locked, so it only works for the
+current lockout.
+*/
+func (sa *SiteAuth) sendUnlockEmail(member Member, lockedAt time.Time) error {
+	subject := member.ID + ":" + strconv.FormatInt(lockedAt.Unix(), 10)
+	token := signToken(sa.frameConfig.TokenSigningKey, signedTokenAccountUnlock, subject, time.Now().Add(accountUnlockTokenTTL))
+
+	emailData := map[string]interface{}{
+		"unlockLink": sa.siteLink(SiteAuthUnlockAccountPath, url.Values{"token": {token}}),
+	}
+
+	return sa.sendMemberEmail(sa.accountUnlockEmailTemplateID, member, emailData)
+}
+
+/*
+sendInBackground runs send in its own goroutine and logs if it fails.
+Notifications use it so a slow or broken mail service never holds up, or
+fails, the request that caused them.
+*/
+func (sa *SiteAuth) sendInBackground(emailName, memberID string, send func() error) {
+	go func() {
+		if err := send(); err != nil {
+			sa.logger.WithError(err).WithField("memberID", memberID).Errorf("error sending %s email", emailName)
+		}
+	}()
+}
+
+/*
+notifyPendingApproval tells approvers that member is waiting for approval.
+Approvers are the active members with the configured notify role. Nothing
+is sent when no template is configured.
+*/
+func (sa *SiteAuth) notifyPendingApproval(memberService *MemberService, member Member) {
+	if sa.pendingApprovalEmailTemplateID == "" {
+		return
+	}
+
+	sa.sendInBackground("pending approval", member.ID, func() error {
+		var (
+			err       error
+			approvers []Member
+			failed    int
+		)
+
+		if approvers, err = memberService.GetActiveMembersByRole(sa.pendingApprovalNotifyRoleID); err != nil {
+			return fmt.Errorf("error getting approvers: %w", err)
+		}
+
+		for _, approver := range approvers {
+			emailData := map[string]interface{}{
+				"memberEmail":     member.Email,
+				"memberFirstName": member.FirstName,
+				"memberLastName":  member.LastName,
+				"reviewLink":      sa.siteLink(path.Join("/admin/members/edit", member.ID), nil),
+			}
+
+			if err = sa.sendMemberEmail(sa.pendingApprovalEmailTemplateID, approver, emailData); err != nil {
+				sa.logger.WithError(err).WithField("approverID", approver.ID).Error("error sending pending approval email to approver")
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d pending approval emails failed", failed, len(approvers))
+		}
+
+		return nil
+	})
+}
+
+/*
+notifyMemberApproved tells a member their account has been approved and
+they can log in. Nothing is sent when no template is configured.
+*/
+func (sa *SiteAuth) notifyMemberApproved(member Member) {
+	if sa.memberApprovedEmailTemplateID == "" {
+		return
+	}
+
+	sa.sendInBackground("member approved", member.ID, func() error {
+		emailData := map[string]interface{}{
+			"loginLink": sa.siteLink(SiteAuthLoginPath, nil),
+		}
+
+		return sa.sendMemberEmail(sa.memberApprovedEmailTemplateID, member, emailData)
+	})
+}
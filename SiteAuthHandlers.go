@@ -4,24 +4,40 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gorilla/sessions"
+	"github.com/app-nerds/kit/v6/passwords"
+	"github.com/sirupsen/logrus"
 )
 
 func (sa *SiteAuth) handleSiteAuthLogin(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
-			err     error
-			session *sessions.Session
-			member  Member
+			err    error
+			member Member
+			wait   time.Duration
 		)
 
 		data := struct {
-			Email        string
-			ErrorMessage string
-			Referer      string
-			Stylesheets  []string
+			CSRFToken             string
+			Email                 string
+			ErrorMessage          string
+			ExternalAuthProviders []string
+			MagicLinkLogin        bool
+			MagicLinkSent         bool
+			PasswordLogin         bool
+			Referer               string
+			SignUpEnabled         bool
+			Stylesheets           []string
 		}{
+			CSRFToken:             CSRFToken(r),
+			ExternalAuthProviders: sa.externalAuthProviders,
+			MagicLinkLogin:        sa.magicLinkEnabled(),
+			PasswordLogin:         sa.passwordLoginEnabled(),
+			SignUpEnabled:         !sa.inviteOnly,
 			Stylesheets: []string{
 				"/frame-static/css/frame-page-styles.css",
 			},
@@ -38,6 +54,59 @@ func (sa *SiteAuth) handleSiteAuthLogin(webApp *WebApp, memberService *MemberSer
 			data.Referer = r.Form.Get("referer")
 			email := r.Form.Get("email")
 			password := r.Form.Get("password")
+			magicLink := sa.wantsMagicLink(r)
+			ip := RealIP(r)
+
+			if !magicLink && password == "" {
+				data.ErrorMessage = "Please enter your password."
+				webApp.RenderTemplate(w, "login.tmpl", data)
+				return
+			}
+
+			/*
+			 * Slow down repeated failures, and block IP addresses that fail
+			 * too often.
+			 */
+			if wait, err = sa.checkLoginThrottle(email, ip, LoginTypeMember); err != nil {
+				sa.logger.WithError(err).Error("error checking login attempts")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			if wait > 0 {
+				data.ErrorMessage = "Too many failed login attempts. Please try again in " + formatRetryAfter(wait) + "."
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				w.WriteHeader(http.StatusTooManyRequests)
+				webApp.RenderTemplate(w, "login.tmpl", data)
+				return
+			}
+
+			/*
+			 * Limit how many magic links are sent to an email address, or
+			 * requested from an IP address, so the form can't be used to
+			 * flood someone's inbox.
+			 */
+			if magicLink {
+				if wait, err = sa.loginAttemptService.CheckMagicLink(email, ip); err != nil {
+					sa.logger.WithError(err).Error("error checking magic link requests")
+					http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+					return
+				}
+
+				if wait > 0 {
+					sa.logger.WithField("ip", ip).Warn("too many magic links requested")
+
+					data.ErrorMessage = "Too many login links have been requested. Please try again in " + formatRetryAfter(wait) + "."
+					w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+					w.WriteHeader(http.StatusTooManyRequests)
+					webApp.RenderTemplate(w, "login.tmpl", data)
+					return
+				}
+
+				if err = sa.loginAttemptService.RecordMagicLink(email, ip); err != nil {
+					sa.logger.WithError(err).Error("error recording magic link request")
+				}
+			}
 
 			/*
 			 * If this member doesn't exist yet, tell them they can make one.
@@ -45,6 +114,22 @@ func (sa *SiteAuth) handleSiteAuthLogin(webApp *WebApp, memberService *MemberSer
 			member, err = memberService.GetMemberByEmail(email, false)
 
 			if err != nil && errors.Is(err, sql.ErrNoRows) {
+				/*
+				 * Don't leak which email addresses have accounts
+				 */
+				if magicLink {
+					sa.logger.WithField("ip", ip).Info("magic link requested for unknown email address")
+					data.MagicLinkSent = true
+					webApp.RenderTemplate(w, "login.tmpl", data)
+					return
+				}
+
+				if _, err = sa.loginAttemptService.RecordFailure(email, ip, LoginTypeMember); err != nil {
+					sa.logger.WithError(err).Error("error recording failed login")
+				}
+
+				_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMemberLoginFailed, AuditTargetMember, "").WithActor(email, ""))
+
 				data.ErrorMessage = "Invalid user name or password. Please try again."
 				webApp.RenderTemplate(w, "login.tmpl", data)
 				return
@@ -73,41 +158,96 @@ func (sa *SiteAuth) handleSiteAuthLogin(webApp *WebApp, memberService *MemberSer
 				return
 			}
 
+			/*
+			 * Accounts are locked after too many failed logins
+			 */
+			if sa.loginAttemptService.IsLocked(member) {
+				data.ErrorMessage = "This account is locked because of too many failed login attempts. Check your email for a link to unlock it, or contact an administrator."
+				webApp.RenderTemplate(w, "login.tmpl", data)
+				return
+			}
+
+			/*
+			 * Magic links are checked when they are followed. Password and
+			 * email verification checks don't apply.
+			 */
+			if magicLink {
+				if err = sa.sendMagicLink(memberService, member, data.Referer); err != nil {
+					sa.logger.WithError(err).WithField("memberID", member.ID).Error("error sending magic link")
+					http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+					return
+				}
+
+				_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMagicLinkSent, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+				data.MagicLinkSent = true
+				webApp.RenderTemplate(w, "login.tmpl", data)
+				return
+			}
+
 			/*
 			 * If we have an approved member, but the password is invalid, let them know
 			 */
-			if !member.Password.IsSameAsPlaintextPassword(password) {
+			if !memberService.IsPasswordCorrect(member, password) {
+				if err = sa.recordFailedLogin(r, memberService, member, LoginTypeMember); err != nil {
+					sa.logger.WithError(err).WithField("memberID", member.ID).Error("error recording failed login")
+				}
+
 				data.ErrorMessage = "Invalid user name or password. Please try again."
 				webApp.RenderTemplate(w, "login.tmpl", data)
 				return
 			}
 
+			upgradePasswordHash(sa.logger, memberService, member, password)
+
 			/*
-			 * Otherwise, we are good to go!
+			 * Members with two-factor authentication turned on are recorded
+			 * once their code checks out. Recording a success now would reset
+			 * the failures that bad codes count towards.
 			 */
-			if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
-				sa.logger.WithError(err).Error("error geting session")
-				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
-				return
+			if member.TotpEnabledAt == nil {
+				if err = sa.recordSuccessfulLogin(r, memberService, member, LoginTypeMember); err != nil {
+					sa.logger.WithError(err).WithField("memberID", member.ID).Error("error recording successful login")
+				}
 			}
 
-			session.Values["memberID"] = member.ID
-			session.Values["email"] = member.Email
-			session.Values["firstName"] = member.FirstName
-			session.Values["lastName"] = member.LastName
-			session.Values["avatarURL"] = member.AvatarURL
-			session.Values["status"] = string(member.Status.Status)
+			/*
+			 * If we require verified email addresses, and this member hasn't
+			 * verified theirs yet, send them a fresh link and let them know.
+			 */
+			if sa.requireVerifiedEmail && member.EmailVerifiedAt == nil {
+				if err = sa.sendVerificationEmail(member); err != nil {
+					sa.logger.WithError(err).WithField("memberID", member.ID).Error("error sending verification email")
+				}
 
-			if err = sa.sessionStore.Save(r, w, session); err != nil {
-				sa.logger.WithError(err).Error("error saving session")
-				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				webApp.RenderTemplate(w, "email-verification-pending.tmpl", data)
 				return
 			}
 
-			goTo := r.Form.Get("referer")
+			goTo := localRedirectPath(r.Form.Get("referer"))
 
-			if goTo == "" {
-				goTo = "/"
+			/*
+			 * Members with two-factor authentication turned on need to provide
+			 * a code from their authenticator app before we log them in.
+			 */
+			if member.TotpEnabledAt != nil {
+				if err = sa.beginTwoFactorLogin(w, r, member, goTo); err != nil {
+					sa.logger.WithError(err).Error("error starting two-factor login")
+					http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+					return
+				}
+
+				http.Redirect(w, r, SiteAuthTwoFactorPath, http.StatusFound)
+				return
+			}
+
+			/*
+			 * Otherwise, we are good to go!
+			 */
+			if err = sa.writeMemberSession(w, r, member); err != nil {
+				sa.logger.WithError(err).Error("error saving session")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
 			}
 
 			http.Redirect(w, r, goTo, http.StatusFound)
@@ -121,13 +261,445 @@ func (sa *SiteAuth) handleSiteAuthLogin(webApp *WebApp, memberService *MemberSer
 func (sa *SiteAuth) handleAccountPending(webApp *WebApp) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		data := struct {
-			Stylesheets []string
+			Stylesheets          []string
+			VerifyEmailAddresses bool
 		}{
 			Stylesheets: []string{
 				"/frame-static/css/frame-page-styles.css",
 			},
+			VerifyEmailAddresses: sa.verifyEmailAddresses,
 		}
 
 		webApp.RenderTemplate(w, "account-pending.tmpl", data)
 	}
 }
+
+/*
+GET, POST /member/forgot-password
+*/
+func (sa *SiteAuth) handleForgotPassword(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err    error
+			member Member
+			token  string
+		)
+
+		data := struct {
+			CSRFToken    string
+			Email        string
+			ErrorMessage string
+			Sent         bool
+			Stylesheets  []string
+		}{
+			CSRFToken: CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if r.Method == http.MethodPost {
+			_ = r.ParseForm()
+
+			data.Email = r.FormValue("email")
+
+			if data.Email == "" {
+				data.ErrorMessage = "Please provide your email address."
+				webApp.RenderTemplate(w, "forgot-password.tmpl", data)
+				return
+			}
+
+			/*
+			 * We always tell the visitor a link was sent. This way we don't
+			 * leak which email addresses have accounts.
+			 */
+			data.Sent = true
+			member, err = memberService.GetMemberByEmail(data.Email, false)
+
+			if err != nil && errors.Is(err, sql.ErrNoRows) {
+				sa.logger.WithField("ip", RealIP(r)).Info("password reset requested for unknown email address")
+				webApp.RenderTemplate(w, "forgot-password.tmpl", data)
+				return
+			}
+
+			if err != nil {
+				sa.logger.WithError(err).Error("error getting member information in handleForgotPassword()")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			/*
+			 * Failures from here on are only logged. Known email addresses
+			 * must get the same response, just as quickly, as unknown ones.
+			 */
+			if token, err = memberService.CreateMemberToken(member.ID, MemberTokenPasswordReset, sa.passwordResetTokenTTL); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error creating password reset token")
+				webApp.RenderTemplate(w, "forgot-password.tmpl", data)
+				return
+			}
+
+			emailData := map[string]interface{}{
+				"resetLink": sa.siteLink(SiteAuthResetPasswordPath, url.Values{"token": {token}}),
+			}
+
+			sa.sendInBackground("password reset", member.ID, func() error {
+				return sa.sendMemberEmail(sa.passwordResetEmailTemplateID, member, emailData)
+			})
+		}
+
+		webApp.RenderTemplate(w, "forgot-password.tmpl", data)
+	}
+}
+
+/*
+GET, POST /member/reset-password
+*/
+func (sa *SiteAuth) handleResetPassword(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err      error
+			member   Member
+			memberID string
+		)
+
+		data := struct {
+			CSRFToken    string
+			ErrorMessage string
+			Stylesheets  []string
+			Success      bool
+			Token        string
+		}{
+			CSRFToken: CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if r.Method == http.MethodGet {
+			data.Token = r.URL.Query().Get("token")
+
+			if data.Token == "" {
+				data.ErrorMessage = "This password reset link is invalid. Please request a new one."
+			}
+
+			webApp.RenderTemplate(w, "reset-password.tmpl", data)
+			return
+		}
+
+		_ = r.ParseForm()
+
+		data.Token = r.FormValue("token")
+		password := r.FormValue("password")
+		reenterPassword := r.FormValue("reenterPassword")
+
+		if password == "" {
+			data.ErrorMessage = "Please provide a new password."
+			webApp.RenderTemplate(w, "reset-password.tmpl", data)
+			return
+		}
+
+		if password != reenterPassword {
+			data.ErrorMessage = "The passwords you provided don't match. Please re-type them and try submitting again."
+			webApp.RenderTemplate(w, "reset-password.tmpl", data)
+			return
+		}
+
+		/*
+		 * Check the new password before using up the token, so a member
+		 * whose password breaks the rules can try another one.
+		 */
+		memberID, err = memberService.PeekMemberToken(MemberTokenPasswordReset, data.Token)
+
+		if err == nil {
+			if member, err = memberService.GetMemberByID(memberID, false); err != nil {
+				sa.logger.WithError(err).WithField("memberID", memberID).Error("error getting member information in handleResetPassword()")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			if err = sa.passwordPolicy.Validate(password, member.Email); err != nil {
+				data.ErrorMessage = err.Error()
+				webApp.RenderTemplate(w, "reset-password.tmpl", data)
+				return
+			}
+
+			memberID, err = memberService.ConsumeMemberToken(MemberTokenPasswordReset, data.Token)
+		}
+
+		if errors.Is(err, ErrInvalidMemberToken) {
+			sa.logger.WithField("ip", RealIP(r)).Info("invalid or expired password reset token used")
+
+			data.ErrorMessage = "This password reset link is invalid or has expired. Please request a new one."
+			webApp.RenderTemplate(w, "reset-password.tmpl", data)
+			return
+		}
+
+		if err != nil {
+			sa.logger.WithError(err).Error("error consuming password reset token")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		member.Password = passwords.HashedPasswordString(password)
+
+		if err = memberService.UpdateMember(member); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error updating member password")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * Any other reset links sent to this member are no longer needed
+		 */
+		if err = memberService.InvalidateMemberTokens(member.ID, MemberTokenPasswordReset); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error invalidating password reset tokens")
+		}
+
+		sa.logger.WithFields(logrus.Fields{
+			"memberID": member.ID,
+			"ip":       RealIP(r),
+		}).Info("member password reset")
+
+		_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionPasswordReset, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+		data.Token = ""
+		data.Success = true
+		webApp.RenderTemplate(w, "reset-password.tmpl", data)
+	}
+}
+
+/*
+GET /member/verify-email
+*/
+func (sa *SiteAuth) handleVerifyEmail(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err     error
+			member  Member
+			subject string
+		)
+
+		data := struct {
+			ErrorMessage string
+			Stylesheets  []string
+			Success      bool
+		}{
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if subject, err = verifySignedToken(sa.frameConfig.TokenSigningKey, signedTokenEmailVerification, r.URL.Query().Get("token")); err != nil {
+			sa.logger.WithField("ip", RealIP(r)).Info("invalid or expired email verification token used")
+
+			data.ErrorMessage = "This verification link is invalid or has expired. Try logging in to receive a new one."
+			webApp.RenderTemplate(w, "email-verified.tmpl", data)
+			return
+		}
+
+		memberID, email, _ := strings.Cut(subject, ":")
+		member, err = memberService.GetMemberByID(memberID, false)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			sa.logger.WithError(err).WithField("memberID", memberID).Error("error getting member information in handleVerifyEmail()")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * The link is only good for the address it was sent to
+		 */
+		if err != nil || member.Email != email {
+			data.ErrorMessage = "This verification link is no longer valid. Try logging in to receive a new one."
+			webApp.RenderTemplate(w, "email-verified.tmpl", data)
+			return
+		}
+
+		if member.EmailVerifiedAt == nil {
+			if err = memberService.MarkMemberEmailVerified(member.ID); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error marking member email as verified")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			sa.logger.WithField("memberID", member.ID).Info("member email address verified")
+
+			now := time.Now().UTC()
+			member.EmailVerifiedAt = &now
+
+			if err = sa.applyApprovalPolicy(r, memberService, &member); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error applying approval policy after email verification")
+			}
+		}
+
+		data.Success = true
+		webApp.RenderTemplate(w, "email-verified.tmpl", data)
+	}
+}
+
+/*
+GET /member/unlock-account
+*/
+func (sa *SiteAuth) handleUnlockAccount(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err     error
+			member  Member
+			subject string
+		)
+
+		data := struct {
+			ErrorMessage string
+			Stylesheets  []string
+			Success      bool
+		}{
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if subject, err = verifySignedToken(sa.frameConfig.TokenSigningKey, signedTokenAccountUnlock, r.URL.Query().Get("token")); err != nil {
+			sa.logger.WithField("ip", RealIP(r)).Info("invalid or expired account unlock token used")
+
+			data.ErrorMessage = "This unlock link is invalid or has expired."
+			webApp.RenderTemplate(w, "account-unlocked.tmpl", data)
+			return
+		}
+
+		memberID, lockedAt, _ := strings.Cut(subject, ":")
+		member, err = memberService.GetMemberByID(memberID, false)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			sa.logger.WithError(err).WithField("memberID", memberID).Error("error getting member information in handleUnlockAccount()")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if err != nil {
+			data.ErrorMessage = "This unlock link is no longer valid."
+			webApp.RenderTemplate(w, "account-unlocked.tmpl", data)
+			return
+		}
+
+		/*
+		 * The link is only good for the lockout it was sent for
+		 */
+		if member.LockedAt != nil {
+			if strconv.FormatInt(member.LockedAt.Unix(), 10) != lockedAt {
+				data.ErrorMessage = "This unlock link is no longer valid."
+				webApp.RenderTemplate(w, "account-unlocked.tmpl", data)
+				return
+			}
+
+			if err = sa.unlockMember(memberService, member); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error unlocking member")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			sa.logger.WithFields(logrus.Fields{
+				"event":    "account_unlocked",
+				"memberID": member.ID,
+				"ip":       RealIP(r),
+			}).Info("member unlocked their account")
+
+			_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionAccountUnlocked, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+		}
+
+		data.Success = true
+		webApp.RenderTemplate(w, "account-unlocked.tmpl", data)
+	}
+}
+
+/*
+checkLoginThrottle returns how long a login attempt must wait. Throttled
+attempts are logged.
+*/
+func (sa *SiteAuth) checkLoginThrottle(email, ip, loginType string) (time.Duration, error) {
+	wait, err := sa.loginAttemptService.CheckLogin(email, ip)
+
+	if err == nil && wait > 0 {
+		sa.logger.WithFields(logrus.Fields{
+			"event":      "login_throttled",
+			"email":      email,
+			"ip":         ip,
+			"loginType":  loginType,
+			"retryAfter": int(wait.Seconds()),
+		}).Warn("login attempt throttled")
+	}
+
+	return wait, err
+}
+
+/*
+recordFailedLogin records a failed login for an existing member. If they
+have failed too many times in a row their account is locked, and they are
+emailed a link to unlock it.
+*/
+func (sa *SiteAuth) recordFailedLogin(r *http.Request, memberService *MemberService, member Member, loginType string) error {
+	var (
+		err      error
+		failures int
+		lockedAt time.Time
+	)
+
+	ip := RealIP(r)
+	_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMemberLoginFailed, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+	if failures, err = sa.loginAttemptService.RecordFailure(member.Email, ip, loginType); err != nil {
+		return err
+	}
+
+	if !sa.loginAttemptService.ShouldLock(failures) || sa.loginAttemptService.IsLocked(member) {
+		return nil
+	}
+
+	if lockedAt, err = memberService.LockMember(member.ID); err != nil {
+		return err
+	}
+
+	sa.logger.WithFields(logrus.Fields{
+		"event":     "account_locked",
+		"memberID":  member.ID,
+		"email":     member.Email,
+		"ip":        ip,
+		"loginType": loginType,
+		"failures":  failures,
+	}).Warn("member account locked after too many failed logins")
+
+	_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionAccountLocked, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+	if sa.accountUnlockEmailTemplateID != "" {
+		if err = sa.sendUnlockEmail(member, lockedAt); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error sending account unlock email")
+		}
+	}
+
+	return nil
+}
+
+/*
+recordSuccessfulLogin records a correct password. A lock that has expired
+is cleared.
+*/
+func (sa *SiteAuth) recordSuccessfulLogin(r *http.Request, memberService *MemberService, member Member, loginType string) error {
+	if err := sa.loginAttemptService.RecordSuccess(member.Email, RealIP(r), loginType); err != nil {
+		return err
+	}
+
+	_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMemberLogin, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+
+	if member.LockedAt != nil {
+		return memberService.UnlockMember(member.ID)
+	}
+
+	return nil
+}
+
+func (sa *SiteAuth) unlockMember(memberService *MemberService, member Member) error {
+	if err := memberService.UnlockMember(member.ID); err != nil {
+		return err
+	}
+
+	return sa.loginAttemptService.ResetFailures(member.Email)
+}
@@ -0,0 +1,599 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	/*
+	 * ErrInvalidRefreshToken is returned when a refresh token does not exist,
+	 * has been revoked, or has expired.
+	 */
+	ErrInvalidRefreshToken = errors.New("invalid, revoked, or expired refresh token")
+
+	/*
+	 * ErrRefreshTokenReused is returned when a refresh token that was
+	 * already exchanged is used again. This usually means the token was
+	 * stolen, so every token in its family is revoked.
+	 */
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+/*
+MemberClaims are the claims carried by a member's JWT access token. They
+hold the same member information a cookie session does. The member ID is
+the token subject.
+*/
+type MemberClaims struct {
+	jwt.RegisteredClaims
+	AvatarURL    string `json:"avatarURL"`
+	Email        string `json:"email"`
+	FirstName    string `json:"firstName"`
+	LastName     string `json:"lastName"`
+	Role         string `json:"role"`
+	RoleID       uint   `json:"roleID"`
+	SessionEpoch int    `json:"sessionEpoch"`
+	Status       string `json:"status"`
+}
+
+/*
+JwtLoginRequest is the body of a POST to /api/member/token. Code is only
+required for members with two-factor authentication turned on.
+*/
+type JwtLoginRequest struct {
+	Code     string `json:"code"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+/*
+JwtRefreshRequest is the body of a POST to /api/member/token/refresh and
+/api/member/token/logout.
+*/
+type JwtRefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+/*
+JwtTokenResponse is returned when a member logs in or refreshes their
+tokens. ExpiresIn is the number of seconds the access token is valid for.
+*/
+type JwtTokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+}
+
+/*
+POST /api/member/token
+*/
+func (sa *SiteAuth) handleJwtLogin(memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err      error
+			member   Member
+			request  JwtLoginRequest
+			response JwtTokenResponse
+			valid    bool
+			wait     time.Duration
+		)
+
+		if err = ReadJSONBody(r, &request); err != nil {
+			WriteJSON(w, http.StatusBadRequest, CreateGenericErrorResponse("Invalid request", err.Error(), ""))
+			return
+		}
+
+		ip := RealIP(r)
+		logger := sa.logger.WithField("ip", ip)
+
+		if wait, err = sa.checkLoginThrottle(request.Email, ip, LoginTypeApi); err != nil {
+			logger.WithError(err).Error("error checking login attempts")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error checking login attempts", "", ""))
+			return
+		}
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			WriteJSON(w, http.StatusTooManyRequests, CreateGenericErrorResponse("Too many failed login attempts. Please try again in "+formatRetryAfter(wait)+".", "", "too_many_attempts"))
+			return
+		}
+
+		member, err = memberService.GetMemberByEmail(request.Email, false)
+
+		if err != nil && errors.Is(err, sql.ErrNoRows) {
+			if _, err = sa.loginAttemptService.RecordFailure(request.Email, ip, LoginTypeApi); err != nil {
+				logger.WithError(err).Error("error recording failed login")
+			}
+
+			_ = sa.auditLogger.Record(NewAuditEvent(r, AuditActionMemberLoginFailed, AuditTargetMember, "").WithActor(request.Email, ""))
+
+			WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid email or password", "", ""))
+			return
+		}
+
+		if err != nil {
+			logger.WithError(err).Error("error getting member information in handleJwtLogin()")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error retrieving member information", "", ""))
+			return
+		}
+
+		if sa.loginAttemptService.IsLocked(member) {
+			WriteJSON(w, http.StatusForbidden, CreateGenericErrorResponse("This account is locked because of too many failed login attempts", "", "account_locked"))
+			return
+		}
+
+		if !memberService.IsPasswordCorrect(member, request.Password) {
+			if err = sa.recordFailedLogin(r, memberService, member, LoginTypeApi); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error recording failed login")
+			}
+
+			WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid email or password", "", ""))
+			return
+		}
+
+		upgradePasswordHash(logger, memberService, member, request.Password)
+
+		/*
+		 * Members with two-factor authentication turned on haven't logged in
+		 * until their code checks out. Recording a success now would reset
+		 * the failures that bad codes count towards.
+		 */
+		if member.TotpEnabledAt == nil {
+			if err = sa.recordSuccessfulLogin(r, memberService, member, LoginTypeApi); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error recording successful login")
+			}
+		}
+
+		if member.Status.ID != MemberActiveID || member.DeletedAt != nil {
+			WriteJSON(w, http.StatusForbidden, CreateGenericErrorResponse("This account is pending approval", "", "account_pending"))
+			return
+		}
+
+		if sa.requireVerifiedEmail && member.EmailVerifiedAt == nil {
+			if err = sa.sendVerificationEmail(member); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error sending verification email")
+			}
+
+			WriteJSON(w, http.StatusForbidden, CreateGenericErrorResponse("Please verify your email address", "", "email_not_verified"))
+			return
+		}
+
+		/*
+		 * Members with two-factor authentication turned on must send a code
+		 * from their authenticator app, or a recovery code.
+		 */
+		if member.TotpEnabledAt != nil {
+			if request.Code == "" {
+				WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("A two-factor authentication code is required", "", "two_factor_required"))
+				return
+			}
+
+			if valid, err = memberService.VerifyMemberSecondFactor(member, request.Code); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error verifying second factor")
+				WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error verifying code", "", ""))
+				return
+			}
+
+			if !valid {
+				if err = sa.recordFailedLogin(r, memberService, member, LoginTypeApi); err != nil {
+					logger.WithError(err).WithField("memberID", member.ID).Error("error recording failed login")
+				}
+
+				WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid two-factor authentication code", "", "two_factor_required"))
+				return
+			}
+
+			if err = sa.recordSuccessfulLogin(r, memberService, member, LoginTypeApi); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error recording successful login")
+			}
+		}
+
+		if response, err = sa.issueJwtTokens(memberService, member, ""); err != nil {
+			logger.WithError(err).WithField("memberID", member.ID).Error("error issuing tokens")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error issuing tokens", "", ""))
+			return
+		}
+
+		logger.WithField("memberID", member.ID).Info("member logged in with jwt auth")
+		WriteJSON(w, http.StatusOK, response)
+	}
+}
+
+/*
+POST /api/member/token/refresh
+*/
+func (sa *SiteAuth) handleJwtRefresh(memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err          error
+			member       Member
+			memberID     string
+			familyID     string
+			request      JwtRefreshRequest
+			response     JwtTokenResponse
+			refreshToken string
+		)
+
+		if err = ReadJSONBody(r, &request); err != nil {
+			WriteJSON(w, http.StatusBadRequest, CreateGenericErrorResponse("Invalid request", err.Error(), ""))
+			return
+		}
+
+		logger := sa.logger.WithField("ip", RealIP(r))
+		memberID, familyID, refreshToken, err = memberService.RotateMemberRefreshToken(request.RefreshToken, sa.jwtRefreshTokenTTL)
+
+		if errors.Is(err, ErrRefreshTokenReused) {
+			logger.WithFields(logrus.Fields{
+				"memberID": memberID,
+				"familyID": familyID,
+			}).Warn("refresh token reuse detected. all tokens in the family were revoked")
+
+			WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid refresh token", "", ""))
+			return
+		}
+
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid refresh token", "", ""))
+			return
+		}
+
+		if err != nil {
+			logger.WithError(err).Error("error rotating refresh token")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error refreshing tokens", "", ""))
+			return
+		}
+
+		/*
+		 * Make sure the member is still allowed to log in
+		 */
+		if member, err = memberService.GetMemberByID(memberID, false); err != nil || member.Status.ID != MemberActiveID {
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				logger.WithError(err).Error("error getting member information in handleJwtRefresh()")
+			}
+
+			_ = memberService.RevokeMemberRefreshTokenFamily(familyID)
+			WriteJSON(w, http.StatusUnauthorized, CreateGenericErrorResponse("Invalid refresh token", "", ""))
+			return
+		}
+
+		if response.AccessToken, err = sa.createJwtAccessToken(member); err != nil {
+			logger.WithError(err).WithField("memberID", member.ID).Error("error creating access token")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error issuing tokens", "", ""))
+			return
+		}
+
+		response.ExpiresIn = int(sa.jwtAccessTokenTTL.Seconds())
+		response.RefreshToken = refreshToken
+		response.TokenType = "Bearer"
+
+		WriteJSON(w, http.StatusOK, response)
+	}
+}
+
+/*
+POST /api/member/token/logout
+*/
+func (sa *SiteAuth) handleJwtLogout(memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err     error
+			request JwtRefreshRequest
+		)
+
+		if err = ReadJSONBody(r, &request); err != nil {
+			WriteJSON(w, http.StatusBadRequest, CreateGenericErrorResponse("Invalid request", err.Error(), ""))
+			return
+		}
+
+		if err = memberService.RevokeMemberRefreshToken(request.RefreshToken); err != nil {
+			sa.logger.WithError(err).WithField("ip", RealIP(r)).Error("error revoking refresh token")
+			WriteJSON(w, http.StatusInternalServerError, CreateGenericErrorResponse("Error logging out", "", ""))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, CreateGenericSuccessResponse("Logged out"))
+	}
+}
+
+/*
+issueJwtTokens creates an access token and a refresh token for a member.
+Pass an empty familyID to start a new refresh token family, which happens
+each time a member logs in.
+*/
+func (sa *SiteAuth) issueJwtTokens(memberService *MemberService, member Member, familyID string) (JwtTokenResponse, error) {
+	var (
+		err    error
+		result JwtTokenResponse
+	)
+
+	if result.AccessToken, err = sa.createJwtAccessToken(member); err != nil {
+		return result, err
+	}
+
+	if result.RefreshToken, err = memberService.CreateMemberRefreshToken(member.ID, familyID, sa.jwtRefreshTokenTTL); err != nil {
+		return result, err
+	}
+
+	result.ExpiresIn = int(sa.jwtAccessTokenTTL.Seconds())
+	result.TokenType = "Bearer"
+
+	return result, nil
+}
+
+func (sa *SiteAuth) createJwtAccessToken(member Member) (string, error) {
+	var (
+		err error
+		id  string
+	)
+
+	if id, err = generateSecureToken(); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	claims := MemberClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(sa.jwtAccessTokenTTL)),
+			ID:        id,
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    sa.frameConfig.AppName,
+			Subject:   member.ID,
+		},
+		AvatarURL:    member.AvatarURL,
+		Email:        member.Email,
+		FirstName:    member.FirstName,
+		LastName:     member.LastName,
+		Role:         member.Role.Role,
+		RoleID:       member.Role.ID,
+		SessionEpoch: member.SessionEpoch,
+		Status:       string(member.Status.Status),
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(sa.frameConfig.JwtSigningKey))
+}
+
+/*
+authenticateJwt validates a JWT access token. On success the returned
+context holds the same values the cookie session puts there. The member
+behind the token is loaded on every request, so a token stops working as
+soon as its member is deleted, deactivated, locked, or has their sessions
+ended, instead of when it expires.
+*/
+func (sa *SiteAuth) authenticateJwt(r *http.Request, memberService *MemberService, accessToken string) (context.Context, error) {
+	var (
+		err         error
+		token       *jwt.Token
+		member      Member
+		permissions PermissionSet
+	)
+
+	claims := &MemberClaims{}
+
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		return []byte(sa.frameConfig.JwtSigningKey), nil
+	}
+
+	if token, err = jwt.ParseWithClaims(accessToken, claims, keyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})); err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || !claims.VerifyIssuer(sa.frameConfig.AppName, true) {
+		return nil, fmt.Errorf("invalid access token")
+	}
+
+	if member, err = memberService.GetMemberByID(claims.Subject, false); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("member %s not found", claims.Subject)
+		}
+
+		return nil, err
+	}
+
+	if member.Status.ID != MemberActiveID {
+		return nil, fmt.Errorf("member %s is not active", member.ID)
+	}
+
+	if sa.loginAttemptService.IsLocked(member) {
+		return nil, fmt.Errorf("member %s is locked", member.ID)
+	}
+
+	if member.SessionEpoch != claims.SessionEpoch {
+		return nil, fmt.Errorf("access token for member %s was revoked", member.ID)
+	}
+
+	if permissions, err = memberService.GetRolePermissions(member.Role.ID); err != nil {
+		return nil, err
+	}
+
+	principal := newPrincipal(AuthMethodJwt, memberService)
+	principal.AvatarURL = member.AvatarURL
+	principal.Email = member.Email
+	principal.FirstName = member.FirstName
+	principal.LastName = member.LastName
+	principal.MemberID = member.ID
+	principal.Permissions = permissions
+	principal.Role = member.Role.Role
+	principal.RoleID = member.Role.ID
+	principal.Status = member.Status.Status
+
+	return withPrincipal(r.Context(), principal), nil
+}
+
+/*
+CreateMemberRefreshToken issues a refresh token for a member. Pass an empty
+familyID to start a new family. The plaintext token is returned to the
+caller. Only a hash of it is stored.
+*/
+func (s MemberService) CreateMemberRefreshToken(memberID, familyID string, ttl time.Duration) (string, error) {
+	return s.createMemberRefreshToken(s.db, memberID, familyID, ttl)
+}
+
+/*
+RotateMemberRefreshToken exchanges a refresh token for a new one in the
+same family. The old token can't be used again. If it is, every token in
+the family is revoked and ErrRefreshTokenReused is returned. The member ID
+and family ID are returned along with the new token.
+*/
+func (s MemberService) RotateMemberRefreshToken(token string, ttl time.Duration) (string, string, string, error) {
+	var (
+		err       error
+		tx        *sql.Tx
+		id        string
+		memberID  string
+		familyID  string
+		expiresAt time.Time
+		usedAt    *time.Time
+		revokedAt *time.Time
+		newToken  string
+	)
+
+	if tx, err = s.db.Begin(); err != nil {
+		return "", "", "", err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		SELECT
+			id,
+			member_id,
+			family_id,
+			expires_at,
+			used_at,
+			revoked_at
+		FROM member_refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`
+
+	err = tx.QueryRow(query, hashToken(token)).Scan(&id, &memberID, &familyID, &expiresAt, &usedAt, &revokedAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	now := time.Now().UTC()
+
+	if usedAt != nil && revokedAt == nil {
+		if _, err = tx.Exec(`UPDATE member_refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`, now, familyID); err != nil {
+			return "", "", "", err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return "", "", "", err
+		}
+
+		return memberID, familyID, "", ErrRefreshTokenReused
+	}
+
+	if usedAt != nil || revokedAt != nil || !expiresAt.After(now) {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+
+	if _, err = tx.Exec(`UPDATE member_refresh_tokens SET used_at = $1 WHERE id = $2`, now, id); err != nil {
+		return "", "", "", err
+	}
+
+	if newToken, err = s.createMemberRefreshToken(tx, memberID, familyID, ttl); err != nil {
+		return "", "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", "", err
+	}
+
+	return memberID, familyID, newToken, nil
+}
+
+/*
+RevokeMemberRefreshToken revokes the family a refresh token belongs to.
+This is how a client logs out. Unknown tokens are ignored.
+*/
+func (s MemberService) RevokeMemberRefreshToken(token string) error {
+	query := `
+		UPDATE member_refresh_tokens SET
+			revoked_at = $1
+		WHERE 1=1
+			AND revoked_at IS NULL
+			AND family_id IN (SELECT family_id FROM member_refresh_tokens WHERE token_hash = $2)
+	`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), hashToken(token))
+	return err
+}
+
+/*
+RevokeMemberRefreshTokenFamily revokes every token in a refresh token
+family.
+*/
+func (s MemberService) RevokeMemberRefreshTokenFamily(familyID string) error {
+	_, err := s.db.Exec(`UPDATE member_refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`, time.Now().UTC(), familyID)
+	return err
+}
+
+/*
+RevokeMemberRefreshTokens revokes every refresh token belonging to a
+member, logging them out of all SPA and mobile clients.
+*/
+func (s MemberService) RevokeMemberRefreshTokens(memberID string) error {
+	_, err := s.db.Exec(`UPDATE member_refresh_tokens SET revoked_at = $1 WHERE member_id = $2 AND revoked_at IS NULL`, time.Now().UTC(), memberID)
+	return err
+}
+
+/*
+sqlExecutor is satisfied by both *sql.DB and *sql.Tx.
+*/
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s MemberService) createMemberRefreshToken(db sqlExecutor, memberID, familyID string, ttl time.Duration) (string, error) {
+	var (
+		err   error
+		token string
+	)
+
+	if token, err = generateSecureToken(); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	query := `
+		INSERT INTO member_refresh_tokens (
+			created_at,
+			expires_at,
+			member_id,
+			family_id,
+			token_hash
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			COALESCE(NULLIF($4, '')::uuid, uuid_generate_v4()),
+			$5
+		)
+	`
+
+	if _, err = db.Exec(query, now, now.Add(ttl), memberID, familyID, hashToken(token)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
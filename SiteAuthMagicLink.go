@@ -0,0 +1,213 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (sa *SiteAuth) magicLinkEnabled() bool {
+	return sa.loginMethod == LoginMethodMagicLink || sa.loginMethod == LoginMethodPasswordOrMagicLink
+}
+
+func (sa *SiteAuth) passwordLoginEnabled() bool {
+	return sa.loginMethod == LoginMethodPassword || sa.loginMethod == LoginMethodPasswordOrMagicLink
+}
+
+/*
+wantsMagicLink returns true when a login form post is asking for a magic
+link instead of checking a password. When both are allowed the form's
+"Email me a link" button sends action=magic-link.
+*/
+func (sa *SiteAuth) wantsMagicLink(r *http.Request) bool {
+	if sa.loginMethod == LoginMethodMagicLink {
+		return true
+	}
+
+	return sa.loginMethod == LoginMethodPasswordOrMagicLink && r.FormValue("action") == "magic-link"
+}
+
+/*
+sendMagicLink emails a member a single-use link that logs them in. Links
+sent earlier stop working, so only the newest one can be used.
+*/
+func (sa *SiteAuth) sendMagicLink(memberService *MemberService, member Member, referer string) error {
+	var (
+		err   error
+		token string
+	)
+
+	if err = memberService.InvalidateMemberTokens(member.ID, MemberTokenMagicLink); err != nil {
+		return err
+	}
+
+	if token, err = memberService.CreateMemberToken(member.ID, MemberTokenMagicLink, sa.magicLinkTokenTTL); err != nil {
+		return err
+	}
+
+	query := url.Values{"token": {token}}
+
+	if referer != "" {
+		query.Set("referer", referer)
+	}
+
+	emailData := map[string]interface{}{
+		"loginLink": sa.siteLink(SiteAuthMagicLinkPath, query),
+	}
+
+	return sa.sendMemberEmail(sa.magicLinkEmailTemplateID, member, emailData)
+}
+
+/*
+GET, POST /member/login/magic-link
+
+The link in the email opens a page with a button that logs the member in.
+Mail scanners follow links in emails, so a GET must not use up the token.
+*/
+func (sa *SiteAuth) handleMagicLinkLogin(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err      error
+			member   Member
+			memberID string
+		)
+
+		data := struct {
+			CSRFToken    string
+			ErrorMessage string
+			Referer      string
+			Stylesheets  []string
+			Token        string
+		}{
+			CSRFToken: CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if r.Method == http.MethodGet {
+			data.Token = r.URL.Query().Get("token")
+			data.Referer = r.URL.Query().Get("referer")
+
+			if data.Token == "" {
+				data.ErrorMessage = "This login link is invalid. Please request a new one."
+			}
+
+			webApp.RenderTemplate(w, "login-magic-link.tmpl", data)
+			return
+		}
+
+		_ = r.ParseForm()
+
+		data.Referer = r.FormValue("referer")
+		ip := RealIP(r)
+
+		memberID, err = memberService.ConsumeMemberToken(MemberTokenMagicLink, r.FormValue("token"))
+
+		if errors.Is(err, ErrInvalidMemberToken) {
+			sa.logger.WithField("ip", ip).Info("invalid or expired magic link used")
+
+			data.ErrorMessage = "This login link is invalid or has expired. Please request a new one."
+			webApp.RenderTemplate(w, "login-magic-link.tmpl", data)
+			return
+		}
+
+		if err != nil {
+			sa.logger.WithError(err).Error("error consuming magic link token")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		member, err = memberService.GetMemberByID(memberID, false)
+
+		if err != nil && errors.Is(err, sql.ErrNoRows) {
+			data.ErrorMessage = "This login link is invalid or has expired. Please request a new one."
+			webApp.RenderTemplate(w, "login-magic-link.tmpl", data)
+			return
+		}
+
+		if err != nil {
+			sa.logger.WithError(err).WithField("memberID", memberID).Error("error getting member information in handleMagicLinkLogin()")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * The member may have been deactivated or deleted since the link
+		 * was sent.
+		 */
+		if member.Status.ID != MemberActiveID || member.DeletedAt != nil {
+			http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusFound)
+			return
+		}
+
+		if sa.loginAttemptService.IsLocked(member) {
+			data.ErrorMessage = "This account is locked because of too many failed login attempts. Check your email for a link to unlock it, or contact an administrator."
+			webApp.RenderTemplate(w, "login-magic-link.tmpl", data)
+			return
+		}
+
+		/*
+		 * Following the link proves the member owns their email address
+		 */
+		if member.EmailVerifiedAt == nil {
+			if err = memberService.MarkMemberEmailVerified(member.ID); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error marking email verified from magic link")
+			}
+		}
+
+		/*
+		 * Members with two-factor authentication turned on are recorded
+		 * once their code checks out. Recording a success now would reset
+		 * the failures that bad codes count towards.
+		 */
+		if member.TotpEnabledAt == nil {
+			if err = sa.recordSuccessfulLogin(r, memberService, member, LoginTypeMagicLink); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error recording successful login")
+			}
+		}
+
+		goTo := localRedirectPath(data.Referer)
+
+		if member.TotpEnabledAt != nil {
+			if err = sa.beginTwoFactorLogin(w, r, member, goTo); err != nil {
+				sa.logger.WithError(err).Error("error starting two-factor login")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			http.Redirect(w, r, SiteAuthTwoFactorPath, http.StatusFound)
+			return
+		}
+
+		if err = sa.writeMemberSession(w, r, member); err != nil {
+			sa.logger.WithError(err).Error("error saving session")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		sa.logger.WithFields(logrus.Fields{
+			"memberID": member.ID,
+			"ip":       ip,
+		}).Info("member logged in with a magic link")
+
+		http.Redirect(w, r, goTo, http.StatusFound)
+	}
+}
+
+/*
+localRedirectPath returns path if it is a path on this site, or "/" if it
+is empty or points somewhere else. Referers that arrive in links can't be
+trusted.
+*/
+func localRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+
+	return path
+}
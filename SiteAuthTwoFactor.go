@@ -0,0 +1,212 @@
+package frame
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	twoFactorLoginTimeout     time.Duration = time.Minute * 5
+	twoFactorLoginMaxAttempts int           = 5
+)
+
+/*
+beginTwoFactorLogin records that a member has passed the password step of
+logging in and still needs to provide a second factor. Nothing that marks
+the visitor as logged in is written to the session here.
+*/
+func (sa *SiteAuth) beginTwoFactorLogin(w http.ResponseWriter, r *http.Request, member Member, referer string) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+		return fmt.Errorf("error getting session: %w", err)
+	}
+
+	for key := range session.Values {
+		delete(session.Values, key)
+	}
+
+	session.Values["twoFactorMemberID"] = member.ID
+	session.Values["twoFactorReferer"] = referer
+	session.Values["twoFactorExpiresAt"] = time.Now().Add(twoFactorLoginTimeout).Unix()
+	session.Values["twoFactorAttempts"] = 0
+
+	return sa.sessionStore.Save(r, w, session)
+}
+
+func clearTwoFactorLogin(session *sessions.Session) {
+	delete(session.Values, "twoFactorMemberID")
+	delete(session.Values, "twoFactorReferer")
+	delete(session.Values, "twoFactorExpiresAt")
+	delete(session.Values, "twoFactorAttempts")
+}
+
+/*
+GET, POST /member/login/two-factor
+*/
+func (sa *SiteAuth) handleTwoFactorLogin(webApp *WebApp, memberService *MemberService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err     error
+			member  Member
+			session *sessions.Session
+			valid   bool
+			wait    time.Duration
+		)
+
+		data := struct {
+			CSRFToken    string
+			ErrorMessage string
+			Stylesheets  []string
+		}{
+			CSRFToken: CSRFToken(r),
+			Stylesheets: []string{
+				"/frame-static/css/frame-page-styles.css",
+			},
+		}
+
+		if session, err = sa.sessionStore.Get(r, sa.sessionName); err != nil {
+			sa.logger.WithError(err).Error("error getting session information")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		memberID, _ := session.Values["twoFactorMemberID"].(string)
+		expiresAt, _ := session.Values["twoFactorExpiresAt"].(int64)
+
+		/*
+		 * If there is no login in progress, or it took too long, start over
+		 */
+		if memberID == "" || time.Now().Unix() > expiresAt {
+			clearTwoFactorLogin(session)
+			_ = sa.sessionStore.Save(r, w, session)
+
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			webApp.RenderTemplate(w, "login-two-factor.tmpl", data)
+			return
+		}
+
+		_ = r.ParseForm()
+
+		member, err = memberService.GetMemberByID(memberID, false)
+
+		if err != nil && errors.Is(err, sql.ErrNoRows) {
+			clearTwoFactorLogin(session)
+			_ = sa.sessionStore.Save(r, w, session)
+
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		if err != nil {
+			sa.logger.WithError(err).WithField("memberID", memberID).Error("error getting member information in handleTwoFactorLogin()")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if member.Status.ID != MemberActiveID {
+			http.Redirect(w, r, SiteAuthAccountPendingPath, http.StatusFound)
+			return
+		}
+
+		/*
+		 * Bad codes count as failed logins, so they are throttled and lock
+		 * the account just like bad passwords
+		 */
+		if sa.loginAttemptService.IsLocked(member) {
+			clearTwoFactorLogin(session)
+			_ = sa.sessionStore.Save(r, w, session)
+
+			http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+			return
+		}
+
+		if wait, err = sa.checkLoginThrottle(member.Email, RealIP(r), LoginTypeMember); err != nil {
+			sa.logger.WithError(err).Error("error checking login attempts")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			data.ErrorMessage = "Too many failed login attempts. Please try again in " + formatRetryAfter(wait) + "."
+			webApp.RenderTemplate(w, "login-two-factor.tmpl", data)
+			return
+		}
+
+		if valid, err = memberService.VerifyMemberSecondFactor(member, r.FormValue("code")); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error verifying second factor")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if !valid {
+			attempts, _ := session.Values["twoFactorAttempts"].(int)
+			attempts++
+
+			sa.logger.WithFields(logrus.Fields{
+				"memberID": member.ID,
+				"ip":       RealIP(r),
+				"attempts": attempts,
+			}).Error("invalid two-factor code")
+
+			if err = sa.recordFailedLogin(r, memberService, member, LoginTypeMember); err != nil {
+				sa.logger.WithError(err).WithField("memberID", member.ID).Error("error recording failed login")
+			}
+
+			/*
+			 * Too many bad codes. Make them enter their password again.
+			 */
+			if attempts >= twoFactorLoginMaxAttempts {
+				clearTwoFactorLogin(session)
+				_ = sa.sessionStore.Save(r, w, session)
+
+				http.Redirect(w, r, SiteAuthLoginPath, http.StatusFound)
+				return
+			}
+
+			session.Values["twoFactorAttempts"] = attempts
+
+			if err = sa.sessionStore.Save(r, w, session); err != nil {
+				sa.logger.WithError(err).Error("error saving session")
+				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+				return
+			}
+
+			data.ErrorMessage = "That code is not valid. Please try again."
+			webApp.RenderTemplate(w, "login-two-factor.tmpl", data)
+			return
+		}
+
+		referer, _ := session.Values["twoFactorReferer"].(string)
+		goTo := localRedirectPath(referer)
+
+		clearTwoFactorLogin(session)
+
+		if err = sa.recordSuccessfulLogin(r, memberService, member, LoginTypeMember); err != nil {
+			sa.logger.WithError(err).WithField("memberID", member.ID).Error("error recording successful login")
+		}
+
+		if err = sa.writeMemberSession(w, r, member); err != nil {
+			sa.logger.WithError(err).Error("error saving session")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		http.Redirect(w, r, goTo, http.StatusFound)
+	}
+}
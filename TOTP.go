@@ -0,0 +1,132 @@
+package frame
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+/*
+These values match what authenticator apps (Google Authenticator, Authy,
+1Password, etc.) expect by default. See RFC 6238.
+*/
+const (
+	totpDigits     int   = 6
+	totpPeriod     int64 = 30
+	totpSkewSteps  int64 = 1
+	totpSecretSize int   = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+generateTOTPSecret returns a new random, base32 encoded TOTP secret.
+*/
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating TOTP secret: %w", err)
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+/*
+totpCode computes the code for a secret at the given time step.
+*/
+func totpCode(secret string, step int64) (string, error) {
+	var (
+		err error
+		key []byte
+	)
+
+	if key, err = totpEncoding.DecodeString(strings.ToUpper(secret)); err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits))), nil
+}
+
+/*
+validateTOTPCode returns the time step code matches the secret at, around
+time "at". One time step of clock drift is allowed in either direction.
+The step is used to make sure a code can't be used twice.
+*/
+func validateTOTPCode(secret, code string, at time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	currentStep := at.Unix() / totpPeriod
+
+	for step := currentStep - totpSkewSteps; step <= currentStep+totpSkewSteps; step++ {
+		expected, err := totpCode(secret, step)
+
+		if err != nil {
+			return 0, false
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+/*
+totpProvisioningURI builds the otpauth:// URI authenticator apps use to
+enroll a secret.
+*/
+func totpProvisioningURI(issuer, accountName, secret string) string {
+	label := url.PathEscape(issuer + ":" + accountName)
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+/*
+totpQRCodeDataURI renders a provisioning URI as a PNG QR code and returns
+it as a data URI suitable for an <img> tag.
+*/
+func totpQRCodeDataURI(provisioningURI string) (template.URL, error) {
+	var (
+		err error
+		png []byte
+	)
+
+	if png, err = qrcode.Encode(provisioningURI, qrcode.Medium, 256); err != nil {
+		return "", fmt.Errorf("error rendering TOTP QR code: %w", err)
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
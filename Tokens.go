@@ -0,0 +1,33 @@
+package frame
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+/*
+generateSecureToken returns a random, URL-safe token. Tokens like these
+are handed to members (in links, for example) and should never be stored
+as-is. Use hashToken() before writing one to the database.
+*/
+func generateSecureToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating secure token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+hashToken returns a hex encoded SHA-256 hash of a token. This is what
+gets stored and looked up in the database.
+*/
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
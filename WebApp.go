@@ -1,11 +1,17 @@
 package frame
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"net/http"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -18,40 +24,48 @@ import (
  ******************************************************************************/
 
 type InternalWebAppConfig struct {
-	AppName            string
-	AdminTemplateFS    fs.FS
-	AdminStaticFS      fs.FS
-	Debug              bool
-	Logger             *logrus.Entry
-	FrameConfig        *Config
-	InternalTemplateFS fs.FS
-	MemberService      *MemberService
-	Version            string
+	AuditLogger         *AuditLogger
+	AppName             string
+	AdminTemplateFS     fs.FS
+	AdminStaticFS       fs.FS
+	Debug               bool
+	Logger              *logrus.Entry
+	FrameConfig         *Config
+	InternalTemplateFS  fs.FS
+	LoginAttemptService *LoginAttemptService
+	MemberService       *MemberService
+	Routes              *routeRegistry
+	SessionService      *SessionService
+	Version             string
 }
 
 type WebApp struct {
-	adminStaticFS      fs.FS
-	adminTemplateFS    fs.FS
-	adminSessionName   string
-	adminSessionStore  sessions.Store
-	appName            string
-	appFS              fs.FS
-	appFolder          string
-	debug              bool
-	frameConfig        *Config
-	internalTemplateFS fs.FS
-	logger             *logrus.Entry
-	memberManagement   *MemberManagement
-	memberService      *MemberService
-	primaryLayoutName  string
-	sessionName        string
-	sessionStore       sessions.Store
-	sessionType        FrameSessionType
-	templateFS         fs.FS
-	templates          map[string]*template.Template
-	templateManifest   TemplateCollection
-	webAppConfig       *WebAppConfig
-	version            string
+	adminStaticFS       fs.FS
+	adminTemplateFS     fs.FS
+	adminSessionName    string
+	adminSessionStore   sessions.Store
+	appName             string
+	appFS               fs.FS
+	appFolder           string
+	auditLogger         *AuditLogger
+	debug               bool
+	frameConfig         *Config
+	internalTemplateFS  fs.FS
+	logger              *logrus.Entry
+	loginAttemptService *LoginAttemptService
+	memberManagement    *MemberManagement
+	memberService       *MemberService
+	primaryLayoutName   string
+	routes              *routeRegistry
+	sessionName         string
+	sessionService      *SessionService
+	sessionStore        sessions.Store
+	sessionType         FrameSessionType
+	templateFS          fs.FS
+	templates           map[string]*template.Template
+	templateManifest    TemplateCollection
+	webAppConfig        *WebAppConfig
+	version             string
 }
 
 type WebAppConfig struct {
@@ -85,23 +99,27 @@ type JavascriptIncludes []JavascriptInclude
 
 func NewWebApp(internalConfig InternalWebAppConfig, webAppConfig *WebAppConfig) *WebApp {
 	result := &WebApp{
-		adminStaticFS:      internalConfig.AdminStaticFS,
-		adminTemplateFS:    internalConfig.AdminTemplateFS,
-		appName:            internalConfig.AppName,
-		appFS:              webAppConfig.AppFS,
-		appFolder:          webAppConfig.AppFolder,
-		debug:              internalConfig.Debug,
-		frameConfig:        internalConfig.FrameConfig,
-		internalTemplateFS: internalConfig.InternalTemplateFS,
-		logger:             internalConfig.Logger,
-		memberService:      internalConfig.MemberService,
-		primaryLayoutName:  webAppConfig.PrimaryLayoutName,
-		sessionType:        webAppConfig.SessionType,
-		templateFS:         webAppConfig.TemplateFS,
-		templates:          map[string]*template.Template{},
-		templateManifest:   webAppConfig.TemplateManifest,
-		webAppConfig:       webAppConfig,
-		version:            internalConfig.Version,
+		adminStaticFS:       internalConfig.AdminStaticFS,
+		adminTemplateFS:     internalConfig.AdminTemplateFS,
+		appName:             internalConfig.AppName,
+		appFS:               webAppConfig.AppFS,
+		appFolder:           webAppConfig.AppFolder,
+		auditLogger:         internalConfig.AuditLogger,
+		debug:               internalConfig.Debug,
+		frameConfig:         internalConfig.FrameConfig,
+		internalTemplateFS:  internalConfig.InternalTemplateFS,
+		logger:              internalConfig.Logger,
+		loginAttemptService: internalConfig.LoginAttemptService,
+		memberService:       internalConfig.MemberService,
+		primaryLayoutName:   webAppConfig.PrimaryLayoutName,
+		routes:              internalConfig.Routes,
+		sessionService:      internalConfig.SessionService,
+		sessionType:         webAppConfig.SessionType,
+		templateFS:          webAppConfig.TemplateFS,
+		templates:           map[string]*template.Template{},
+		templateManifest:    webAppConfig.TemplateManifest,
+		webAppConfig:        webAppConfig,
+		version:             internalConfig.Version,
 	}
 
 	result.setupSessions()
@@ -140,10 +158,11 @@ func (wa *WebApp) GetStaticFS() fs.FS {
  ******************************************************************************/
 
 func (wa *WebApp) RegisterRoutes(router *mux.Router, adminRouter *mux.Router) {
-	router.HandleFunc("/errors/unexpected", wa.handleUnexpectedError)
+	wa.routes.public(router.HandleFunc(UnexpectedErrorPath, wa.handleUnexpectedError))
 
-	adminRouter.HandleFunc("", wa.handleAdminDashboard)
-	adminRouter.HandleFunc("/login", wa.handleAdminLogin)
+	wa.routes.admin(adminRouter.HandleFunc("", wa.handleAdminDashboard), AuthResponseHTML)
+	wa.routes.public(adminRouter.HandleFunc("/login", wa.handleAdminLogin))
+	wa.routes.admin(adminRouter.HandleFunc("/audit", wa.handleAdminAudit).Methods(http.MethodGet), AuthResponseHTML)
 }
 
 func (wa *WebApp) registerAdminTemplates() TemplateCollection {
@@ -151,6 +170,7 @@ func (wa *WebApp) registerAdminTemplates() TemplateCollection {
 	manifest = append(manifest, Template{Name: "admin-layout.tmpl", IsLayout: true})
 	manifest = append(manifest, Template{Name: "admin-login.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	manifest = append(manifest, Template{Name: "admin-dashboard.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
+	manifest = append(manifest, Template{Name: "admin-audit.tmpl", IsLayout: false, UseLayout: "admin-layout.tmpl"})
 	manifest = append(manifest, wa.memberManagement.RegisterAdminTemplate()...)
 
 	return manifest
@@ -161,6 +181,14 @@ func (wa *WebApp) registerInternalTemplates() TemplateCollection {
 	wa.templateManifest = append(wa.templateManifest, Template{Name: "login.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
 	wa.templateManifest = append(wa.templateManifest, Template{Name: "unexpected-error.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
 	wa.templateManifest = append(wa.templateManifest, Template{Name: "sign-up.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "forgot-password.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "reset-password.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "email-verification-pending.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "email-verified.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "account-unlocked.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "login-two-factor.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "login-magic-link.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
+	wa.templateManifest = append(wa.templateManifest, Template{Name: "forbidden.tmpl", IsLayout: false, UseLayout: "layout.tmpl"})
 	wa.templateManifest = append(wa.templateManifest, wa.memberManagement.RegisterTemplates()...)
 
 	return wa.templateManifest
@@ -179,6 +207,11 @@ func (wa *WebApp) setupSessions() {
 		wa.sessionName, wa.sessionStore = CookieSessions(wa.frameConfig)
 		wa.adminSessionName, wa.adminSessionStore = AdminCookieSessions(wa.frameConfig)
 	}
+
+	if wa.sessionType == DatabaseSessionType {
+		wa.sessionName, wa.sessionStore = DatabaseSessions(wa.frameConfig, wa.sessionService)
+		wa.adminSessionName, wa.adminSessionStore = AdminDatabaseSessions(wa.frameConfig, wa.sessionService)
+	}
 }
 
 /*******************************************************************************
@@ -187,7 +220,8 @@ func (wa *WebApp) setupSessions() {
 
 func (wa *WebApp) handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
-		"AppName": wa.appName,
+		"AppName":   wa.appName,
+		"CSRFToken": CSRFToken(r),
 	}
 
 	wa.RenderTemplate(w, "admin-dashboard.tmpl", data)
@@ -195,14 +229,17 @@ func (wa *WebApp) handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
 
 func (wa *WebApp) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 	var (
-		err     error
-		session *sessions.Session
+		err    error
+		member Member
+		valid  bool
+		wait   time.Duration
 	)
 
 	data := AdminLoginData{
 		BaseViewModel: BaseViewModel{
 			JavascriptIncludes: []JavascriptInclude{},
 			AppName:            wa.appName,
+			CSRFToken:          CSRFToken(r),
 			Stylesheets:        []string{},
 		},
 		Message: "",
@@ -214,40 +251,233 @@ func (wa *WebApp) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		_ = r.ParseForm()
 
-		// First, is this a root user?
-		if r.FormValue("userName") == wa.frameConfig.RootUserName && r.FormValue("password") == wa.frameConfig.RootUserPassword {
-			if session, err = wa.adminSessionStore.Get(r, wa.adminSessionName); err != nil {
-				wa.logger.WithError(err).Error("error geting session")
+		userName := r.FormValue("userName")
+		password := r.FormValue("password")
+
+		ip := RealIP(r)
+
+		logger := wa.logger.WithFields(logrus.Fields{
+			"ip":       ip,
+			"userName": userName,
+		})
+
+		if wait, err = wa.loginAttemptService.CheckLogin(userName, ip); err != nil {
+			logger.WithError(err).Error("error checking login attempts in admin login")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if wait > 0 {
+			logger.WithFields(logrus.Fields{
+				"event":      "login_throttled",
+				"loginType":  LoginTypeAdmin,
+				"retryAfter": int(wait.Seconds()),
+			}).Warn("login attempt throttled")
+
+			data.Message = "Too many failed login attempts. Please try again in " + formatRetryAfter(wait) + "."
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			wa.RenderTemplate(w, "admin-login.tmpl", data)
+			return
+		}
+
+		/*
+		 * The root user is a break-glass account. It can be turned off
+		 * with ROOT_USER_ENABLED=false.
+		 */
+		if wa.frameConfig.RootUserEnabled && wa.isRootUser(userName, password) {
+			logger.Warn("root user logged into admin")
+
+			if err = wa.loginAttemptService.RecordSuccess(userName, ip, LoginTypeAdmin); err != nil {
+				logger.WithError(err).Error("error recording successful login")
+			}
+
+			if err = wa.writeAdminSession(w, r, wa.frameConfig.RootUserName, "", 0); err != nil {
+				logger.WithError(err).Error("error saving session")
 				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
 				return
 			}
 
-			session.Values["adminUserName"] = wa.frameConfig.RootUserName
+			_ = wa.auditLogger.Record(NewAuditEvent(r, AuditActionAdminLogin, "", "").WithActor(wa.frameConfig.RootUserName, ""))
 
-			if err = wa.adminSessionStore.Save(r, w, session); err != nil {
-				wa.logger.WithError(err).Error("error saving session")
+			wa.redirectAfterAdminLogin(w, r)
+			return
+		}
+
+		/*
+		 * Otherwise admins are members with the Admin role
+		 */
+		member, err = wa.memberService.GetMemberByEmail(userName, false)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logger.WithError(err).Error("error getting member information in admin login")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+			return
+		}
+
+		if err == nil && wa.loginAttemptService.IsLocked(member) {
+			logger.WithField("memberID", member.ID).Error("locked member attempted admin login")
+			data.Message = "This account is locked because of too many failed login attempts"
+			wa.RenderTemplate(w, "admin-login.tmpl", data)
+			return
+		}
+
+		/*
+		 * Wrong passwords count towards locking the member's account
+		 */
+		if err != nil || !wa.memberService.IsPasswordCorrect(member, password) {
+			logger.Error("invalid admin login attempt")
+			wa.recordFailedAdminLogin(r, logger, userName, member)
+
+			data.Message = "Invalid user name or password"
+			wa.RenderTemplate(w, "admin-login.tmpl", data)
+			return
+		}
+
+		upgradePasswordHash(logger, wa.memberService, member, password)
+
+		if member.Role.ID != AdminMemberRoleID || member.Status.ID != MemberActiveID {
+			logger.Error("invalid admin login attempt")
+			_ = wa.auditLogger.Record(NewAuditEvent(r, AuditActionAdminLoginFailed, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+			data.Message = "Invalid user name or password"
+			wa.RenderTemplate(w, "admin-login.tmpl", data)
+			return
+		}
+
+		/*
+		 * Admins with two-factor authentication turned on must also
+		 * provide a code.
+		 */
+		if member.TotpEnabledAt != nil {
+			if valid, err = wa.memberService.VerifyMemberSecondFactor(member, r.FormValue("code")); err != nil {
+				logger.WithError(err).Error("error verifying second factor in admin login")
 				http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
 				return
 			}
 
-			goTo := r.FormValue("referer")
+			if !valid {
+				logger.Error("invalid two-factor code in admin login")
+				wa.recordFailedAdminLogin(r, logger, userName, member)
+
+				data.Message = "Please provide a valid two-factor authentication code"
+				wa.RenderTemplate(w, "admin-login.tmpl", data)
+				return
+			}
+		}
+
+		if err = wa.loginAttemptService.RecordSuccess(member.Email, ip, LoginTypeAdmin); err != nil {
+			logger.WithError(err).Error("error recording successful login")
+		}
 
-			if goTo == "" {
-				goTo = "/admin"
+		if member.LockedAt != nil {
+			if err = wa.memberService.UnlockMember(member.ID); err != nil {
+				logger.WithError(err).WithField("memberID", member.ID).Error("error clearing expired lock")
 			}
+		}
 
-			http.Redirect(w, r, goTo, http.StatusFound)
+		if err = wa.writeAdminSession(w, r, member.Email, member.ID, member.SessionEpoch); err != nil {
+			logger.WithError(err).Error("error saving session")
+			http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
 			return
 		}
 
-		// TODO: Add users from a database
+		logger.WithField("memberID", member.ID).Info("admin logged in")
+		_ = wa.auditLogger.Record(NewAuditEvent(r, AuditActionAdminLogin, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
 
-		data.Message = "Invalid user name or password"
+		wa.redirectAfterAdminLogin(w, r)
+		return
 	}
 
 	wa.RenderTemplate(w, "admin-login.tmpl", data)
 }
 
+/*
+recordFailedAdminLogin records a wrong password or two-factor code on the
+admin login page. It counts towards throttling, and members who fail too
+many times in a row are locked.
+*/
+func (wa *WebApp) recordFailedAdminLogin(r *http.Request, logger *logrus.Entry, userName string, member Member) {
+	_ = wa.auditLogger.Record(NewAuditEvent(r, AuditActionAdminLoginFailed, AuditTargetMember, member.ID).WithActor(userName, member.ID))
+
+	failures, err := wa.loginAttemptService.RecordFailure(userName, RealIP(r), LoginTypeAdmin)
+
+	if err != nil {
+		logger.WithError(err).Error("error recording failed login")
+		return
+	}
+
+	if member.ID == "" || !wa.loginAttemptService.ShouldLock(failures) || wa.loginAttemptService.IsLocked(member) {
+		return
+	}
+
+	if _, err = wa.memberService.LockMember(member.ID); err != nil {
+		logger.WithError(err).WithField("memberID", member.ID).Error("error locking member")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"event":     "account_locked",
+		"memberID":  member.ID,
+		"loginType": LoginTypeAdmin,
+		"failures":  failures,
+	}).Warn("member account locked after too many failed logins")
+
+	_ = wa.auditLogger.Record(NewAuditEvent(r, AuditActionAccountLocked, AuditTargetMember, member.ID).WithActor(member.Email, member.ID))
+}
+
+/*
+isRootUser compares credentials against the configured root user. The
+comparison is constant time so it doesn't leak how much of the password
+matched.
+*/
+func (wa *WebApp) isRootUser(userName, password string) bool {
+	if wa.frameConfig.RootUserPassword == "" {
+		return false
+	}
+
+	userNameMatches := subtle.ConstantTimeCompare([]byte(userName), []byte(wa.frameConfig.RootUserName))
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(wa.frameConfig.RootUserPassword))
+
+	return userNameMatches&passwordMatches == 1
+}
+
+func (wa *WebApp) writeAdminSession(w http.ResponseWriter, r *http.Request, adminUserName, adminMemberID string, sessionEpoch int) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = wa.adminSessionStore.Get(r, wa.adminSessionName); err != nil {
+		return fmt.Errorf("error getting admin session: %w", err)
+	}
+
+	if store, ok := wa.adminSessionStore.(*DatabaseSessionStore); ok {
+		if err = store.renewSessionID(session); err != nil {
+			return fmt.Errorf("error renewing admin session: %w", err)
+		}
+	}
+
+	session.Values["adminUserName"] = adminUserName
+	session.Values["adminMemberID"] = adminMemberID
+	session.Values["adminSessionEpoch"] = sessionEpoch
+
+	if _, err = renewCSRFToken(session); err != nil {
+		return fmt.Errorf("error renewing csrf token: %w", err)
+	}
+
+	return wa.adminSessionStore.Save(r, w, session)
+}
+
+func (wa *WebApp) redirectAfterAdminLogin(w http.ResponseWriter, r *http.Request) {
+	goTo := "/admin"
+
+	if referer := r.FormValue("referer"); referer != "" {
+		goTo = localRedirectPath(referer)
+	}
+
+	http.Redirect(w, r, goTo, http.StatusFound)
+}
+
 /*
 GET /errors/unexpected
 */
@@ -259,6 +489,14 @@ func (wa *WebApp) handleUnexpectedError(w http.ResponseWriter, r *http.Request)
  * Templates
  ******************************************************************************/
 
+func (wa *WebApp) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"HasPermission": PermissionSet.Has,
+		"IsSet":         wa.templateFuncIsSet,
+		"csrfField":     templateFuncCSRFField,
+	}
+}
+
 func (wa *WebApp) templateFuncIsSet(name string, data interface{}) bool {
 	v := reflect.ValueOf(data)
 
@@ -298,9 +536,7 @@ func (wa *WebApp) setupTemplateEngine() {
 	wa.templateFS = mergefs.Merge(wa.templateFS, wa.internalTemplateFS)
 	wa.templateManifest = wa.registerInternalTemplates()
 
-	templateFuncs := template.FuncMap{
-		"IsSet": wa.templateFuncIsSet,
-	}
+	templateFuncs := wa.templateFuncs()
 
 	for _, tmplDefinition = range wa.templateManifest {
 		var parsedTemplate *template.Template
@@ -344,6 +580,7 @@ func (wa *WebApp) setupAdminTemplates() {
 	)
 
 	manifest := wa.registerAdminTemplates()
+	templateFuncs := wa.templateFuncs()
 
 	for _, tmplDefinition = range manifest {
 		var parsedTemplate *template.Template
@@ -352,11 +589,11 @@ func (wa *WebApp) setupAdminTemplates() {
 		layoutPath := filepath.Join("admin-templates", tmplDefinition.UseLayout)
 
 		if tmplDefinition.IsLayout {
-			if parsedTemplate, err = template.ParseFS(wa.adminTemplateFS, tmplPath); err != nil {
+			if parsedTemplate, err = template.New(tmplDefinition.Name).Funcs(templateFuncs).ParseFS(wa.adminTemplateFS, tmplPath); err != nil {
 				wa.logger.WithError(err).Fatalf("error parsing admin layout '%s'. shutting down", tmplDefinition.Name)
 			}
 		} else {
-			if parsedTemplate, err = template.ParseFS(wa.adminTemplateFS, tmplPath, layoutPath); err != nil {
+			if parsedTemplate, err = template.New(tmplDefinition.Name).Funcs(templateFuncs).ParseFS(wa.adminTemplateFS, tmplPath, layoutPath); err != nil {
 				wa.logger.WithError(err).Fatalf("error parsing admin template '%s' with layout '%s'. shutting down", tmplDefinition.Name, tmplDefinition.UseLayout)
 			}
 		}
@@ -1,4 +1,5 @@
-import { fetcher, PopupMenu } from "../frame.min.js";
+import { fetcher } from "../fetcher.js";
+import { PopupMenu } from "../frame.min.js";
 import { PendingApproval, Active, Inactive } from "../constants/member-constants.js";
 
 export default class MembersTable extends HTMLElement {
@@ -7,6 +8,7 @@ export default class MembersTable extends HTMLElement {
 
     this._tbody = null;
     this._page = 1;
+    this._includeDeleted = false;
   }
 
   async connectedCallback() {
@@ -39,6 +41,7 @@ export default class MembersTable extends HTMLElement {
     const th3 = document.createElement("th");
     const th4 = document.createElement("th");
     const th5 = document.createElement("th");
+    const th6 = document.createElement("th");
 
     th0.setAttribute("scope", "col");
     th0.innerText = "Role";
@@ -56,7 +59,10 @@ export default class MembersTable extends HTMLElement {
     th4.innerText = "Status";
 
     th5.setAttribute("scope", "col");
-    th5.innerHTML = `<span class="sr-only">Actions</span>`;
+    th5.innerText = "Email Verified";
+
+    th6.setAttribute("scope", "col");
+    th6.innerHTML = `<span class="sr-only">Actions</span>`;
 
     tr.insertAdjacentElement("beforeend", th0);
     tr.insertAdjacentElement("beforeend", th1);
@@ -64,6 +70,7 @@ export default class MembersTable extends HTMLElement {
     tr.insertAdjacentElement("beforeend", th3);
     tr.insertAdjacentElement("beforeend", th4);
     tr.insertAdjacentElement("beforeend", th5);
+    tr.insertAdjacentElement("beforeend", th6);
 
     head.insertAdjacentElement("beforeend", tr);
     return head;
@@ -88,7 +95,7 @@ export default class MembersTable extends HTMLElement {
       const td = document.createElement("td");
 
       td.setAttribute("scope", "row");
-      td.setAttribute("colspan", "6");
+      td.setAttribute("colspan", "7");
       td.innerText = `No member records`;
 
       tr.insertAdjacentElement("beforeend", td);
@@ -103,6 +110,7 @@ export default class MembersTable extends HTMLElement {
       const td3 = document.createElement("td");
       const td4 = document.createElement("td");
       const td5 = document.createElement("td");
+      const td6 = document.createElement("td");
       const buttons = this.createActionButtons(member);
 
       td0.innerHTML = `<span class="member-table-role-block" style="background-color: ${member.role.color};" title="Role: ${member.role.role}"><span class="sr-only">Role: ${member.role.role}</span></span>`;
@@ -110,10 +118,11 @@ export default class MembersTable extends HTMLElement {
       th1.innerText = `${member.firstName} ${member.lastName}`;
       td2.innerText = member.email;
       td3.innerText = dayjs(member.CreatedAt).format("MMM D, YYYY");
-      td4.innerText = member.memberStatus.status;
+      td4.innerText = this.memberStatusText(member);
+      td5.innerText = member.emailVerifiedAt ? dayjs(member.emailVerifiedAt).format("MMM D, YYYY") : "Not verified";
 
       buttons.forEach(button => {
-        td5.insertAdjacentElement("beforeend", button);
+        td6.insertAdjacentElement("beforeend", button);
       });
 
       tr.insertAdjacentElement("beforeend", td0);
@@ -122,6 +131,7 @@ export default class MembersTable extends HTMLElement {
       tr.insertAdjacentElement("beforeend", td3);
       tr.insertAdjacentElement("beforeend", td4);
       tr.insertAdjacentElement("beforeend", td5);
+      tr.insertAdjacentElement("beforeend", td6);
 
       result.push(tr);
     });
@@ -142,24 +152,20 @@ export default class MembersTable extends HTMLElement {
     const popup = document.createElement("popup-menu");
     popup.setAttribute("trigger", `#${buttonID}`);
 
-    let menuItems = [
-      { id: `member-edit-button-${member.id}`, text: `Edit`, icon: "icon--mdi icon--mdi--pencil", handler: () => { this.onEditMemberClick(member.id); } },
-    ];
-
-    if (member.memberStatus.id === PendingApproval) {
-      menuItems.push({ id: `member-status-button-${member.id}`, text: `Approve`, icon: "icon--mdi icon--mdi--check", handler: () => { this.onActionButtonClick(member); } });
-    }
+    let menuItems = [];
 
-    if (member.memberStatus.id === Inactive) {
-      menuItems.push({ id: `member-status-button-${member.id}`, text: `Inactivate`, icon: "icon--mdi icon--mdi--minus", handler: () => { this.onActionButtonClick(member); } });
+    if (member.deletedAt) {
+      if (!member.anonymizedAt) {
+        menuItems.push({ id: `member-purge-button-${member.id}`, text: `Purge`, icon: "icon--mdi icon--mdi--close", handler: () => { this.onPurgeButtonClick(member); } });
+      }
+    } else {
+      menuItems = this.createActiveMemberMenuItems(member);
     }
 
-    if (member.memberStatus.id === Inactive) {
-      menuItems.push({ id: `member-status-button-${member.id}`, text: `Activate`, icon: "icon--mdi icon--mdi--check", handler: () => { this.onActionButtonClick(member); } });
+    if (menuItems.length === 0) {
+      return [];
     }
 
-    menuItems.push({ id: `member-delete-button-${member.id}`, text: `Delete`, icon: "icon--mdi icon--mdi--delete", handler: () => { this.onDeleteButtonClick(member); } });
-
     menuItems.forEach(data => {
       const menuItem = document.createElement("popup-menu-item");
       menuItem.setAttribute("id", data.id);
@@ -174,6 +180,8 @@ export default class MembersTable extends HTMLElement {
         this.onEditMemberClick.call(this, member.id);
       } else if (e.detail.id === `member-delete-button-${member.id}`) {
         this.onDeleteButtonClick.call(this, member);
+      } else if (e.detail.id === `member-purge-button-${member.id}`) {
+        this.onPurgeButtonClick.call(this, member);
       } else {
         this.onActionButtonClick.call(this, member)
       }
@@ -182,6 +190,44 @@ export default class MembersTable extends HTMLElement {
     return [button, popup];
   }
 
+  createActiveMemberMenuItems(member) {
+    let menuItems = [
+      { id: `member-edit-button-${member.id}`, text: `Edit`, icon: "icon--mdi icon--mdi--pencil", handler: () => { this.onEditMemberClick(member.id); } },
+    ];
+
+    if (member.memberStatus.id === PendingApproval) {
+      menuItems.push({ id: `member-status-button-${member.id}`, text: `Approve`, icon: "icon--mdi icon--mdi--check", handler: () => { this.onActionButtonClick(member); } });
+    }
+
+    if (member.memberStatus.id === Inactive) {
+      menuItems.push({ id: `member-status-button-${member.id}`, text: `Inactivate`, icon: "icon--mdi icon--mdi--minus", handler: () => { this.onActionButtonClick(member); } });
+    }
+
+    if (member.memberStatus.id === Inactive) {
+      menuItems.push({ id: `member-status-button-${member.id}`, text: `Activate`, icon: "icon--mdi icon--mdi--check", handler: () => { this.onActionButtonClick(member); } });
+    }
+
+    menuItems.push({ id: `member-delete-button-${member.id}`, text: `Delete`, icon: "icon--mdi icon--mdi--delete", handler: () => { this.onDeleteButtonClick(member); } });
+    return menuItems;
+  }
+
+  memberStatusText(member) {
+    if (member.anonymizedAt) {
+      return "Purged";
+    }
+
+    if (member.deletedAt) {
+      return "Deleted";
+    }
+
+    return member.memberStatus.status;
+  }
+
+  setIncludeDeleted(includeDeleted) {
+    this._includeDeleted = includeDeleted;
+    this.rerenderBody();
+  }
+
   async getMembers() {
     const options = {
       method: "GET",
@@ -190,7 +236,8 @@ export default class MembersTable extends HTMLElement {
       },
     };
 
-    const response = await fetcher(`/admin/api/members?page=${this._page}`, options);
+    const deleted = this._includeDeleted ? "&deleted=true" : "";
+    const response = await fetcher(`/admin/api/members?page=${this._page}${deleted}`, options);
     const result = await response.json();
     return result;
   }
@@ -259,6 +306,29 @@ export default class MembersTable extends HTMLElement {
     this.rerenderBody();
   }
 
+  async onPurgeButtonClick(member) {
+    const confirmation = await window.confirm.yesNo("Are you sure you wish to purge this member? Their name, email address, and avatar will be permanently removed.");
+
+    if (!confirmation) {
+      return;
+    }
+
+    const options = {
+      method: "PUT",
+    };
+
+    const response = await fetcher(`/admin/api/member/purge/${member.id}`, options, window.spinner);
+    const result = await response.json();
+
+    if (!response.ok) {
+      window.alert.error(result.message);
+      return;
+    }
+
+    window.alert.success("Member purged.");
+    this.rerenderBody();
+  }
+
   async activateMember(member) {
     const data = new URLSearchParams();
     data.set("id", member.id);
@@ -1,4 +1,4 @@
-import { fetcher } from "../frame.min.js";
+import { fetcher } from "../fetcher.js";
 
 export default class RoleSelector extends HTMLElement {
   constructor() {
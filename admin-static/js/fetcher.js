@@ -0,0 +1,19 @@
+import { fetcher as frameFetcher } from "./frame.min.js";
+
+/**
+ * Wraps the Frame fetcher and adds the CSRF token from the page's
+ * csrf-token meta tag to every request. The server rejects POST, PUT,
+ * and DELETE requests that don't send it.
+ * @param {string} url The URL to fetch
+ * @param {object} options The fetch options
+ * @param {object} spinner The spinner element to show
+ * @param {number} msBeforeShowSpinner The number of milliseconds to wait before showing the spinner. Default is 1000
+ * @returns {Promise<object>} A promise that resolves to the fetch response
+ */
+export async function fetcher(url, options = {}, spinner, msBeforeShowSpinner = 1000) {
+  const token = document.querySelector(`meta[name="csrf-token"]`)?.getAttribute("content") || "";
+  const headers = new Headers(options.headers || {});
+
+  headers.set("X-CSRF-Token", token);
+  return frameFetcher(url, { ...options, headers }, spinner, msBeforeShowSpinner);
+}
@@ -1,7 +1,18 @@
+import { fetcher } from "../fetcher.js";
 import RoleSelector from "../components/role-selector.js";
 
 document.addEventListener("DOMContentLoaded", () => {
   document.querySelector("#cancel").addEventListener("click", onCancelClick);
+  document.querySelector("#resetTwoFactor")?.addEventListener("click", onResetTwoFactorClick);
+  document.querySelector("#unlockAccount")?.addEventListener("click", onUnlockAccountClick);
+  document.querySelector("#impersonate")?.addEventListener("click", onImpersonateClick);
+  document.querySelector("#revokeAllSessions")?.addEventListener("click", onRevokeAllSessionsClick);
+
+  const sessionsEl = document.querySelector("#memberSessions");
+
+  if (sessionsEl) {
+    renderSessions();
+  }
 
   /*
    * Event handlers
@@ -9,4 +20,148 @@ document.addEventListener("DOMContentLoaded", () => {
   function onCancelClick() {
     window.location = "/admin/members/manage";
   }
+
+  async function onResetTwoFactorClick(e) {
+    const confirmation = await window.confirm.yesNo("Are you sure you wish to reset two-factor authentication for this member? They will be able to log in with only their password.");
+
+    if (!confirmation) {
+      return;
+    }
+
+    const options = {
+      method: "PUT",
+    };
+
+    const response = await fetcher(`/admin/api/member/reset-two-factor/${e.target.dataset.memberId}`, options, window.spinner);
+    const result = await response.json();
+
+    if (!response.ok) {
+      window.alert.error(result.message);
+      return;
+    }
+
+    window.alert.success("Two-factor authentication reset.");
+    document.querySelector("#twoFactorStatus").innerText = "Not enabled";
+  }
+
+  async function onUnlockAccountClick(e) {
+    const options = {
+      method: "PUT",
+    };
+
+    const response = await fetcher(`/admin/api/member/unlock/${e.target.dataset.memberId}`, options, window.spinner);
+    const result = await response.json();
+
+    if (!response.ok) {
+      window.alert.error(result.message);
+      return;
+    }
+
+    window.alert.success("Account unlocked.");
+    document.querySelector("#lockStatus").innerText = "Unlocked";
+  }
+
+  async function onImpersonateClick(e) {
+    const confirmation = await window.confirm.yesNo("Are you sure you wish to impersonate this member? This will be recorded.");
+
+    if (!confirmation) {
+      return;
+    }
+
+    const options = {
+      method: "PUT",
+    };
+
+    const response = await fetcher(`/admin/api/member/impersonate/${e.target.dataset.memberId}`, options, window.spinner);
+    const result = await response.json();
+
+    if (!response.ok) {
+      window.alert.error(result.message);
+      return;
+    }
+
+    window.location = "/";
+  }
+
+  async function onRevokeAllSessionsClick() {
+    const confirmation = await window.confirm.yesNo("Are you sure you wish to log this member out of every device?");
+
+    if (!confirmation) {
+      return;
+    }
+
+    await revokeSessions(`/admin/api/member/sessions/${sessionsEl.dataset.memberId}`, "Member logged out everywhere.");
+  }
+
+  async function onRevokeSessionClick(session) {
+    const confirmation = await window.confirm.yesNo("Are you sure you wish to end this session?");
+
+    if (!confirmation) {
+      return;
+    }
+
+    await revokeSessions(`/admin/api/member/sessions/${sessionsEl.dataset.memberId}/${session.id}`, "Session ended.");
+  }
+
+  /*
+   * Sessions
+   */
+  async function revokeSessions(url, successMessage) {
+    const options = {
+      method: "DELETE",
+    };
+
+    const response = await fetcher(url, options, window.spinner);
+    const result = await response.json();
+
+    if (!response.ok) {
+      window.alert.error(result.message);
+      return;
+    }
+
+    window.alert.success(successMessage);
+    renderSessions();
+  }
+
+  async function renderSessions() {
+    const response = await fetcher(`/admin/api/member/sessions/${sessionsEl.dataset.memberId}`, { method: "GET" });
+    const sessions = await response.json();
+
+    sessionsEl.innerHTML = "";
+
+    if (!response.ok) {
+      window.alert.error(sessions.message);
+      return;
+    }
+
+    if (sessions.length === 0) {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `<td colspan="4">No active sessions</td>`;
+      sessionsEl.insertAdjacentElement("beforeend", tr);
+      return;
+    }
+
+    sessions.forEach(session => {
+      const tr = document.createElement("tr");
+
+      const td0 = document.createElement("td");
+      td0.innerText = dayjs(session.updatedAt).format("YYYY-MM-DD h:mm A");
+
+      const td1 = document.createElement("td");
+      td1.innerText = session.ipAddress;
+
+      const td2 = document.createElement("td");
+      td2.innerText = session.userAgent;
+
+      const td3 = document.createElement("td");
+      const button = document.createElement("button");
+      button.type = "button";
+      button.innerText = "End Session";
+      button.addEventListener("click", () => onRevokeSessionClick(session));
+      td3.insertAdjacentElement("beforeend", button);
+
+      tr.append(td0, td1, td2, td3);
+      sessionsEl.insertAdjacentElement("beforeend", tr);
+    });
+  }
 });
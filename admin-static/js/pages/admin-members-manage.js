@@ -1,4 +1,7 @@
 import MembersTable from "../components/members-table.js";
 
 document.addEventListener("DOMContentLoaded", async () => {
+  document.querySelector("#showDeleted").addEventListener("change", e => {
+    document.querySelector("members-table").setIncludeDeleted(e.target.checked);
+  });
 });
@@ -0,0 +1,21 @@
+BEGIN;
+
+--
+-- Member Tokens. These are single-use, expiring tokens issued to members
+-- for things like password resets. Only a hash of the token is stored.
+--
+CREATE TABLE IF NOT EXISTS public.member_tokens (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone NOT NULL,
+	used_at timestamp without time zone,
+	member_id uuid NOT NULL references public.members(id),
+	purpose character varying NOT NULL,
+	token_hash character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_member_tokens_token_hash ON public.member_tokens (token_hash);
+CREATE INDEX idx_member_tokens_member_id ON public.member_tokens (member_id);
+
+COMMIT;
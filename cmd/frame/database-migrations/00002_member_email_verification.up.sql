@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS email_verified_at timestamp without time zone;
+
+COMMIT;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.member_recovery_codes;
+ALTER TABLE public.members DROP COLUMN IF EXISTS totp_enabled_at;
+ALTER TABLE public.members DROP COLUMN IF EXISTS totp_secret;
@@ -0,0 +1,21 @@
+BEGIN;
+
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS totp_secret character varying NOT NULL DEFAULT '';
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp without time zone;
+
+--
+-- Member Recovery Codes. One-time codes a member can use in place of an
+-- authenticator app code. Only a hash of each code is stored.
+--
+CREATE TABLE IF NOT EXISTS public.member_recovery_codes (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	used_at timestamp without time zone,
+	member_id uuid NOT NULL references public.members(id),
+	code_hash character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX idx_member_recovery_codes_member_id ON public.member_recovery_codes (member_id);
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+--
+-- Sessions. Used when a web app is configured with DatabaseSessionType.
+-- The session cookie only holds a random token. Only a hash of it is stored.
+--
+CREATE TABLE IF NOT EXISTS public.sessions (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	updated_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone NOT NULL,
+	session_name character varying NOT NULL,
+	token_hash character varying NOT NULL,
+	member_id uuid references public.members(id),
+	ip_address character varying NOT NULL,
+	user_agent character varying NOT NULL,
+	data bytea NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_sessions_token_hash ON public.sessions (token_hash);
+CREATE INDEX idx_sessions_member_id ON public.sessions (member_id);
+CREATE INDEX idx_sessions_expires_at ON public.sessions (expires_at);
+
+COMMIT;
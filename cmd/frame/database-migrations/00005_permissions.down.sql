@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.member_role_permissions;
+DROP TABLE IF EXISTS public.permissions;
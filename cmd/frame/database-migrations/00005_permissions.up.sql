@@ -0,0 +1,26 @@
+BEGIN;
+
+--
+-- Permissions. Names are registered by the application at startup, for
+-- example "invoices.write". Roles are granted permissions through
+-- member_role_permissions. The Admin role always has every permission.
+--
+CREATE TABLE IF NOT EXISTS public.permissions (
+	id serial,
+	created_at timestamp without time zone NOT NULL,
+	updated_at timestamp without time zone,
+	name character varying NOT NULL,
+	description character varying NOT NULL DEFAULT '',
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_permissions_name ON public.permissions (name);
+
+CREATE TABLE IF NOT EXISTS public.member_role_permissions (
+	role_id bigint NOT NULL references public.member_roles(id) ON DELETE CASCADE,
+	permission_id bigint NOT NULL references public.permissions(id) ON DELETE CASCADE,
+	created_at timestamp without time zone NOT NULL,
+	PRIMARY KEY(role_id, permission_id)
+);
+
+COMMIT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.member_api_tokens;
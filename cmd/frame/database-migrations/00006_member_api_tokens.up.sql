@@ -0,0 +1,26 @@
+BEGIN;
+
+--
+-- Member API Tokens. Personal access tokens members create to call APIs
+-- with an "Authorization: Bearer" header. Only a hash of the token is
+-- stored. token_prefix is kept so members can tell their tokens apart.
+-- scopes is a space separated list.
+--
+CREATE TABLE IF NOT EXISTS public.member_api_tokens (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone,
+	last_used_at timestamp without time zone,
+	revoked_at timestamp without time zone,
+	member_id uuid NOT NULL references public.members(id),
+	name character varying NOT NULL,
+	scopes character varying NOT NULL DEFAULT '',
+	token_prefix character varying NOT NULL,
+	token_hash character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_member_api_tokens_token_hash ON public.member_api_tokens (token_hash);
+CREATE INDEX idx_member_api_tokens_member_id ON public.member_api_tokens (member_id);
+
+COMMIT;
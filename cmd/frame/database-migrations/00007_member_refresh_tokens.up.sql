@@ -0,0 +1,25 @@
+BEGIN;
+
+--
+-- Member Refresh Tokens. Issued to SPA and mobile clients alongside a JWT
+-- access token. Each refresh token can be used once. Using it issues a new
+-- token in the same family. If a used token is presented again the whole
+-- family is revoked. Only a hash of the token is stored.
+--
+CREATE TABLE IF NOT EXISTS public.member_refresh_tokens (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone NOT NULL,
+	used_at timestamp without time zone,
+	revoked_at timestamp without time zone,
+	member_id uuid NOT NULL references public.members(id),
+	family_id uuid NOT NULL,
+	token_hash character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_member_refresh_tokens_token_hash ON public.member_refresh_tokens (token_hash);
+CREATE INDEX idx_member_refresh_tokens_member_id ON public.member_refresh_tokens (member_id);
+CREATE INDEX idx_member_refresh_tokens_family_id ON public.member_refresh_tokens (family_id);
+
+COMMIT;
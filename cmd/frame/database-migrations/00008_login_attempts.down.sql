@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.login_attempts;
+ALTER TABLE public.members DROP COLUMN IF EXISTS locked_at;
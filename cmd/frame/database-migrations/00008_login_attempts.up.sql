@@ -0,0 +1,22 @@
+BEGIN;
+
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS locked_at timestamp without time zone;
+
+--
+-- Login Attempts. Every member, admin, and API login attempt is recorded
+-- so repeated failures can be throttled by account and by IP address.
+--
+CREATE TABLE IF NOT EXISTS public.login_attempts (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	email character varying NOT NULL,
+	ip_address character varying NOT NULL,
+	login_type character varying NOT NULL,
+	succeeded boolean NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX idx_login_attempts_email_created_at ON public.login_attempts (email, created_at);
+CREATE INDEX idx_login_attempts_ip_address_created_at ON public.login_attempts (ip_address, created_at);
+
+COMMIT;
@@ -0,0 +1 @@
+ALTER TABLE public.members DROP COLUMN IF EXISTS session_epoch;
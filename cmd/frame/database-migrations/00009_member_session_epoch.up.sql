@@ -0,0 +1,10 @@
+BEGIN;
+
+--
+-- Session epoch. Bumped whenever a member changes so sessions created
+-- before the change are reloaded, or ended if the member can no longer
+-- log in.
+--
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS session_epoch integer NOT NULL DEFAULT 0;
+
+COMMIT;
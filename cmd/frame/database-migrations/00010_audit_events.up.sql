@@ -0,0 +1,26 @@
+BEGIN;
+
+--
+-- Audit Events. Admin actions and security events, such as logins and
+-- lockouts. Changes holds the fields that changed, as
+-- { "field": { "before": ..., "after": ... } }.
+--
+CREATE TABLE IF NOT EXISTS public.audit_events (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	action character varying NOT NULL,
+	actor character varying NOT NULL DEFAULT '',
+	actor_member_id character varying NOT NULL DEFAULT '',
+	changes jsonb NOT NULL DEFAULT '{}'::jsonb,
+	ip_address character varying NOT NULL DEFAULT '',
+	target_id character varying NOT NULL DEFAULT '',
+	target_type character varying NOT NULL DEFAULT '',
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX idx_audit_events_created_at ON public.audit_events (created_at);
+CREATE INDEX idx_audit_events_action_created_at ON public.audit_events (action, created_at);
+CREATE INDEX idx_audit_events_actor ON public.audit_events (actor);
+CREATE INDEX idx_audit_events_target ON public.audit_events (target_type, target_id);
+
+COMMIT;
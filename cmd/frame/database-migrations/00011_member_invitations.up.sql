@@ -0,0 +1,25 @@
+BEGIN;
+
+--
+-- Member Invitations. Admins invite people by email. Accepting an
+-- invitation creates an active member with the invitation's role. Only a
+-- hash of the token is stored.
+--
+CREATE TABLE IF NOT EXISTS public.member_invitations (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone NOT NULL,
+	accepted_at timestamp without time zone,
+	revoked_at timestamp without time zone,
+	email character varying NOT NULL,
+	invited_by character varying NOT NULL DEFAULT '',
+	member_id uuid references public.members(id),
+	role_id bigint NOT NULL references public.member_roles(id),
+	token_hash character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_member_invitations_token_hash ON public.member_invitations (token_hash);
+CREATE INDEX idx_member_invitations_email ON public.member_invitations (email);
+
+COMMIT;
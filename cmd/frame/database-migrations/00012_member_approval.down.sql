@@ -0,0 +1,2 @@
+ALTER TABLE public.members DROP COLUMN IF EXISTS approved_by;
+ALTER TABLE public.members DROP COLUMN IF EXISTS approved_at;
@@ -0,0 +1,11 @@
+BEGIN;
+
+--
+-- Member approval. Records when a member was approved, and by whom. That
+-- is an approval policy ("policy:auto-approve"), an admin
+-- ("admin:someone@example.com"), or an invitation.
+--
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS approved_at timestamp without time zone;
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS approved_by character varying NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_members_deleted_at;
+ALTER TABLE public.members DROP COLUMN IF EXISTS anonymized_at;
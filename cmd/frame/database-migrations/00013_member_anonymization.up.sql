@@ -0,0 +1,11 @@
+BEGIN;
+
+--
+-- Member anonymization. Deleted members have their personal information
+-- scrubbed once the account deletion grace period is over.
+--
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS anonymized_at timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS idx_members_deleted_at ON public.members (deleted_at);
+
+COMMIT;
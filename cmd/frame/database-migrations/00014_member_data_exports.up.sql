@@ -0,0 +1,23 @@
+BEGIN;
+
+--
+-- Member Data Exports. Archives of everything stored about a member, built
+-- in the background when they ask for a copy of their data. Only a hash of
+-- the download token is stored. Archive is NULL until the export is built.
+--
+CREATE TABLE IF NOT EXISTS public.member_data_exports (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	expires_at timestamp without time zone NOT NULL,
+	completed_at timestamp without time zone,
+	member_id uuid NOT NULL references public.members(id),
+	token_hash character varying NOT NULL,
+	archive bytea,
+	PRIMARY KEY(id)
+);
+
+CREATE UNIQUE INDEX idx_member_data_exports_token_hash ON public.member_data_exports (token_hash);
+CREATE INDEX idx_member_data_exports_member_id ON public.member_data_exports (member_id);
+CREATE INDEX idx_member_data_exports_expires_at ON public.member_data_exports (expires_at);
+
+COMMIT;
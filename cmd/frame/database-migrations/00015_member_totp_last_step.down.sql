@@ -0,0 +1 @@
+ALTER TABLE public.members DROP COLUMN IF EXISTS totp_last_step;
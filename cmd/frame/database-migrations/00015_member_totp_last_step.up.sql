@@ -0,0 +1,9 @@
+BEGIN;
+
+--
+-- Last TOTP time step each member used. Codes from that step or earlier
+-- are rejected so a code can't be replayed while it is still valid.
+--
+ALTER TABLE public.members ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.magic_link_requests;
@@ -0,0 +1,18 @@
+BEGIN;
+
+--
+-- Magic Link Requests. Every request for a magic link is recorded so
+-- sends can be limited by email address and by IP address.
+--
+CREATE TABLE IF NOT EXISTS public.magic_link_requests (
+	id uuid DEFAULT uuid_generate_v4(),
+	created_at timestamp without time zone NOT NULL,
+	email character varying NOT NULL,
+	ip_address character varying NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX idx_magic_link_requests_email_created_at ON public.magic_link_requests (email, created_at);
+CREATE INDEX idx_magic_link_requests_ip_address_created_at ON public.magic_link_requests (ip_address, created_at);
+
+COMMIT;
@@ -98,6 +98,38 @@ func main() {
 		{Source: "templates/gitignore", Dest: fmt.Sprintf("%s/.gitignore", ctx.AppName)},
 		{Source: "database-migrations/00000_init.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00000_init.down.sql", ctx.AppName)},
 		{Source: "database-migrations/00000_init.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00000_init.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00001_member_tokens.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00001_member_tokens.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00001_member_tokens.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00001_member_tokens.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00002_member_email_verification.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00002_member_email_verification.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00002_member_email_verification.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00002_member_email_verification.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00003_member_two_factor.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00003_member_two_factor.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00003_member_two_factor.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00003_member_two_factor.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00004_sessions.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00004_sessions.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00004_sessions.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00004_sessions.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00005_permissions.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00005_permissions.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00005_permissions.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00005_permissions.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00006_member_api_tokens.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00006_member_api_tokens.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00006_member_api_tokens.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00006_member_api_tokens.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00007_member_refresh_tokens.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00007_member_refresh_tokens.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00007_member_refresh_tokens.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00007_member_refresh_tokens.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00008_login_attempts.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00008_login_attempts.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00008_login_attempts.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00008_login_attempts.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00009_member_session_epoch.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00009_member_session_epoch.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00009_member_session_epoch.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00009_member_session_epoch.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00010_audit_events.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00010_audit_events.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00010_audit_events.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00010_audit_events.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00011_member_invitations.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00011_member_invitations.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00011_member_invitations.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00011_member_invitations.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00012_member_approval.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00012_member_approval.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00012_member_approval.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00012_member_approval.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00013_member_anonymization.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00013_member_anonymization.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00013_member_anonymization.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00013_member_anonymization.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00014_member_data_exports.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00014_member_data_exports.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00014_member_data_exports.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00014_member_data_exports.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00015_member_totp_last_step.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00015_member_totp_last_step.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00015_member_totp_last_step.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00015_member_totp_last_step.up.sql", ctx.AppName)},
+		{Source: "database-migrations/00016_magic_link_requests.down.sql", Dest: fmt.Sprintf("%s/database-migrations/00016_magic_link_requests.down.sql", ctx.AppName)},
+		{Source: "database-migrations/00016_magic_link_requests.up.sql", Dest: fmt.Sprintf("%s/database-migrations/00016_magic_link_requests.up.sql", ctx.AppName)},
 		{Source: "templates/jsconfig.json", Dest: fmt.Sprintf("%s/jsconfig.json", ctx.AppName)},
 		{Source: "templates/base-layout", Dest: fmt.Sprintf("%s/frontend-templates/layout.tmpl", ctx.AppName)},
 		{Source: "templates/base.min.css", Dest: fmt.Sprintf("%s/app/static/css/base.min.css", ctx.AppName)},
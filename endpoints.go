@@ -13,14 +13,31 @@ import (
 
 /*
 Endpoint defines a single HTTP endpoint. Each endpoint is used
-to configure a Gorilla Mux route.
+to configure a Gorilla Mux route. If RequiredRoles is set only
+members with one of those roles may call the endpoint. On AuthAdmin
+endpoints the admin's role is checked. If RequiredPermissions is set members must have all of those
+permissions. Set SkipCSRF for endpoints that receive posts from other
+sites, such as webhooks.
+
+Auth declares who may call the endpoint: AuthPublic, AuthMember, or
+AuthAdmin. AuthResponse picks whether visitors who may not are redirected
+to a login page (AuthResponseHTML) or get a JSON 401 (AuthResponseJSON).
+Endpoints without an Auth level fall back to the site auth
+PathsExcludedFromAuth and HtmlPaths lists.
+
+	{Path: "/reports", Methods: []string{http.MethodGet}, HandlerFunc: handleReports, Auth: frame.AuthMember, AuthResponse: frame.AuthResponseHTML}
 */
 type Endpoint struct {
-	Path           string
-	Methods        []string
-	HandlerFunc    http.HandlerFunc
-	Handler        http.Handler
-	MiddlewareFunc mux.MiddlewareFunc
+	Path                string
+	Methods             []string
+	HandlerFunc         http.HandlerFunc
+	Handler             http.Handler
+	MiddlewareFunc      mux.MiddlewareFunc
+	RequiredRoles       []string
+	RequiredPermissions []string
+	SkipCSRF            bool
+	Auth                AuthLevel
+	AuthResponse        AuthResponse
 }
 
 /*
@@ -83,20 +100,53 @@ func (fa *FrameApplication) SetupEndpoints(endpoints Endpoints) *FrameApplicatio
 	for _, e := range endpoints {
 		if fa.Config.Debug {
 			fa.Logger.WithFields(logrus.Fields{
-				"path":    e.Path,
-				"methods": e.Methods,
+				"path":          e.Path,
+				"methods":       e.Methods,
+				"requiredRoles": e.RequiredRoles,
+				"permissions":   e.RequiredPermissions,
+				"skipCSRF":      e.SkipCSRF,
+				"auth":          e.Auth,
 			}).Info("registering endpoint")
 		}
 
+		handler := e.Handler
+
 		if e.HandlerFunc != nil {
+			handler = e.HandlerFunc
+
 			if e.MiddlewareFunc != nil {
-				h := e.MiddlewareFunc(http.HandlerFunc(e.HandlerFunc))
-				fa.router.HandleFunc(e.Path, h.ServeHTTP).Methods(e.Methods...)
-			} else {
-				fa.router.HandleFunc(e.Path, e.HandlerFunc).Methods(e.Methods...)
+				handler = e.MiddlewareFunc(handler)
 			}
-		} else {
-			fa.router.Handle(e.Path, e.Handler).Methods(e.Methods...)
+		}
+
+		for _, permission := range e.RequiredPermissions {
+			handler = fa.RequirePermission(permission)(handler)
+		}
+
+		if len(e.RequiredRoles) > 0 {
+			handler = fa.RequireRole(e.RequiredRoles...)(handler)
+		}
+
+		/*
+		 * Admin endpoints outside of /admin don't go through the admin
+		 * router, so they get the admin check themselves
+		 */
+		if e.Auth == AuthAdmin {
+			if fa.webApp == nil {
+				fa.Logger.Fatalf("admin endpoint '%s' requires a web app. please call AddWebApp() before SetupEndpoints()", e.Path)
+			}
+
+			handler = adminAuthMiddleware(fa.Logger, fa.Config, fa.webApp.GetAdminSessionStore(), &fa.MemberService, fa.routes)(handler)
+		}
+
+		if e.SkipCSRF {
+			fa.csrf.skip(e.Path)
+		}
+
+		route := fa.router.Handle(e.Path, handler).Methods(e.Methods...)
+
+		if e.Auth != "" {
+			fa.routes.add(route, e.Auth, e.AuthResponse)
 		}
 	}
 
@@ -105,10 +155,10 @@ func (fa *FrameApplication) SetupEndpoints(endpoints Endpoints) *FrameApplicatio
 			fa.Logger.Info("registering /static endpoint")
 		}
 
-		fa.router.PathPrefix("/static/").Handler(staticFS).Methods(http.MethodGet)
+		fa.routes.public(fa.router.PathPrefix("/static/").Handler(staticFS).Methods(http.MethodGet))
 	}
 
-	fa.router.PathPrefix("/admin-static/").Handler(adminFs).Methods(http.MethodGet)
+	fa.routes.public(fa.router.PathPrefix("/admin-static/").Handler(adminFs).Methods(http.MethodGet))
 
 	return fa
 }
@@ -18,7 +18,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/app-nerds/gobucket/v2/cmd/gobucketgo"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/gorilla/handlers"
@@ -47,10 +46,13 @@ type FrameApplication struct {
 
 	appName       string
 	cron          *cron.Cron
+	csrf          *csrfProtection
 	externalAuths []goth.Provider
 	hasEndpoints  bool
 	pageSize      int
+	permissions   []Permission
 	router        *mux.Router
+	routes        *routeRegistry
 	templateFS    fs.FS
 	templates     map[string]*template.Template
 	version       string
@@ -62,20 +64,23 @@ type FrameApplication struct {
 	customMemberSignupConfig *CustomMemberSignupConfig
 
 	// Internal services
-	gobucketClient   *gobucketgo.GoBucket
 	memberManagement *MemberManagement
+	passwordHasher   PasswordHasher
 	siteAuth         *SiteAuth
 	webApp           *WebApp
 
 	// Public
-	Config        *Config
-	DB            *sql.DB
-	Logger        *logrus.Entry
-	EmailService  EmailServicer
-	MemberService MemberService
-	NsqPublisher  *nsq.Producer
-	NsqConsumers  []*nsq.Consumer
-	Server        *http.Server
+	AuditLogger         AuditLogger
+	Config              *Config
+	DB                  *sql.DB
+	Logger              *logrus.Entry
+	EmailService        EmailServicer
+	LoginAttemptService LoginAttemptService
+	MemberService       MemberService
+	NsqPublisher        *nsq.Producer
+	NsqConsumers        []*nsq.Consumer
+	Server              *http.Server
+	SessionService      SessionService
 
 	// Hooks
 	OnAuthSuccess func(w http.ResponseWriter, r *http.Request, member Member)
@@ -96,12 +101,14 @@ func NewFrameApplication(appName, version string) *FrameApplication {
 		}),
 		pageSize: 25,
 		router:   mux.NewRouter(),
+		routes:   newRouteRegistry(),
 		version:  version,
 	}
 
 	config := NewConfig(appName, version)
 	result.Logger.Logger.SetLevel(config.GetLogLevel())
 	result.Config = config
+	result.csrf = newCSRFProtection(result.Logger)
 
 	if !config.Debug {
 		result.Logger.Info("setting log format to JSON")
@@ -110,7 +117,6 @@ func NewFrameApplication(appName, version string) *FrameApplication {
 
 	// Attach Fireplace if configured
 	result.withFireplace()
-	result.withGobucket()
 
 	return result
 }
@@ -121,22 +127,51 @@ func (fa *FrameApplication) AddSiteAuth(config SiteAuthConfig) *FrameApplication
 	}
 
 	fa.siteAuth = NewSiteAuth(InternalSiteAuthConfig{
-		FrameStaticFS: frameStaticFS,
-		Logger:        fa.Logger,
-		SessionName:   fa.webApp.GetSessionName(),
-		SessionStore:  fa.webApp.GetSessionStore(),
+		AuditLogger:         &fa.AuditLogger,
+		EmailService:        &fa.EmailService,
+		FrameConfig:         fa.Config,
+		FrameStaticFS:       frameStaticFS,
+		Logger:              fa.Logger,
+		LoginAttemptService: &fa.LoginAttemptService,
+		Routes:              fa.routes,
+		SessionName:         fa.webApp.GetSessionName(),
+		SessionStore:        fa.webApp.GetSessionStore(),
 	}, config)
 
 	fa.memberManagement = NewMemberManagement(InternalMemberManagementConfig{
 		AppName:        fa.appName,
-		GobucketClient: fa.gobucketClient,
+		AuditLogger:    &fa.AuditLogger,
 		Logger:         fa.Logger,
 		MemberService:  &fa.MemberService,
+		SessionService: &fa.SessionService,
+		SiteAuth:       fa.siteAuth,
 		WebApp:         fa.webApp,
 	})
 
 	fa.webApp.memberManagement = fa.memberManagement
 
+	fa.AddCron("@daily", func(app *FrameApplication) {
+		anonymized, err := app.siteAuth.anonymizeDeletedMembers(&app.MemberService)
+
+		if err != nil {
+			app.Logger.WithError(err).Error("error anonymizing deleted members")
+			return
+		}
+
+		app.Logger.WithField("anonymized", anonymized).Debug("anonymized deleted members")
+	})
+
+	fa.AddCron("@hourly", func(app *FrameApplication) {
+		removed, err := app.MemberService.DeleteExpiredMemberDataExports()
+
+		if err != nil {
+			app.Logger.WithError(err).Error("error deleting expired member data exports")
+			return
+		}
+
+		app.Logger.WithField("removed", removed).Debug("deleted expired member data exports")
+	})
+
 	return fa
 }
 
@@ -148,19 +183,39 @@ final binary.
 func (fa *FrameApplication) AddWebApp(config *WebAppConfig) *FrameApplication {
 	fa.webApp = NewWebApp(
 		InternalWebAppConfig{
-			AdminTemplateFS:    adminTemplatesFS,
-			AdminStaticFS:      adminStaticFS,
-			AppName:            fa.appName,
-			Debug:              fa.Config.Debug,
-			Logger:             fa.Logger,
-			FrameConfig:        fa.Config,
-			InternalTemplateFS: internalTemplatesFS,
-			MemberService:      &fa.MemberService,
-			Version:            fa.version,
+			AdminTemplateFS:     adminTemplatesFS,
+			AdminStaticFS:       adminStaticFS,
+			AppName:             fa.appName,
+			AuditLogger:         &fa.AuditLogger,
+			Debug:               fa.Config.Debug,
+			Logger:              fa.Logger,
+			FrameConfig:         fa.Config,
+			InternalTemplateFS:  internalTemplatesFS,
+			LoginAttemptService: &fa.LoginAttemptService,
+			MemberService:       &fa.MemberService,
+			Routes:              fa.routes,
+			SessionService:      &fa.SessionService,
+			Version:             fa.version,
 		},
 		config,
 	)
 
+	/*
+	 * Database sessions need expired rows cleaned up
+	 */
+	if config.SessionType == DatabaseSessionType {
+		fa.AddCron("@hourly", func(app *FrameApplication) {
+			removed, err := app.SessionService.DeleteExpiredSessions()
+
+			if err != nil {
+				app.Logger.WithError(err).Error("error deleting expired sessions")
+				return
+			}
+
+			app.Logger.WithField("removed", removed).Debug("deleted expired sessions")
+		})
+	}
+
 	return fa
 }
 
@@ -172,6 +227,17 @@ func (fa *FrameApplication) AddCron(schedule string, cronFunc func(app *FrameApp
 	return fa
 }
 
+/*
+WithPasswordHasher replaces the hasher chosen by the PASSWORD_HASHER
+setting. New passwords are hashed with it, and members' existing hashes
+are upgraded to it the next time they log in with their password.
+*/
+func (fa *FrameApplication) WithPasswordHasher(hasher PasswordHasher) *FrameApplication {
+	fa.passwordHasher = hasher
+	fa.MemberService.passwordHasher = hasher
+	return fa
+}
+
 func (fa *FrameApplication) AddEmailService() *FrameApplication {
 	fa.Logger.Info("setting up email service...")
 	fa.EmailService = NewEmailService(emailServiceConfig{
@@ -270,24 +336,14 @@ func (fa *FrameApplication) Database(migrationDirectory string) *FrameApplicatio
 	return fa
 }
 
+/*
+GetMemberSession returns the logged in member making this request. An
+empty Member is returned when nobody is logged in. Use MemberFromContext
+to tell the two apart.
+*/
 func (fa *FrameApplication) GetMemberSession(r *http.Request) Member {
-	firstName := r.Context().Value("firstName").(string)
-	lastName := r.Context().Value("lastName").(string)
-	email := r.Context().Value("email").(string)
-	avatarURL := r.Context().Value("avatarURL").(string)
-	memberID := r.Context().Value("memberID").(string)
-	status := r.Context().Value("status").(string)
-
-	return Member{
-		ID:        memberID,
-		AvatarURL: avatarURL,
-		Email:     email,
-		FirstName: firstName,
-		LastName:  lastName,
-		Status: MembersStatus{
-			Status: MemberStatus(status),
-		},
-	}
+	member, _ := MemberFromContext(r.Context())
+	return member
 }
 
 func (fa *FrameApplication) RenderTemplate(w http.ResponseWriter, name string, data interface{}) {
@@ -319,26 +375,57 @@ func (fa *FrameApplication) Start() chan os.Signal {
 		fa.cron.Start()
 	}
 
+	/*
+	 * Write any permissions the application registered
+	 */
+	if len(fa.permissions) > 0 {
+		if fa.DB == nil {
+			fa.Logger.Fatalf("permissions require a database. please call Database() before Start()")
+		}
+
+		if err := fa.MemberService.SyncPermissions(fa.permissions); err != nil {
+			fa.Logger.WithError(err).Fatal("error registering permissions")
+		}
+	}
+
 	/*
 	 * If we have a web app register the admin routes
 	 */
 	if fa.webApp != nil {
 		adminRouter = fa.router.PathPrefix("/admin").Subrouter()
-		adminRouter.Use(adminAuthMiddleware(fa.Logger, fa.Config, fa.webApp.GetAdminSessionStore()))
+		adminRouter.Use(adminAuthMiddleware(fa.Logger, fa.Config, fa.webApp.GetAdminSessionStore(), &fa.MemberService, fa.routes))
+
+		if fa.Config.RootUserEnabled {
+			fa.Logger.Warn("the root admin user is enabled. set ROOT_USER_ENABLED=false once an admin member exists")
+		}
 
 		fa.webApp.RegisterRoutes(fa.router, adminRouter)
 	}
 
 	if fa.siteAuth != nil && fa.webApp != nil {
 		fa.siteAuth.RegisterSiteAuthRoutes(fa.router, fa.webApp, &fa.MemberService)
+
+		if len(fa.externalAuths) > 0 {
+			fa.siteAuth.RegisterExternalAuthRoutes(fa.router, &fa.MemberService, fa.OnAuthSuccess)
+		}
+
 		fa.siteAuth.RegisterStaticFrameAssetsRoute(fa.router)
 		fa.memberManagement.RegisterRoutes(fa.router, adminRouter)
 	}
 
+	/*
+	 * Site auth is what checks member routes
+	 */
+	if fa.siteAuth == nil && fa.routes.hasLevel(AuthMember) {
+		fa.Logger.Fatalf("member endpoints require site auth. please call AddSiteAuth() before Start()")
+	}
+
 	/*
 	 * If we have either endpoints or a web app start the HTTP server
 	 */
 	if fa.hasEndpoints || fa.webApp != nil {
+		fa.logRoutes()
+
 		fa.Logger.WithFields(logrus.Fields{
 			"host":     fa.Config.ServerHost,
 			"debug":    fa.Config.Debug,
@@ -352,6 +439,24 @@ func (fa *FrameApplication) Start() chan os.Signal {
 
 		fa.router.Use(accessControlMiddleware(AllowAllOrigins, AllowAllMethods, AllowAllHeaders))
 
+		/*
+		 * Pages rendered by the web app use cookies, so forms need CSRF
+		 * protection. Token API routes don't use cookies. This is added
+		 * after the site auth middleware so it can tell which requests
+		 * were authenticated with a bearer token.
+		 */
+		if fa.webApp != nil {
+			if fa.siteAuth != nil && fa.siteAuth.jwtAuthEnabled {
+				fa.csrf.skip(MemberApiTokenPath, MemberApiTokenRefreshPath, MemberApiTokenLogoutPath)
+			}
+
+			fa.router.Use(fa.csrf.middleware(fa.webApp, fa.routes, fa.sendCSRFFailedResponse))
+
+			if fa.siteAuth != nil {
+				fa.router.Use(fa.siteAuth.impersonationBannerMiddleware)
+			}
+		}
+
 		fa.Server = &http.Server{
 			Addr:         fa.Config.ServerHost,
 			WriteTimeout: time.Second * time.Duration(fa.Config.ServerWriteTimeout),
@@ -462,6 +567,16 @@ func (fa *FrameApplication) Stop() {
 		}
 	}
 
+	/*
+	 * Wait for member data exports being built in the background
+	 */
+	if fa.memberManagement != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		fa.memberManagement.stopDataExports(ctx)
+	}
+
 	fa.Logger.Info("server stopped.")
 }
 
@@ -471,8 +586,46 @@ func (fa *FrameApplication) Stop() {
 // }
 
 func (fa *FrameApplication) setupServicesThatRequireDB() {
+	var (
+		err error
+	)
+
+	if fa.passwordHasher == nil {
+		if fa.passwordHasher, err = newPasswordHasherFromConfig(fa.Config); err != nil {
+			fa.Logger.WithError(err).Fatal("invalid password hasher configuration")
+		}
+	}
+
 	fa.MemberService = NewMemberService(MemberServiceConfig{
+		DB:             fa.DB,
+		PageSize:       fa.Config.PageSize,
+		PasswordHasher: fa.passwordHasher,
+	})
+
+	fa.SessionService = NewSessionService(SessionServiceConfig{
+		DB: fa.DB,
+	})
+
+	fa.LoginAttemptService = NewLoginAttemptService(LoginAttemptServiceConfig{
+		Config: fa.Config,
+		DB:     fa.DB,
+		Logger: fa.Logger,
+	})
+
+	fa.AuditLogger = NewAuditLogger(AuditLoggerConfig{
 		DB:       fa.DB,
+		Logger:   fa.Logger,
 		PageSize: fa.Config.PageSize,
 	})
+
+	fa.AddCron("@daily", func(app *FrameApplication) {
+		removed, err := app.LoginAttemptService.DeleteOldLoginAttempts()
+
+		if err != nil {
+			app.Logger.WithError(err).Error("error deleting old login attempts")
+			return
+		}
+
+		app.Logger.WithField("removed", removed).Debug("deleted old login attempts")
+	})
 }
@@ -2,7 +2,9 @@ package frame
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -150,16 +152,9 @@ func requestLoggerMiddleware(logger *logrus.Entry) mux.MiddlewareFunc {
 	}
 }
 
-func adminAuthMiddleware(logger *logrus.Entry, config *Config, sessionStore sessions.Store) mux.MiddlewareFunc {
-	pathsExcludedFromAuth := []string{
-		"/admin/login",
-		"/frame-static/",
-		"/admin-static/",
-	}
-
+func adminAuthMiddleware(logger *logrus.Entry, config *Config, sessionStore sessions.Store, memberService *MemberService, routes *routeRegistry) mux.MiddlewareFunc {
 	htmlPaths := []string{
 		"/admin",
-		"/members/manage",
 	}
 
 	return func(next http.Handler) http.Handler {
@@ -173,18 +168,12 @@ func adminAuthMiddleware(logger *logrus.Entry, config *Config, sessionStore sess
 			)
 
 			/*
-			 * If this path is excluded from auth, just keep going
+			 * Every other route needs an admin, including ones that
+			 * didn't declare an auth level
 			 */
-			for _, excludedPath := range pathsExcludedFromAuth {
-				if excludedPath == "/" && r.URL.Path == "/" {
-					next.ServeHTTP(w, r)
-					return
-				}
-
-				if strings.HasPrefix(r.URL.Path, excludedPath) && excludedPath != "/" {
-					next.ServeHTTP(w, r)
-					return
-				}
+			if auth, declared := routes.lookup(r); declared && auth.level == AuthPublic {
+				next.ServeHTTP(w, r)
+				return
 			}
 
 			/*
@@ -204,7 +193,7 @@ func adminAuthMiddleware(logger *logrus.Entry, config *Config, sessionStore sess
 					"path": r.URL.Path,
 				}).Error("user is not authorized")
 
-				adminMiddlewareSendUnauthorizedResponse(w, r, htmlPaths)
+				adminMiddlewareSendUnauthorizedResponse(w, r, routes, htmlPaths)
 				return
 			}
 
@@ -214,24 +203,120 @@ func adminAuthMiddleware(logger *logrus.Entry, config *Config, sessionStore sess
 					"path": r.URL.Path,
 				}).Error("user is not authorized")
 
-				adminMiddlewareSendUnauthorizedResponse(w, r, htmlPaths)
+				adminMiddlewareSendUnauthorizedResponse(w, r, routes, htmlPaths)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), "adminUserName", adminUserName)
+			adminMemberID, _ := session.Values["adminMemberID"].(string)
+
+			/*
+			 * Admins who are changed since they logged in must still be
+			 * active members with the Admin role
+			 */
+			if adminMemberID != "" {
+				if ok, err = syncAdminSession(w, r, session, sessionStore, memberService, adminMemberID); err != nil {
+					logger.WithError(err).Error("error checking admin session epoch")
+					http.Redirect(w, r, UnexpectedErrorPath, http.StatusFound)
+					return
+				}
+
+				if !ok {
+					logger.WithFields(logrus.Fields{
+						"ip":            RealIP(r),
+						"adminMemberID": adminMemberID,
+					}).Info("admin can no longer log in. ending their session")
+
+					adminMiddlewareSendUnauthorizedResponse(w, r, routes, htmlPaths)
+					return
+				}
+			}
+
+			/*
+			 * Root user sessions end as soon as the root user is turned off
+			 */
+			if adminMemberID == "" && !config.RootUserEnabled {
+				logger.WithField("ip", RealIP(r)).Info("root user is disabled. ending their session")
+
+				session.Options.MaxAge = -1
+
+				if err = sessionStore.Save(r, w, session); err != nil {
+					logger.WithError(err).Error("error ending root user session")
+				}
+
+				adminMiddlewareSendUnauthorizedResponse(w, r, routes, htmlPaths)
+				return
+			}
+
+			adminUserName, _ = session.Values["adminUserName"].(string)
+
+			/*
+			 * The root user isn't a member. Every other admin is a member
+			 * with the Admin role.
+			 */
+			principal := newPrincipal(AuthMethodRootUser, memberService)
+			principal.Email = adminUserName
+			principal.Role = AdminMemberRole
+			principal.RoleID = AdminMemberRoleID
+			principal.Status = MemberActive
+
+			if adminMemberID != "" {
+				principal.AuthMethod = AuthMethodAdminSession
+				principal.MemberID = adminMemberID
+			}
+
+			ctx := context.WithValue(r.Context(), adminPrincipalContextKey, principal)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func adminMiddlewareSendUnauthorizedResponse(w http.ResponseWriter, r *http.Request, htmlResponsePaths []string) {
-	for _, path := range htmlResponsePaths {
-		if strings.HasPrefix(r.URL.Path, path) {
-			http.Redirect(w, r, fmt.Sprintf("%s?referer=%s", AdminLoginPath, r.URL.Path), http.StatusFound)
-			return
+/*
+syncAdminSession ends an admin session if the member behind it has been
+changed, and is no longer an active member with the Admin role. It returns
+false if the session was ended.
+*/
+func syncAdminSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, sessionStore sessions.Store, memberService *MemberService, adminMemberID string) (bool, error) {
+	var (
+		err          error
+		currentEpoch int
+		member       Member
+	)
+
+	sessionEpoch, _ := session.Values["adminSessionEpoch"].(int)
+	currentEpoch, err = memberService.GetMemberSessionEpoch(adminMemberID)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return true, err
+	}
+
+	if err == nil && currentEpoch == sessionEpoch {
+		return true, nil
+	}
+
+	if err == nil {
+		member, err = memberService.GetMemberByID(adminMemberID, false)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return true, err
 		}
 	}
 
+	if err != nil || member.Role.ID != AdminMemberRoleID || member.Status.ID != MemberActiveID {
+		session.Options.MaxAge = -1
+		return false, sessionStore.Save(r, w, session)
+	}
+
+	session.Values["adminUserName"] = member.Email
+	session.Values["adminSessionEpoch"] = member.SessionEpoch
+	return true, sessionStore.Save(r, w, session)
+}
+
+func adminMiddlewareSendUnauthorizedResponse(w http.ResponseWriter, r *http.Request, routes *routeRegistry, htmlResponsePaths []string) {
+	if routes.wantsHTML(r, htmlResponsePaths) {
+		http.Redirect(w, r, fmt.Sprintf("%s?referer=%s", AdminLoginPath, r.URL.Path), http.StatusFound)
+		return
+	}
+
 	result := map[string]interface{}{
 		"success": false,
 		"error":   "User unauthorized",